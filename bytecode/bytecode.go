@@ -0,0 +1,358 @@
+// Package bytecode stores compiled Monkey programs in a portable binary
+// format, so that they can be run without parsing and compiling them again.
+//
+// A file starts with Magic and a big-endian uint16 Version, followed by the
+// program:
+//
+//	program  = string(filename) uvarint(n) string(builtin)*n
+//	           function(main) uvarint(n) constant*n
+//	function = bytes(instructions) uvarint(locals) uvarint(params)
+//	           string(name) string(filename) lines handlers frees
+//	           bool(captures)
+//	constant = tag payload
+//
+// Integers are zig-zag varints, or a sign and big-endian bytes when they do
+// not fit in 64 bits, and counts and offsets uvarints. Strings and byte
+// slices are prefixed by their length. Builtins are referred to by their
+// index in the builtin set the program was compiled with, whose names the
+// file lists so that the virtual machine can check it has the same
+// builtins.
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/object"
+	"io"
+	"math"
+	"math/big"
+)
+
+// Magic identifies a Monkey bytecode file.
+const Magic = "MKBC"
+
+// Version is the version of the format Encode writes and Decode reads.
+const Version = 4
+
+// constant tags
+const (
+	tagInteger byte = iota + 1
+	tagFloat
+	tagString
+	tagFunction
+	tagBigInt
+)
+
+// IsBytecode reports whether data starts like a Monkey bytecode file.
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Encode writes bc to w.
+func Encode(w io.Writer, bc *compiler.Bytecode) error {
+	e := &encoder{}
+
+	e.buf.WriteString(Magic)
+	e.buf.Write(binary.BigEndian.AppendUint16(nil, Version))
+
+	e.string(bc.Filename)
+	e.uvarint(len(bc.Builtins))
+	for _, name := range bc.Builtins {
+		e.string(name)
+	}
+	e.function(&object.CompiledFunction{
+		Instructions: bc.Instructions,
+		Filename:     bc.Filename,
+		Lines:        bc.Lines,
+		Handlers:     bc.Handlers,
+	})
+
+	e.uvarint(len(bc.Constants))
+	for i, constant := range bc.Constants {
+		if err := e.constant(constant); err != nil {
+			return fmt.Errorf("bytecode: constant %d: %w", i, err)
+		}
+	}
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(n int) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(len(b))
+	e.buf.Write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) constant(constant object.Object) error {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.buf.Write(binary.AppendVarint(nil, constant.Value))
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(constant.Value)))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.string(constant.Value)
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagFunction)
+		e.function(constant)
+	case *object.BigInt:
+		e.buf.WriteByte(tagBigInt)
+		e.bool(constant.Value.Sign() < 0)
+		e.bytes(constant.Value.Bytes())
+	default:
+		return fmt.Errorf("cannot encode %s", constant.Type())
+	}
+	return nil
+}
+
+func (e *encoder) function(fn *object.CompiledFunction) {
+	e.bytes(fn.Instructions)
+	e.uvarint(fn.NumLocals)
+	e.uvarint(fn.NumParameters)
+	e.string(fn.Name)
+	e.string(fn.Filename)
+
+	e.uvarint(len(fn.Lines))
+	for _, entry := range fn.Lines {
+		e.uvarint(entry.Offset)
+		e.uvarint(entry.Line)
+	}
+
+	e.uvarint(len(fn.Handlers))
+	for _, h := range fn.Handlers {
+		e.uvarint(h.Start)
+		e.uvarint(h.End)
+		e.uvarint(h.Target)
+		e.uvarint(h.Depth)
+	}
+
+	e.uvarint(len(fn.FreeNames))
+	for _, name := range fn.FreeNames {
+		e.string(name)
+	}
+
+	e.bool(fn.CapturesLocals)
+}
+
+var errTruncated = errors.New("bytecode: unexpected end of file")
+
+// Decode reads a program written by Encode. It checks that the file is
+// well formed and that its instructions only refer to constants, variables
+// and offsets that exist. Errors of the program itself, such as calling a
+// value that is not a function, are left to the virtual machine.
+func Decode(r io.Reader) (*compiler.Bytecode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsBytecode(data) {
+		return nil, errors.New("bytecode: not a Monkey bytecode file")
+	}
+	d := &decoder{data: data[len(Magic):]}
+
+	if len(d.data) < 2 {
+		return nil, errTruncated
+	}
+	version := binary.BigEndian.Uint16(d.data)
+	d.data = d.data[2:]
+	if version != Version {
+		return nil, fmt.Errorf("bytecode: unsupported version %d, want %d", version, Version)
+	}
+
+	bc := &compiler.Bytecode{}
+	bc.Filename = d.string()
+
+	if n := d.count(); n > 0 {
+		bc.Builtins = make([]string, n)
+		for i := range bc.Builtins {
+			bc.Builtins[i] = d.string()
+		}
+	}
+
+	main := d.function()
+	bc.Instructions = main.Instructions
+	bc.Lines = main.Lines
+	bc.Handlers = main.Handlers
+
+	bc.Constants = make([]object.Object, d.count())
+	for i := range bc.Constants {
+		bc.Constants[i] = d.constant()
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.data) != 0 {
+		return nil, fmt.Errorf("bytecode: %d unexpected bytes at end of file", len(d.data))
+	}
+
+	if err := compiler.Verify(bc); err != nil {
+		return nil, fmt.Errorf("bytecode: %w", err)
+	}
+
+	return bc, nil
+}
+
+// decoder reads values off data. After the first error it stops consuming
+// input and returns zero values; err holds the error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail(errTruncated)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() int {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 || n > math.MaxInt32 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+// count reads the length of a sequence, each element of which takes up at
+// least one byte, so that corrupt lengths fail before allocating.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > len(d.data) {
+		d.fail(errTruncated)
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	b := make([]byte, n)
+	copy(b, d.data)
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		n, size := binary.Varint(d.data)
+		if size <= 0 {
+			d.fail(errTruncated)
+			return nil
+		}
+		d.data = d.data[size:]
+		return &object.Integer{Value: n}
+	case tagFloat:
+		if len(d.data) < 8 {
+			d.fail(errTruncated)
+			return nil
+		}
+		bits := binary.BigEndian.Uint64(d.data)
+		d.data = d.data[8:]
+		return &object.Float{Value: math.Float64frombits(bits)}
+	case tagString:
+		return &object.String{Value: d.string()}
+	case tagFunction:
+		return d.function()
+	case tagBigInt:
+		negative := d.bool()
+		value := new(big.Int).SetBytes(d.bytes())
+		if negative {
+			value.Neg(value)
+		}
+		return object.NewInteger(value)
+	default:
+		if d.err == nil {
+			d.fail(fmt.Errorf("bytecode: unknown constant tag %d", tag))
+		}
+		return nil
+	}
+}
+
+func (d *decoder) function() *object.CompiledFunction {
+	fn := &object.CompiledFunction{}
+
+	fn.Instructions = code.Instructions(d.bytes())
+	fn.NumLocals = d.uvarint()
+	fn.NumParameters = d.uvarint()
+	fn.Name = d.string()
+	fn.Filename = d.string()
+
+	if n := d.count(); n > 0 {
+		fn.Lines = make(code.LineTable, n)
+		for i := range fn.Lines {
+			fn.Lines[i] = code.LineEntry{Offset: d.uvarint(), Line: d.uvarint()}
+		}
+	}
+
+	if n := d.count(); n > 0 {
+		fn.Handlers = make(code.HandlerTable, n)
+		for i := range fn.Handlers {
+			fn.Handlers[i] = code.Handler{
+				Start:  d.uvarint(),
+				End:    d.uvarint(),
+				Target: d.uvarint(),
+				Depth:  d.uvarint(),
+			}
+		}
+	}
+
+	if n := d.count(); n > 0 {
+		fn.FreeNames = make([]string, n)
+		for i := range fn.FreeNames {
+			fn.FreeNames[i] = d.string()
+		}
+	}
+
+	fn.CapturesLocals = d.bool()
+	return fn
+}
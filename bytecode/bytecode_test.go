@@ -0,0 +1,408 @@
+package bytecode
+
+import (
+	"bytes"
+	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/lexer"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/parser"
+	"github.com/mehrankamal/monkey/vm"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2", "3"},
+		{"-9223372036854775807 - 1", "-9223372036854775808"},
+		{"1.5 * 2.25", "3.375"},
+		{"99999999999999999999 + 1", "100000000000000000000"},
+		{"0x1_0000_0000_0000_0000 - 1", "18446744073709551615"},
+		{`"mon" + "key"`, "monkey"},
+		{`[1, "two", [3.5]]`, "[1, two, [3.5]]"},
+		{`{"a": 1}["a"]`, "1"},
+		{"let add = fn(a, b) { a + b }; add(1, 2)", "3"},
+		{"let adder = fn(a) { fn(b) { fn(c) { a + b + c } } }; adder(1)(2)(3)", "6"},
+		{"let counter = fn() { let n = 0; fn() { n += 1 } }; let c = counter(); c(); c()", "2"},
+		{"let f = fn(n) { if (n == 0) { return 0 } f(n - 1) }; f(10000)", "0"},
+		{`let r = ""; try { len(1) } catch (e) { r = e["message"] } finally { r += "!" }; r`,
+			"argument to `len` not supported, got INTEGER!"},
+		{"let n = 0; for (x in [1, 2, 3]) { if (x == 2) { continue } n += x }; n", "4"},
+	}
+
+	for _, tt := range tests {
+		bc := compile(t, tt.input)
+
+		var buf bytes.Buffer
+		if err := Encode(&buf, bc); err != nil {
+			t.Fatalf("encode error for %q: %s", tt.input, err)
+		}
+
+		decoded, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("decode error for %q: %s", tt.input, err)
+		}
+
+		machine := vm.New(decoded)
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		result := machine.LastPoppedStackElem().Inspect()
+		if result != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, result)
+		}
+	}
+}
+
+func TestRoundTripPreservesFunctions(t *testing.T) {
+	input := `let outer = fn(a, b) {
+	let c = a;
+	let inner = fn() { try { c } catch (e) { 0 } };
+	inner
+};
+outer(1, 2)();`
+
+	bc := compile(t, input)
+	bc.Filename = "outer.mk"
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, bc); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if decoded.Filename != bc.Filename {
+		t.Errorf("wrong filename. want=%q, got=%q", bc.Filename, decoded.Filename)
+	}
+	if !reflect.DeepEqual(decoded.Builtins, bc.Builtins) {
+		t.Errorf("wrong builtins. want=%v, got=%v", bc.Builtins, decoded.Builtins)
+	}
+	assertSameFunction(t, "main",
+		&object.CompiledFunction{Instructions: bc.Instructions, Lines: bc.Lines, Handlers: bc.Handlers},
+		&object.CompiledFunction{Instructions: decoded.Instructions, Lines: decoded.Lines, Handlers: decoded.Handlers})
+
+	if len(decoded.Constants) != len(bc.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(bc.Constants), len(decoded.Constants))
+	}
+
+	functions := 0
+	for i, constant := range bc.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			if !reflect.DeepEqual(constant, decoded.Constants[i]) {
+				t.Errorf("constant %d differs. want=%+v, got=%+v", i, constant, decoded.Constants[i])
+			}
+			continue
+		}
+
+		functions++
+		decodedFn, ok := decoded.Constants[i].(*object.CompiledFunction)
+		if !ok {
+			t.Fatalf("constant %d is not CompiledFunction. got=%T", i, decoded.Constants[i])
+		}
+		assertSameFunction(t, fn.Name, fn, decodedFn)
+	}
+
+	if functions != 2 {
+		t.Errorf("expected 2 functions in the constant pool, got %d", functions)
+	}
+}
+
+func TestRoundTripChecksBuiltins(t *testing.T) {
+	p := parser.New(lexer.New(`len("abc")`))
+	comp := compiler.NewWithBuiltins(object.PureBuiltins())
+	if err := comp.Compile(p.ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	decoded, err := Decode(bytes.NewReader(encode(t, comp.Bytecode())))
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	machine := vm.New(decoded)
+	err = machine.Run()
+	if err == nil || err.Error() != "program compiled with builtin 1 first, but it is puts" {
+		t.Errorf("expected the default builtins to be rejected, got %v", err)
+	}
+
+	machine = vm.New(decoded)
+	machine.Config().Builtins = object.PureBuiltins()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if result := machine.LastPoppedStackElem().Inspect(); result != "3" {
+		t.Errorf("wrong result. want=3, got=%s", result)
+	}
+}
+
+func TestRoundTripBigInts(t *testing.T) {
+	value, _ := new(big.Int).SetString("-1180591620717411303424", 10)
+	bc := &compiler.Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants:    []object.Object{&object.BigInt{Value: value}},
+	}
+
+	decoded, err := Decode(bytes.NewReader(encode(t, bc)))
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	constant, ok := decoded.Constants[0].(*object.BigInt)
+	if !ok {
+		t.Fatalf("constant is not BigInt. got=%T (%+v)", decoded.Constants[0], decoded.Constants[0])
+	}
+	if constant.Value.Cmp(value) != 0 {
+		t.Errorf("wrong constant. want=%s, got=%s", value, constant.Value)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := encode(t, compile(t, `let f = fn(x) { x + "a" }; f("b")`))
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{}, "bytecode: not a Monkey bytecode file"},
+		{[]byte("#!/usr/bin/env monkey\n"), "bytecode: not a Monkey bytecode file"},
+		{[]byte(Magic), "bytecode: unexpected end of file"},
+		{[]byte(Magic + "\x00\x03"), "bytecode: unsupported version 3, want 4"},
+		{append(append([]byte{}, valid...), 0), "bytecode: 1 unexpected bytes at end of file"},
+		{emptyProgramWith(99), "bytecode: unknown constant tag 99"},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(tt.data))
+		if err == nil {
+			t.Errorf("expected error for %q, got none", tt.data)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.data, tt.expected, err)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	valid := encode(t, compile(t, `let f = fn(x) { try { x } catch (e) { 1.5 } }; f("b")`))
+
+	for i := len(Magic); i < len(valid); i++ {
+		_, err := Decode(bytes.NewReader(valid[:i]))
+		if err == nil {
+			t.Fatalf("expected error for file truncated to %d of %d bytes, got none", i, len(valid))
+		}
+	}
+}
+
+func TestDecodeInvalidInstructions(t *testing.T) {
+	function := func(ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concatInstructions(ins...), Name: "f", NumLocals: 1, FreeNames: []string{"x"}}
+	}
+	one := []object.Object{&object.Integer{Value: 1}}
+
+	tests := []struct {
+		bc       *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: []byte{255}},
+			"bytecode: invalid function <main>: opcode 255 undefined at 0",
+		},
+		{
+			&compiler.Bytecode{Instructions: concatInstructions(code.Make(code.OpNull), code.Make(code.OpConstant, 0)[:2])},
+			"bytecode: invalid function <main>: OpConstant at 1 needs 3 bytes, 2 left",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 1), Constants: one},
+			"bytecode: invalid function <main>: OpConstant at 0: constant 1 of 1",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: one},
+			"bytecode: invalid function <main>: OpClosure at 0: constant 0 is not a function",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{function()}},
+			"bytecode: invalid function <main>: OpClosure at 0: 0 free variables, function has 1",
+		},
+		{
+			&compiler.Bytecode{Instructions: concatInstructions(code.Make(code.OpTrue), code.Make(code.OpJumpFalsy, 2))},
+			"bytecode: invalid function <main>: OpJumpFalsy at 1: jump to 2",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpJump, 4)},
+			"bytecode: invalid function <main>: OpJump at 0: jump to 4",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpGetLocal, 0)},
+			"bytecode: invalid function <main>: OpGetLocal at 0: local 0 of 0",
+		},
+		{
+			&compiler.Bytecode{Constants: []object.Object{function(code.Make(code.OpSetLocal, 1))}},
+			"bytecode: invalid function f: OpSetLocal at 0: local 1 of 1",
+		},
+		{
+			&compiler.Bytecode{Constants: []object.Object{function(code.Make(code.OpGetFree, 1))}},
+			"bytecode: invalid function f: OpGetFree at 0: free variable 1 of 1",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpNull), Handlers: code.HandlerTable{{Start: 0, End: 1, Target: 1}}},
+			"bytecode: invalid function <main>: handler [0, 1) to 1",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpPop)},
+			"bytecode: invalid function <main>: OpPop at 0 takes 1 values, 0 on the stack",
+		},
+		{
+			&compiler.Bytecode{Instructions: concatInstructions(code.Make(code.OpTrue), code.Make(code.OpJumpFalsy, 5),
+				code.Make(code.OpNull), code.Make(code.OpPop))},
+			"bytecode: invalid function <main>: 1 values on the stack at 5, 0 on another path",
+		},
+		{
+			&compiler.Bytecode{Constants: []object.Object{function(code.Make(code.OpNull))}},
+			"bytecode: invalid function f: runs off the end",
+		},
+		{
+			&compiler.Bytecode{Instructions: concatInstructions(code.Make(code.OpNull), code.Make(code.OpTailCall, 0))},
+			"bytecode: invalid function <main>: OpTailCall at 1: tail call outside of a function",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(encode(t, tt.bc)))
+		if err == nil {
+			t.Errorf("expected error for %q, got none", tt.bc.Instructions)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.bc.Instructions, tt.expected, err)
+		}
+	}
+}
+
+// TestDecodeCorrupt changes each byte of a valid file and runs whatever
+// still decodes, which must fail or succeed without panicking.
+func TestDecodeCorrupt(t *testing.T) {
+	valid := encode(t, compile(t, `
+		let f = fn(xs) { let n = 0; for (x in xs) { n += x }; fn() { n } };
+		let r = 0;
+		try { r = f([1, 2, {"a": [3]}])() } catch (e) { r = e["message"] };
+		[r, f([4])(), len("abc")]
+	`))
+
+	for i := len(Magic) + 2; i < len(valid); i++ {
+		for _, b := range []byte{0, 1, 2, 0x7f, 0xff, valid[i] + 1, valid[i] - 1} {
+			data := append([]byte{}, valid...)
+			data[i] = b
+
+			decoded, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+
+			machine := vm.New(decoded)
+			machine.Config().MaxInstructions = 10000
+			machine.Run()
+		}
+	}
+}
+
+func TestEncodeUnsupportedConstant(t *testing.T) {
+	bc := &compiler.Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants:    []object.Object{&object.Array{}},
+	}
+
+	err := Encode(&bytes.Buffer{}, bc)
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if !strings.Contains(err.Error(), "cannot encode ARRAY") {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
+
+// emptyProgramWith returns a program with no instructions and a single
+// constant with the given tag and no payload.
+func emptyProgramWith(tag byte) []byte {
+	data := []byte(Magic + "\x00\x04")
+	data = append(data, 0)                         // filename
+	data = append(data, 0)                         // builtins
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 0) // main function
+	data = append(data, 1, tag)                    // constants
+	return data
+}
+
+func concatInstructions(instructions ...[]byte) code.Instructions {
+	out := code.Instructions{}
+
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.Bytecode()
+}
+
+func encode(t *testing.T, bc *compiler.Bytecode) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, bc); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func assertSameFunction(t *testing.T, name string, want, got *object.CompiledFunction) {
+	t.Helper()
+
+	if !bytes.Equal(want.Instructions, got.Instructions) {
+		t.Errorf("%s: wrong instructions.\nwant=%q\ngot=%q", name, want.Instructions, got.Instructions)
+	}
+	if want.NumLocals != got.NumLocals || want.NumParameters != got.NumParameters {
+		t.Errorf("%s: wrong locals or parameters. want=%d/%d, got=%d/%d", name,
+			want.NumLocals, want.NumParameters, got.NumLocals, got.NumParameters)
+	}
+	if want.Name != got.Name || want.Filename != got.Filename {
+		t.Errorf("%s: wrong name or filename. want=%q/%q, got=%q/%q", name,
+			want.Name, want.Filename, got.Name, got.Filename)
+	}
+	if len(want.Lines) != len(got.Lines) || (len(want.Lines) > 0 && !reflect.DeepEqual(want.Lines, got.Lines)) {
+		t.Errorf("%s: wrong lines. want=%v, got=%v", name, want.Lines, got.Lines)
+	}
+	if len(want.Handlers) != len(got.Handlers) || (len(want.Handlers) > 0 && !reflect.DeepEqual(want.Handlers, got.Handlers)) {
+		t.Errorf("%s: wrong handlers. want=%v, got=%v", name, want.Handlers, got.Handlers)
+	}
+	if strings.Join(want.FreeNames, ",") != strings.Join(got.FreeNames, ",") {
+		t.Errorf("%s: wrong free names. want=%v, got=%v", name, want.FreeNames, got.FreeNames)
+	}
+	if want.CapturesLocals != got.CapturesLocals {
+		t.Errorf("%s: wrong CapturesLocals. want=%t, got=%t", name, want.CapturesLocals, got.CapturesLocals)
+	}
+}
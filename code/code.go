@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
 )
 
 type Definition struct {
@@ -11,6 +12,16 @@ type Definition struct {
 	OperandWidths []int
 }
 
+// Width returns the length in bytes of an instruction with this
+// definition, opcode included.
+func (d *Definition) Width() int {
+	width := 1
+	for _, w := range d.OperandWidths {
+		width += w
+	}
+	return width
+}
+
 type Instructions []byte
 
 func (ins Instructions) String() string {
@@ -20,10 +31,16 @@ func (ins Instructions) String() string {
 	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			i++
 			continue
 		}
 
+		if width := def.Width(); i+width > len(ins) {
+			fmt.Fprintf(&out, "%04d ERROR: %s needs %d bytes, %d left\n", i, def.Name, width, len(ins)-i)
+			break
+		}
+
 		operands, read := ReadOperands(def, ins[i+1:])
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
 
@@ -53,6 +70,49 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
 
+// LineEntry marks that the instructions starting at Offset were compiled
+// from source line Line. It holds until the next entry's Offset.
+type LineEntry struct {
+	Offset int
+	Line   int
+}
+
+// LineTable maps instruction offsets to source lines. Entries are sorted by
+// Offset.
+type LineTable []LineEntry
+
+// Line returns the source line of the instruction at offset, or 0 if unknown.
+func (lt LineTable) Line(offset int) int {
+	i := sort.Search(len(lt), func(i int) bool { return lt[i].Offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return lt[i-1].Line
+}
+
+// Handler sends errors raised by the instructions in [Start, End) to the
+// handler code at Target. The stack is cut back to Depth values above the
+// frame's locals and the caught value is pushed before jumping.
+type Handler struct {
+	Start  int
+	End    int
+	Target int
+	Depth  int
+}
+
+// HandlerTable lists the handlers of a function, innermost first.
+type HandlerTable []Handler
+
+// Lookup returns the innermost handler covering the instruction at offset.
+func (ht HandlerTable) Lookup(offset int) (Handler, bool) {
+	for _, h := range ht {
+		if h.Start <= offset && offset < h.End {
+			return h, true
+		}
+	}
+	return Handler{}, false
+}
+
 type Opcode byte
 
 const (
@@ -67,17 +127,32 @@ const (
 	OpSub
 	OpMul
 	OpDiv
+	OpMod
+	OpPow
+
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpShiftLeft
+	OpShiftRight
 
 	OpNegate
 	OpBang
+	OpBitNot
 
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
+	OpGreaterThanOrEqual
+	OpLessThan
+	OpLessThanOrEqual
 
 	OpJumpFalsy
 	OpJump
 
+	OpIter
+	OpIterNext
+
 	OpSetGlobal
 	OpGetGlobal
 
@@ -88,15 +163,22 @@ const (
 	OpHash
 
 	OpIndex
+	OpSetIndex
+	OpDup2
 
 	OpCall
+	OpTailCall
 	OpReturnValue
 	OpReturn
+	OpThrow
 
 	OpGetBuiltin
 
 	OpClosure
 	OpGetFree
+	OpSetFree
+	OpCaptureLocal
+	OpCaptureFree
 	OpCurrentClosure
 )
 
@@ -112,17 +194,32 @@ var definitions = map[Opcode]*Definition{
 	OpSub: {"OpSub", []int{}},
 	OpMul: {"OpMul", []int{}},
 	OpDiv: {"OpDiv", []int{}},
+	OpMod: {"OpMod", []int{}},
+	OpPow: {"OpPow", []int{}},
+
+	OpBitAnd:     {"OpBitAnd", []int{}},
+	OpBitOr:      {"OpBitOr", []int{}},
+	OpBitXor:     {"OpBitXor", []int{}},
+	OpShiftLeft:  {"OpShiftLeft", []int{}},
+	OpShiftRight: {"OpShiftRight", []int{}},
 
 	OpNegate: {"OpNegate", []int{}},
 	OpBang:   {"OpBang", []int{}},
+	OpBitNot: {"OpBitNot", []int{}},
 
-	OpEqual:       {"OpEqual", []int{}},
-	OpNotEqual:    {"OpNotEqual", []int{}},
-	OpGreaterThan: {"OpGreaterThan", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpGreaterThan:        {"OpGreaterThan", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpLessThan:           {"OpLessThan", []int{}},
+	OpLessThanOrEqual:    {"OpLessThanOrEqual", []int{}},
 
 	OpJumpFalsy: {"OpJumpFalsy", []int{2}},
 	OpJump:      {"OpJump", []int{2}},
 
+	OpIter:     {"OpIter", []int{}},
+	OpIterNext: {"OpIterNext", []int{2}},
+
 	OpSetGlobal: {"OpSetGlobal", []int{2}},
 	OpGetGlobal: {"OpGetGlobal", []int{2}},
 
@@ -132,16 +229,23 @@ var definitions = map[Opcode]*Definition{
 	OpArray: {"OpArray", []int{2}},
 	OpHash:  {"OpHash", []int{2}},
 
-	OpIndex: {"OpIndex", []int{}},
+	OpIndex:    {"OpIndex", []int{}},
+	OpSetIndex: {"OpSetIndex", []int{}},
+	OpDup2:     {"OpDup2", []int{}},
 
 	OpCall:        {"OpCall", []int{1}},
+	OpTailCall:    {"OpTailCall", []int{1}},
 	OpReturnValue: {"OpReturnValue", []int{}},
 	OpReturn:      {"OpReturn", []int{}},
+	OpThrow:       {"OpThrow", []int{}},
 
 	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
 
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
 }
 
@@ -161,12 +265,7 @@ func Make(op Opcode, operands ...int) []byte {
 		return []byte{}
 	}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
-	}
-
-	instruction := make([]byte, instructionLen)
+	instruction := make([]byte, def.Width())
 	instruction[0] = byte(op)
 
 	offset := 1
@@ -56,6 +56,29 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringMalformed(t *testing.T) {
+	tests := []struct {
+		instructions Instructions
+		expected     string
+	}{
+		{
+			Instructions{255, byte(OpPop)},
+			"0000 ERROR: opcode 255 undefined\n0001 OpPop\n",
+		},
+		{
+			Instructions{byte(OpPop), byte(OpConstant), 1},
+			"0000 OpPop\n0001 ERROR: OpConstant needs 3 bytes, 2 left\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.instructions.String() != tt.expected {
+			t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q",
+				tt.expected, tt.instructions.String())
+		}
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
@@ -85,3 +108,35 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestLineTable(t *testing.T) {
+	lines := LineTable{
+		{Offset: 0, Line: 1},
+		{Offset: 4, Line: 3},
+		{Offset: 9, Line: 2},
+	}
+
+	tests := []struct {
+		offset   int
+		expected int
+	}{
+		{-1, 0},
+		{0, 1},
+		{3, 1},
+		{4, 3},
+		{8, 3},
+		{9, 2},
+		{100, 2},
+	}
+
+	for _, tt := range tests {
+		if got := lines.Line(tt.offset); got != tt.expected {
+			t.Errorf("wrong line for offset %d. want=%d, got=%d",
+				tt.offset, tt.expected, got)
+		}
+	}
+
+	if got := (LineTable{}).Line(0); got != 0 {
+		t.Errorf("wrong line for empty table. want=0, got=%d", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/mehrankamal/monkey/ast"
 	"github.com/mehrankamal/monkey/code"
 	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/token"
 	"sort"
 )
 
@@ -15,8 +16,59 @@ type EmittedInstruction struct {
 
 type CompilationScope struct {
 	instructions        code.Instructions
+	lines               code.LineTable
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	// loops enclosing the code being compiled, innermost last
+	loops []*loop
+
+	// try statements enclosing the code being compiled, innermost last,
+	// and the handlers of those already compiled
+	tries    []*tryBlock
+	handlers code.HandlerTable
+
+	// values on the stack above the frame's locals at the current
+	// instruction, recorded in handlers to unwind the stack to
+	depth int
+}
+
+// loop collects the jumps of a while or for-in loop.
+type loop struct {
+	continueTarget int
+	breakJumps     []int // OpJump positions patched to the loop's exit
+	hasIterator    bool  // a for-in iterator sits on the stack
+	tryDepth       int   // try statements enclosing the loop
+	depth          int   // values above the locals when the body starts
+}
+
+// tryBlock collects the instruction ranges protected by a try block, or by
+// the catch block of a try with a finally block. The range is cut around
+// the finally code inlined where a return, break or continue leaves it.
+type tryBlock struct {
+	finally *ast.BlockStatement
+	start   int // start of the open range
+	ranges  []code.Handler
+}
+
+func (t *tryBlock) open(pos int) {
+	t.start = pos
+}
+
+func (t *tryBlock) close(pos int) {
+	if pos > t.start {
+		t.ranges = append(t.ranges, code.Handler{Start: t.start, End: pos})
+	}
+}
+
+// Error is a compilation error located at the node that caused it.
+type Error struct {
+	Pos     token.Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
 }
 
 type Compiler struct {
@@ -25,9 +77,26 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// position of the node currently being compiled, recorded in the
+	// line table of every instruction emitted for it
+	position token.Position
+	filename string
+
+	// calls whose value the enclosing function returns directly, compiled
+	// to OpTailCall
+	tailCalls map[*ast.CallExpression]bool
 }
 
+// New returns a compiler for programs using the builtins of
+// object.Builtins.
 func New() *Compiler {
+	return NewWithBuiltins(object.Builtins)
+}
+
+// NewWithBuiltins returns a compiler for programs using the builtins of
+// set. The machine running them must have the same set.
+func NewWithBuiltins(set object.BuiltinSet) *Compiler {
 	mainScope := CompilationScope{
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
@@ -35,10 +104,7 @@ func New() *Compiler {
 	}
 
 	symbolTable := NewSymbolTable()
-
-	for idx, builtin := range object.Builtins {
-		symbolTable.DefineBuiltin(idx, builtin.Name)
-	}
+	symbolTable.DefineBuiltins(set)
 
 	return &Compiler{
 		constants:   []object.Object{},
@@ -46,6 +112,8 @@ func New() *Compiler {
 
 		scopes:     []CompilationScope{mainScope},
 		scopeIndex: 0,
+
+		tailCalls: map[*ast.CallExpression]bool{},
 	}
 }
 
@@ -57,8 +125,17 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	if node != nil {
+		previous := c.position
+		if pos := node.Pos(); pos.IsValid() {
+			c.position = pos
+		}
+		defer func() { c.position = previous }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
+		c.filename = node.Pos().Filename
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -103,22 +180,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpBang)
 		case "-":
 			c.emit(code.OpNegate)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
-			return fmt.Errorf("unknown operator %s for prefix expressions", node.Operator)
+			return c.errorf("unknown operator %s for prefix expressions", node.Operator)
 		}
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 
 		err := c.Compile(node.Left)
@@ -140,15 +209,37 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "**":
+			c.emit(code.OpPow)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShiftLeft)
+		case ">>":
+			c.emit(code.OpShiftRight)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterThanOrEqual)
+		case "<":
+			c.emit(code.OpLessThan)
+		case "<=":
+			c.emit(code.OpLessThanOrEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return c.errorf("unknown operator %s", node.Operator)
 		}
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
 	case *ast.IfExpression:
 		err := c.Compile(node.Condition)
 		if err != nil {
@@ -156,20 +247,20 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		jumpFalsyPos := c.emit(code.OpJumpFalsy, 9999)
+		depth := c.scopes[c.scopeIndex].depth
 
 		err = c.Compile(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIsOp(code.OpPop) {
-			c.removeLastInstruction()
-		}
+		c.blockValue(node.Consequence)
 
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpFalsyPos, afterConsequencePos)
+		c.scopes[c.scopeIndex].depth = depth
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
@@ -178,18 +269,58 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
-			if c.lastInstructionIsOp(code.OpPop) {
-				c.removeLastInstruction()
-			}
+			c.blockValue(node.Alternative)
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
 
+	case *ast.WhileStatement:
+		return c.compileWhileStatement(node)
+	case *ast.ForStatement:
+		return c.compileForStatement(node)
+	case *ast.BreakStatement:
+		l := c.currentLoop()
+		if l == nil {
+			return c.errorf("break outside loop")
+		}
+		depth := c.scopes[c.scopeIndex].depth
+		err := c.leaveTries(l.tryDepth, func() {
+			c.popTo(l.depth)
+			if l.hasIterator {
+				c.emit(code.OpPop)
+			}
+			l.breakJumps = append(l.breakJumps, c.emit(code.OpJump, 9999))
+		})
+		if err != nil {
+			return err
+		}
+		c.scopes[c.scopeIndex].depth = depth
+	case *ast.ContinueStatement:
+		l := c.currentLoop()
+		if l == nil {
+			return c.errorf("continue outside loop")
+		}
+		depth := c.scopes[c.scopeIndex].depth
+		err := c.leaveTries(l.tryDepth, func() {
+			c.popTo(l.depth)
+			c.emit(code.OpJump, l.continueTarget)
+		})
+		if err != nil {
+			return err
+		}
+		c.scopes[c.scopeIndex].depth = depth
+
 	case *ast.IntegerLiteral:
-		value := &object.Integer{Value: node.Value}
+		var value object.Object = &object.Integer{Value: node.Value}
+		if node.Big != nil {
+			value = &object.BigInt{Value: node.Big}
+		}
 		address := c.addConstant(value)
 		c.emit(code.OpConstant, address)
+	case *ast.FloatLiteral:
+		value := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(value))
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -202,7 +333,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return c.errorf("undefined variable %s", node.Value)
 		}
 
 		c.loadSymbol(symbol)
@@ -253,7 +384,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
-		if node.Name != "" {
+		// A function that assigns to its own name refers to it through the
+		// variable it is bound to, like the evaluator, so that the
+		// assignment is seen wherever the name is used.
+		if node.Name != "" && !assigns(node.Body, node.Name) {
 			c.symbolTable.DefineFunctionName(node.Name)
 		}
 
@@ -261,42 +395,75 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.symbolTable.Define(p.Value)
 		}
 
+		c.markTailCalls(node.Body)
+
 		err := c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIsOp(code.OpPop) {
+		if endsInExpression(node.Body) && c.lastInstructionIsOp(code.OpPop) {
 			c.replaceLastPopWithReturn()
 		}
-		if !c.lastInstructionIsOp(code.OpReturnValue) {
+		// a try statement can end the body with a jump past its handler
+		if !c.lastInstructionIsOp(code.OpReturnValue) || c.jumpsTo(len(c.currentInstructions())) {
 			c.emit(code.OpReturn)
 		}
 
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
+		capturesLocals := c.symbolTable.Captured
+		lines := c.scopes[c.scopeIndex].lines
+		handlers := c.scopes[c.scopeIndex].handlers
 		instructions := c.leaveScope()
 
-		for _, freeSymbol := range freeSymbols {
-			c.loadSymbol(freeSymbol)
+		freeNames := make([]string, len(freeSymbols))
+		for i, freeSymbol := range freeSymbols {
+			c.captureSymbol(freeSymbol)
+			freeNames[i] = freeSymbol.Name
 		}
 
 		compiledFn := &object.CompiledFunction{
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			Filename:      node.Pos().Filename,
+			Lines:         lines,
+			Handlers:      handlers,
+			FreeNames:     freeNames,
+
+			CapturesLocals: capturesLocals,
 		}
 
 		fnIdx := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIdx, len(freeSymbols))
 
 	case *ast.ReturnStatement:
+		tries := c.scopes[c.scopeIndex].tries
+		if call, ok := node.ReturnValue.(*ast.CallExpression); ok && c.scopeIndex > 0 && len(tries) == 0 {
+			c.tailCalls[call] = true
+		}
+
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpReturnValue)
+		err = c.leaveTries(0, func() { c.emit(code.OpReturnValue) })
+		if err != nil {
+			return err
+		}
+
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpThrow)
+	case *ast.TryStatement:
+		return c.compileTryStatement(node)
 	case *ast.CallExpression:
 		err := c.Compile(node.Function)
 		if err != nil {
@@ -310,7 +477,497 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
-		c.emit(code.OpCall, len(node.Arguments))
+		if c.tailCalls[node] {
+			delete(c.tailCalls, node)
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+	}
+
+	return nil
+}
+
+// markTailCalls records the calls in tail position of a function body: the
+// body's last expression, or the last expression of either branch of a
+// trailing if. Their value is returned as is, so the call can reuse the
+// caller's frame.
+func (c *Compiler) markTailCalls(body *ast.BlockStatement) {
+	if body == nil || len(body.Statements) == 0 {
+		return
+	}
+
+	last, ok := body.Statements[len(body.Statements)-1].(*ast.ExpressionStatement)
+	if !ok {
+		return
+	}
+
+	switch expr := last.Expression.(type) {
+	case *ast.CallExpression:
+		c.tailCalls[expr] = true
+	case *ast.IfExpression:
+		c.markTailCalls(expr.Consequence)
+		c.markTailCalls(expr.Alternative)
+	}
+}
+
+// assigns reports whether node contains an assignment to the variable
+// name, including in nested functions. Variables of the same name that
+// shadow it count too.
+func assigns(node ast.Node, name string) bool {
+	switch node := node.(type) {
+	case *ast.Program:
+		return assignsAny(node.Statements, name)
+	case *ast.BlockStatement:
+		return node != nil && assignsAny(node.Statements, name)
+	case *ast.ExpressionStatement:
+		return assigns(node.Expression, name)
+	case *ast.LetStatement:
+		return assigns(node.Value, name)
+	case *ast.ReturnStatement:
+		return assigns(node.ReturnValue, name)
+	case *ast.ThrowStatement:
+		return assigns(node.Value, name)
+	case *ast.WhileStatement:
+		return assigns(node.Condition, name) || assigns(node.Body, name)
+	case *ast.ForStatement:
+		return assigns(node.Iterable, name) || assigns(node.Body, name)
+	case *ast.TryStatement:
+		return assigns(node.Block, name) || assigns(node.Catch, name) || assigns(node.Finally, name)
+	case *ast.AssignExpression:
+		if target, ok := node.Target.(*ast.Identifier); ok && target.Value == name {
+			return true
+		}
+		return assigns(node.Target, name) || assigns(node.Value, name)
+	case *ast.PrefixExpression:
+		return assigns(node.Right, name)
+	case *ast.InfixExpression:
+		return assigns(node.Left, name) || assigns(node.Right, name)
+	case *ast.IfExpression:
+		return assigns(node.Condition, name) || assigns(node.Consequence, name) || assigns(node.Alternative, name)
+	case *ast.FunctionLiteral:
+		return assigns(node.Body, name)
+	case *ast.CallExpression:
+		if assigns(node.Function, name) {
+			return true
+		}
+		for _, arg := range node.Arguments {
+			if assigns(arg, name) {
+				return true
+			}
+		}
+	case *ast.ArrayLiteral:
+		for _, element := range node.Elements {
+			if assigns(element, name) {
+				return true
+			}
+		}
+	case *ast.IndexExpression:
+		return assigns(node.Left, name) || assigns(node.Index, name)
+	case *ast.HashLiteral:
+		for key, value := range node.Pairs {
+			if assigns(key, name) || assigns(value, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func assignsAny(statements []ast.Statement, name string) bool {
+	for _, s := range statements {
+		if assigns(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileLogicalExpression compiles && and || so that the right operand is
+// only evaluated when needed. Both produce a boolean:
+//
+//	a && b: <a> OpJumpFalsy F; <b> OpBang OpBang; OpJump E; F: OpFalse; E:
+//	a || b: <a> OpJumpFalsy R; OpTrue; OpJump E; R: <b> OpBang OpBang; E:
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jumpFalsyPos := c.emit(code.OpJumpFalsy, 9999)
+	depth := c.scopes[c.scopeIndex].depth
+
+	if node.Operator == "&&" {
+		err = c.Compile(node.Right)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpBang)
+		c.emit(code.OpBang)
+
+		jumpPos := c.emit(code.OpJump, 9999)
+		c.changeOperand(jumpFalsyPos, len(c.currentInstructions()))
+		c.scopes[c.scopeIndex].depth = depth
+		c.emit(code.OpFalse)
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+		return nil
+	}
+
+	c.emit(code.OpTrue)
+	jumpPos := c.emit(code.OpJump, 9999)
+	c.changeOperand(jumpFalsyPos, len(c.currentInstructions()))
+	c.scopes[c.scopeIndex].depth = depth
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpBang)
+	c.emit(code.OpBang)
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// blockValue leaves the value of a just compiled if branch on the stack:
+// the value of its last expression statement, or null if it ends in any
+// other statement or is empty.
+func (c *Compiler) blockValue(block *ast.BlockStatement) {
+	if endsInExpression(block) && c.lastInstructionIsOp(code.OpPop) {
+		c.removeLastInstruction()
+	} else {
+		c.emit(code.OpNull)
+	}
+}
+
+// endsInExpression reports whether the last statement of block is an
+// expression statement, whose OpPop is then the last instruction emitted
+// for the block.
+func endsInExpression(block *ast.BlockStatement) bool {
+	if block == nil || len(block.Statements) == 0 {
+		return false
+	}
+
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// compileTryStatement emits
+//
+//	S: <block> OpJump N
+//	H: OpSet e; <catch>
+//	N: <finally> OpJump E
+//	F: <finally> OpThrow
+//	E:
+//
+// An error raised in the block is caught at H. One raised in the catch
+// block is caught at F, which runs the finally block and throws the error
+// again. Without a catch block, the block is caught at F and falls through
+// to N; without a finally block, N and F are left out.
+func (c *Compiler) compileTryStatement(node *ast.TryStatement) error {
+	depth := c.scopes[c.scopeIndex].depth
+
+	protected, err := c.compileProtected(node.Block, node.Finally)
+	if err != nil {
+		return err
+	}
+
+	if node.Catch != nil {
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		c.addHandlers(protected, len(c.currentInstructions()), depth)
+		c.scopes[c.scopeIndex].depth = depth + 1
+
+		symbol := c.symbolTable.Define(node.Param.Value)
+		err = c.storeSymbol(symbol)
+		if err != nil {
+			return err
+		}
+
+		if node.Finally == nil {
+			err = c.Compile(node.Catch)
+			if err != nil {
+				return err
+			}
+
+			c.changeOperand(jumpPos, len(c.currentInstructions()))
+			return nil
+		}
+
+		protected, err = c.compileProtected(node.Catch, node.Finally)
+		if err != nil {
+			return err
+		}
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+	}
+
+	err = c.Compile(node.Finally)
+	if err != nil {
+		return err
+	}
+
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.addHandlers(protected, len(c.currentInstructions()), depth)
+	c.scopes[c.scopeIndex].depth = depth + 1
+
+	err = c.Compile(node.Finally)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpThrow)
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// compileProtected compiles block as the innermost try block, returning
+// the instruction ranges its handler covers.
+func (c *Compiler) compileProtected(block, finally *ast.BlockStatement) (*tryBlock, error) {
+	t := &tryBlock{finally: finally}
+	t.open(len(c.currentInstructions()))
+
+	tries := c.scopes[c.scopeIndex].tries
+	c.scopes[c.scopeIndex].tries = append(tries, t)
+
+	err := c.Compile(block)
+
+	c.scopes[c.scopeIndex].tries = tries
+	t.close(len(c.currentInstructions()))
+
+	return t, err
+}
+
+// addHandlers sends errors raised in the ranges of t to target, with the
+// stack cut back to depth.
+func (c *Compiler) addHandlers(t *tryBlock, target int, depth int) {
+	for _, h := range t.ranges {
+		h.Target = target
+		h.Depth = depth
+		c.scopes[c.scopeIndex].handlers = append(c.scopes[c.scopeIndex].handlers, h)
+	}
+}
+
+// leaveTries emits exit, a return, break or continue out of the enclosing
+// try statements from the given one inwards, after inlining their finally
+// blocks, innermost first. The inlined code and exit are left out of the
+// ranges of the try statements they leave.
+func (c *Compiler) leaveTries(from int, exit func()) error {
+	tries := c.scopes[c.scopeIndex].tries
+
+	for i := len(tries) - 1; i >= from; i-- {
+		tries[i].close(len(c.currentInstructions()))
+		if tries[i].finally == nil {
+			continue
+		}
+
+		c.scopes[c.scopeIndex].tries = tries[:i]
+		err := c.Compile(tries[i].finally)
+		c.scopes[c.scopeIndex].tries = tries
+		if err != nil {
+			return err
+		}
+	}
+
+	exit()
+
+	for _, t := range tries[from:] {
+		t.open(len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// compileWhileStatement emits
+//
+//	S: <cond> OpJumpFalsy E; <body> OpJump S; E:
+//
+// with continue jumping to S and break to E.
+func (c *Compiler) compileWhileStatement(node *ast.WhileStatement) error {
+	start := len(c.currentInstructions())
+
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+
+	jumpFalsyPos := c.emit(code.OpJumpFalsy, 9999)
+
+	err = c.compileLoopBody(node.Body, start, false)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, start)
+	end := len(c.currentInstructions())
+	c.changeOperand(jumpFalsyPos, end)
+	c.patchBreaks(end)
+
+	return nil
+}
+
+// compileForStatement emits
+//
+//	<iterable> OpIter; N: OpIterNext E; OpSet x; <body> OpJump N; E:
+//
+// The iterator stays on the stack while the loop runs. OpIterNext pushes
+// the next item, or pops the iterator and jumps to E once there is none.
+// continue jumps to N; break pops the iterator itself and jumps to E.
+func (c *Compiler) compileForStatement(node *ast.ForStatement) error {
+	depth := c.scopes[c.scopeIndex].depth
+
+	err := c.Compile(node.Iterable)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpIter)
+	next := c.emit(code.OpIterNext, 9999)
+
+	symbol := c.symbolTable.Define(node.Variable.Value)
+	err = c.storeSymbol(symbol)
+	if err != nil {
+		return err
+	}
+
+	err = c.compileLoopBody(node.Body, next, true)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, next)
+	end := len(c.currentInstructions())
+	c.changeOperand(next, end)
+	c.patchBreaks(end)
+	c.scopes[c.scopeIndex].depth = depth
+
+	return nil
+}
+
+// compileLoopBody compiles body as the innermost loop, leaving its break
+// jumps for patchBreaks.
+func (c *Compiler) compileLoopBody(body *ast.BlockStatement, continueTarget int, hasIterator bool) error {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, &loop{
+		continueTarget: continueTarget,
+		hasIterator:    hasIterator,
+		tryDepth:       len(scope.tries),
+		depth:          scope.depth,
+	})
+
+	return c.Compile(body)
+}
+
+// popTo emits the pops that bring the stack down to depth, leaving values
+// such as an exception a finally block is about to rethrow.
+func (c *Compiler) popTo(depth int) {
+	for c.scopes[c.scopeIndex].depth > depth {
+		c.emit(code.OpPop)
+	}
+}
+
+// patchBreaks points the break jumps of the innermost loop at end and
+// leaves the loop.
+func (c *Compiler) patchBreaks(end int) {
+	scope := &c.scopes[c.scopeIndex]
+	l := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range l.breakJumps {
+		c.changeOperand(pos, end)
+	}
+}
+
+func (c *Compiler) currentLoop() *loop {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+var compoundOperators = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+	"%=": code.OpMod,
+}
+
+// compileAssignExpression leaves the assigned value on the stack:
+//
+//	x = v:      <v> OpSet x; OpGet x
+//	x += v:     OpGet x; <v> OpAdd; OpSet x; OpGet x
+//	a[i] = v:   <a> <i> <v> OpSetIndex
+//	a[i] += v:  <a> <i> OpDup2 OpIndex <v> OpAdd OpSetIndex
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	var operator code.Opcode
+	if node.Operator != "=" {
+		op, ok := compoundOperators[node.Operator]
+		if !ok {
+			return c.errorf("unknown assignment operator %s", node.Operator)
+		}
+		operator = op
+	}
+
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return c.errorf("undefined variable %s", target.Value)
+		}
+
+		if node.Operator != "=" {
+			c.loadSymbol(symbol)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		if node.Operator != "=" {
+			c.emit(operator)
+		}
+
+		err = c.storeSymbol(symbol)
+		if err != nil {
+			return err
+		}
+		c.loadSymbol(symbol)
+
+	case *ast.IndexExpression:
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+
+		if node.Operator != "=" {
+			c.emit(code.OpDup2)
+			c.emit(code.OpIndex)
+		}
+
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		if node.Operator != "=" {
+			c.emit(operator)
+		}
+
+		c.emit(code.OpSetIndex)
+
+	default:
+		return c.errorf("invalid assignment target %s", node.Target.String())
 	}
 
 	return nil
@@ -320,6 +977,10 @@ func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.scopes[c.scopeIndex].instructions,
 		Constants:    c.constants,
+		Filename:     c.filename,
+		Lines:        c.scopes[c.scopeIndex].lines,
+		Handlers:     c.scopes[c.scopeIndex].handlers,
+		Builtins:     c.symbolTable.BuiltinNames(),
 	}
 }
 
@@ -338,6 +999,39 @@ func (c *Compiler) loadSymbol(s Symbol) {
 	}
 }
 
+// captureSymbol pushes the cell through which a new closure shares the
+// variable s with the enclosing function. Anything else, such as the
+// enclosing function's own closure, is pushed by value.
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+func (c *Compiler) errorf(format string, a ...interface{}) error {
+	return &Error{Pos: c.position, Message: fmt.Sprintf(format, a...)}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) error {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	default:
+		return c.errorf("cannot assign to %s", s.Name)
+	}
+
+	return nil
+}
+
 func (c *Compiler) addConstant(obj object.Object) int {
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
@@ -346,20 +1040,67 @@ func (c *Compiler) addConstant(obj object.Object) int {
 func (c *Compiler) emit(opcode code.Opcode, operands ...int) int {
 	instruction := code.Make(opcode, operands...)
 	pos := c.addInstruction(instruction)
+	c.scopes[c.scopeIndex].depth += stackEffect(opcode, operands)
 
 	c.setLastInstruction(opcode, pos)
 
 	return pos
 }
 
+// stackEffect returns the number of values an instruction leaves on the
+// stack less the number it takes, when execution falls through to the next
+// instruction.
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree,
+		code.OpCaptureLocal, code.OpCaptureFree, code.OpCurrentClosure,
+		code.OpIterNext:
+		return 1
+	case code.OpPop, code.OpJumpFalsy, code.OpSetGlobal, code.OpSetLocal,
+		code.OpSetFree, code.OpIndex, code.OpReturnValue, code.OpThrow,
+		code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+		code.OpLessThan, code.OpLessThanOrEqual:
+		return -1
+	case code.OpDup2:
+		return 2
+	case code.OpSetIndex:
+		return -2
+	case code.OpArray:
+		return 1 - operands[0]
+	case code.OpHash:
+		return 1 - 2*operands[0]
+	case code.OpCall, code.OpTailCall:
+		return -operands[0]
+	case code.OpClosure:
+		return 1 - operands[1]
+	default:
+		return 0
+	}
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.currentInstructions())
+	c.addLine(posNewInstruction)
 	updatedInstructions := append(c.currentInstructions(), ins...)
 	c.scopes[c.scopeIndex].instructions = updatedInstructions
 
 	return posNewInstruction
 }
 
+func (c *Compiler) addLine(offset int) {
+	scope := &c.scopes[c.scopeIndex]
+
+	line := c.position.Line
+	if n := len(scope.lines); n > 0 && scope.lines[n-1].Line == line {
+		return
+	}
+
+	scope.lines = append(scope.lines, code.LineEntry{Offset: offset, Line: line})
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -376,9 +1117,40 @@ func (c *Compiler) lastInstructionIsOp(opcode code.Opcode) bool {
 	return c.scopes[c.scopeIndex].lastInstruction.Opcode == opcode
 }
 
+// jumpsTo reports whether an instruction of the current scope jumps to
+// offset.
+func (c *Compiler) jumpsTo(offset int) bool {
+	ins := c.currentInstructions()
+	for i := 0; i < len(ins); {
+		def, _ := code.Lookup(ins[i])
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		switch code.Opcode(ins[i]) {
+		case code.OpJump, code.OpJumpFalsy, code.OpIterNext:
+			if operands[0] == offset {
+				return true
+			}
+		}
+
+		i += 1 + read
+	}
+	return false
+}
+
 func (c *Compiler) removeLastInstruction() {
+	last := c.scopes[c.scopeIndex].lastInstruction
+	def, _ := code.Lookup(byte(last.Opcode))
+	operands, _ := code.ReadOperands(def, c.currentInstructions()[last.Position+1:])
+	c.scopes[c.scopeIndex].depth -= stackEffect(last.Opcode, operands)
+
 	c.scopes[c.scopeIndex].instructions = c.scopes[c.scopeIndex].instructions[:c.scopes[c.scopeIndex].lastInstruction.Position]
 	c.scopes[c.scopeIndex].lastInstruction = c.scopes[c.scopeIndex].previousInstruction
+
+	lines := c.scopes[c.scopeIndex].lines
+	for len(lines) > 0 && lines[len(lines)-1].Offset >= len(c.currentInstructions()) {
+		lines = lines[:len(lines)-1]
+	}
+	c.scopes[c.scopeIndex].lines = lines
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -400,6 +1172,14 @@ func (c *Compiler) currentInstructions() code.Instructions {
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+
+	Filename string
+	Lines    code.LineTable
+	Handlers code.HandlerTable
+
+	// Builtins are the names of the builtins the program was compiled with,
+	// by index. It runs only with a builtin set starting with these names.
+	Builtins []string
 }
 
 func (c *Compiler) enterScope() {
@@ -7,6 +7,7 @@ import (
 	"github.com/mehrankamal/monkey/lexer"
 	"github.com/mehrankamal/monkey/object"
 	"github.com/mehrankamal/monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -82,6 +83,32 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 * 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-2.5",
+			expectedConstants: []interface{}{2.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNegate),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -112,11 +139,11 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
 				code.Make(code.OpPop),
 			},
 		},
@@ -174,6 +201,170 @@ func TestBooleanExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestComparisonAndModuloOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThanOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "7 % 2",
+			expectedConstants: []interface{}{7, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestPowerAndBitwiseOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "2 ** 3",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "6 & 3",
+			expectedConstants: []interface{}{6, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "6 | 3",
+			expectedConstants: []interface{}{6, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "6 ^ 3",
+			expectedConstants: []interface{}{6, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 << 4",
+			expectedConstants: []interface{}{1, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "16 >> 2",
+			expectedConstants: []interface{}{16, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "~5",
+			expectedConstants: []interface{}{5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "true && false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpFalsy, 10),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpBang),
+				// 0006
+				code.Make(code.OpBang),
+				// 0007
+				code.Make(code.OpJump, 11),
+				// 0010
+				code.Make(code.OpFalse),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true || false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpFalsy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 11),
+				// 0008
+				code.Make(code.OpFalse),
+				// 0009
+				code.Make(code.OpBang),
+				// 0010
+				code.Make(code.OpBang),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -220,9 +411,345 @@ func TestConditionals(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             `if (true) { let x = 1; } else { }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpFalsy, 14),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
-	runCompilerTests(t, tests)
+	runCompilerTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let i = 0; while (i < 3) { i += 1; }`,
+			expectedConstants: []interface{}{0, 3, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpLessThan),
+				// 0013
+				code.Make(code.OpJumpFalsy, 33),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpConstant, 2),
+				// 0022
+				code.Make(code.OpAdd),
+				// 0023
+				code.Make(code.OpSetGlobal, 0),
+				// 0026
+				code.Make(code.OpGetGlobal, 0),
+				// 0029
+				code.Make(code.OpPop),
+				// 0030
+				code.Make(code.OpJump, 6),
+			},
+		},
+		{
+			input:             `while (true) { continue; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpFalsy, 10),
+				// 0004
+				code.Make(code.OpJump, 0),
+				// 0007
+				code.Make(code.OpJump, 0),
+			},
+		},
+		{
+			input:             `for (x in [1]) { x; break; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpIter),
+				// 0007
+				code.Make(code.OpIterNext, 24),
+				// 0010
+				code.Make(code.OpSetGlobal, 0),
+				// 0013
+				code.Make(code.OpGetGlobal, 0),
+				// 0016
+				code.Make(code.OpPop),
+				// 0017
+				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpJump, 24),
+				// 0021
+				code.Make(code.OpJump, 7),
+			},
+		},
+		{
+			input: `fn(a) { for (x in a) { continue; } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpIter),
+					// 0003
+					code.Make(code.OpIterNext, 14),
+					// 0006
+					code.Make(code.OpSetLocal, 1),
+					// 0008
+					code.Make(code.OpJump, 3),
+					// 0011
+					code.Make(code.OpJump, 3),
+					// 0014
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside loop"},
+		{"continue;", "1:1: continue outside loop"},
+		{"while (true) { fn() { break; } }", "1:23: break outside loop"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestTryStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `try { throw 1 } catch (e) { e }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpThrow),
+				// 0004
+				code.Make(code.OpJump, 14),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpGetGlobal, 0),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `try { 1 } finally { 2 }`,
+			expectedConstants: []interface{}{1, 2, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpPop),
+				// 0004
+				code.Make(code.OpConstant, 1),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 16),
+				// 0011
+				code.Make(code.OpConstant, 2),
+				// 0014
+				code.Make(code.OpPop),
+				// 0015
+				code.Make(code.OpThrow),
+			},
+		},
+		{
+			input: `fn() { try { return 1 } finally { 2 } }`,
+			expectedConstants: []interface{}{
+				1, 2, 2, 2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpConstant, 0),
+					// 0003
+					code.Make(code.OpConstant, 1),
+					// 0006
+					code.Make(code.OpPop),
+					// 0007
+					code.Make(code.OpReturnValue),
+					// 0008
+					code.Make(code.OpConstant, 2),
+					// 0011
+					code.Make(code.OpPop),
+					// 0012
+					code.Make(code.OpJump, 20),
+					// 0015
+					code.Make(code.OpConstant, 3),
+					// 0018
+					code.Make(code.OpPop),
+					// 0019
+					code.Make(code.OpThrow),
+					// 0020
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { try { return f() } catch (e) { } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpCall, 0),
+					// 0004
+					code.Make(code.OpReturnValue),
+					// 0005
+					code.Make(code.OpJump, 10),
+					// 0008
+					code.Make(code.OpSetLocal, 1),
+					// 0010
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTryHandlers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected code.HandlerTable
+	}{
+		{
+			`try { throw 1 } catch (e) { e }`,
+			code.HandlerTable{{Start: 0, End: 4, Target: 7, Depth: 0}},
+		},
+		{
+			`try { 1 } finally { 2 }`,
+			code.HandlerTable{{Start: 0, End: 4, Target: 11, Depth: 0}},
+		},
+		{
+			`1 + if (true) { try { throw 2 } catch (e) { }; 3 }`,
+			code.HandlerTable{{Start: 7, End: 11, Target: 14, Depth: 1}},
+		},
+		{
+			// the catch block is covered by the finally handler
+			`try { 1 } catch (e) { 2 } finally { 3 }`,
+			code.HandlerTable{
+				{Start: 0, End: 4, Target: 7, Depth: 0},
+				{Start: 10, End: 14, Target: 21, Depth: 0},
+			},
+		},
+		{
+			// inner handlers come first
+			`try { try { 1 } catch (e) { } } catch (e) { }`,
+			code.HandlerTable{
+				{Start: 0, End: 4, Target: 7, Depth: 0},
+				{Start: 0, End: 10, Target: 13, Depth: 0},
+			},
+		},
+		{
+			// the finally code inlined before break is not protected
+			`while (true) { try { break } finally { 1 } }`,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		handlers := compiler.Bytecode().Handlers
+		if len(handlers) != len(tt.expected) {
+			t.Fatalf("wrong handlers for %q.\nwant=%+v\ngot =%+v", tt.input, tt.expected, handlers)
+		}
+		for i, h := range tt.expected {
+			if handlers[i] != h {
+				t.Errorf("wrong handler %d for %q. want=%+v, got=%+v", i, tt.input, h, handlers[i])
+			}
+		}
+	}
+}
+
+func TestStackDepthBalanced(t *testing.T) {
+	inputs := []string{
+		`let a = [1, 2][0] + {"a": 1}["a"]; a += 1;`,
+		`if (true) { 1 } else { 2 }; if (false) { 3 };`,
+		`true && false; true || false;`,
+		`let n = 0; while (n < 3) { n += 1; if (n == 2) { continue; } };`,
+		`for (x in [1, 2]) { if (x == 1) { break; } };`,
+		`let f = fn(a) { fn() { a } }; f(1)();`,
+		`try { throw 1 } catch (e) { e } finally { 2 };`,
+		`for (x in [1]) { try { break; } finally { x; } };`,
+	}
+
+	for _, input := range inputs {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if depth := compiler.scopes[compiler.scopeIndex].depth; depth != 0 {
+			t.Errorf("stack depth not balanced for %q. got=%d", input, depth)
+		}
+	}
 }
 
 func TestGlobalLetStatements(t *testing.T) {
@@ -420,6 +947,129 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let x = 1; x = 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x += 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { a -= 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { fn() { a = 2 } }",
+			expectedConstants: []interface{}{
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] = 2;",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let h = {}; h[\"k\"] *= 3;",
+			expectedConstants: []interface{}{"k", 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "1:3: undefined variable x"},
+		{"len = 1", "1:5: cannot assign to len"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -751,7 +1401,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -782,7 +1432,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -812,13 +1462,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -861,15 +1511,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -887,8 +1537,75 @@ func TestClosures(t *testing.T) {
 
 }
 
+func TestClosureCaptures(t *testing.T) {
+	input := `
+		fn() {
+			let a = 1;
+			fn() { a += 1 };
+		};
+		fn() { let b = 2; b };
+		fn() {
+			let c = fn() { fn() { c } };
+		};
+	`
+
+	program := parse(input)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var functions []*object.CompiledFunction
+	for _, constant := range compiler.Bytecode().Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			functions = append(functions, fn)
+		}
+	}
+
+	// in compilation order: the adder, its outer function capturing a, the
+	// function of b, the closure over c, c itself and the function of c
+	expected := []bool{false, true, false, false, false, false}
+	if len(functions) != 6 {
+		t.Fatalf("wrong number of functions. want=6, got=%d", len(functions))
+	}
+	for i, fn := range functions {
+		if fn.CapturesLocals != expected[i] {
+			t.Errorf("functions[%d].CapturesLocals wrong. want=%t, got=%t",
+				i, expected[i], fn.CapturesLocals)
+		}
+	}
+
+	err = assertInstructions([]code.Instructions{
+		code.Make(code.OpCurrentClosure),
+		code.Make(code.OpClosure, 6, 1),
+		code.Make(code.OpReturnValue),
+	}, functions[4].Instructions)
+	if err != nil {
+		t.Errorf("wrong instructions capturing the enclosing closure: %s", err)
+	}
+}
+
 func TestRecursiveFunctions(t *testing.T) {
 	tests := []compilerTestCase{
+		{
+			input: `let f = fn() { f = 1; f };`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetGlobal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
 		{
 			input: `
 				let countDown = fn(x) { countDown(x - 1); };
@@ -900,7 +1617,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -928,7 +1645,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -937,7 +1654,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -954,6 +1671,98 @@ func TestRecursiveFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(f) { return f(1); }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { if (true) { f() } else { 1 } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpFalsy, 11),
+					// 0004
+					code.Make(code.OpGetLocal, 0),
+					// 0006
+					code.Make(code.OpTailCall, 0),
+					// 0008
+					code.Make(code.OpJump, 14),
+					// 0011
+					code.Make(code.OpConstant, 0),
+					// 0014
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { f() + 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { let x = f(); x }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `len([]);`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
@@ -999,6 +1808,13 @@ func assertConstants(
 					i, err)
 			}
 
+		case float64:
+			err := assertFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s",
+					i, err)
+			}
+
 		case string:
 			err := assertStringObject(constant, actual[i])
 			if err != nil {
@@ -1052,6 +1868,19 @@ func assertIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func assertFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
+}
+
 func assertInstructions(expected []code.Instructions, actual code.Instructions) error {
 	concatted := concatInstructions(expected)
 
@@ -1085,3 +1914,91 @@ func parse(input string) *ast.Program {
 	p := parser.New(l)
 	return p.ParseProgram()
 }
+
+func TestLineTables(t *testing.T) {
+	input := `1;
+let f = fn() {
+	2;
+	if (true) { 3 }
+};
+f();`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// 0000 OpConstant 0, 0003 OpPop        line 1
+	// 0004 OpClosure 3 0, 0008 OpSetGlobal line 2
+	// 0011 OpGetGlobal 0, 0014 OpCall 0    line 6
+	expectedMain := code.LineTable{
+		{Offset: 0, Line: 1},
+		{Offset: 4, Line: 2},
+		{Offset: 11, Line: 6},
+	}
+	assertLineTable(t, expectedMain, bytecode.Lines)
+
+	fn, ok := bytecode.Constants[3].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 3 - not a function: %T", bytecode.Constants[3])
+	}
+
+	if fn.Name != "f" {
+		t.Errorf("wrong function name. want=%q, got=%q", "f", fn.Name)
+	}
+
+	expectedFn := code.LineTable{
+		{Offset: 0, Line: 3},
+		{Offset: 4, Line: 4},
+	}
+	assertLineTable(t, expectedFn, fn.Lines)
+}
+
+func assertLineTable(t *testing.T, expected, actual code.LineTable) {
+	t.Helper()
+
+	if len(expected) != len(actual) {
+		t.Fatalf("wrong line table length. want=%+v, got=%+v", expected, actual)
+	}
+
+	for i, entry := range expected {
+		if actual[i] != entry {
+			t.Errorf("wrong line entry %d. want=%+v, got=%+v", i, entry, actual[i])
+		}
+	}
+}
+
+func TestFreeNames(t *testing.T) {
+	input := `
+let outer = fn(a, b) {
+	let c = 1;
+	fn() { fn() { b + c + a } }
+};`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.Bytecode().Constants
+	expected := map[int][]string{
+		1: {"b", "c", "a"}, // innermost
+		2: {"b", "c", "a"},
+		3: {},
+	}
+
+	for idx, names := range expected {
+		fn, ok := constants[idx].(*object.CompiledFunction)
+		if !ok {
+			t.Fatalf("constant %d - not a function: %T", idx, constants[idx])
+		}
+
+		if strings.Join(fn.FreeNames, ",") != strings.Join(names, ",") {
+			t.Errorf("constant %d: wrong free names. want=%v, got=%v", idx, names, fn.FreeNames)
+		}
+	}
+}
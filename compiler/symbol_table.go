@@ -1,5 +1,7 @@
 package compiler
 
+import "github.com/mehrankamal/monkey/object"
+
 type SymbolScope string
 
 const (
@@ -22,7 +24,20 @@ type SymbolTable struct {
 	store          map[string]Symbol
 	numDefinitions int
 
+	// names of the builtins by index
+	builtins []string
+
+	// FreeSymbols are the enclosing symbols this function closes over, in
+	// the order of its free variable indexes. A LocalScope entry is a local
+	// of the enclosing function, captured through a cell pointing into its
+	// frame; a FreeScope entry shares a cell the enclosing closure already
+	// holds.
 	FreeSymbols []Symbol
+
+	// Captured is set once an inner function captures one of this table's
+	// locals. Locals of functions that never have any captured stay plain
+	// stack slots that need no cell bookkeeping when the frame returns.
+	Captured bool
 }
 
 func (st *SymbolTable) defineFree(original Symbol) Symbol {
@@ -63,6 +78,10 @@ func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return sym, ok
 		}
 
+		if sym.Scope == LocalScope {
+			st.Outer.Captured = true
+		}
+
 		free := st.defineFree(sym)
 
 		return free, ok
@@ -75,9 +94,30 @@ func (st *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	st.store[name] = symbol
 
+	for len(st.builtins) <= index {
+		st.builtins = append(st.builtins, "")
+	}
+	st.builtins[index] = name
+
 	return symbol
 }
 
+// DefineBuiltins defines the builtins of set by their index in it.
+func (st *SymbolTable) DefineBuiltins(set object.BuiltinSet) {
+	for i, def := range set {
+		st.DefineBuiltin(i, def.Name)
+	}
+}
+
+// BuiltinNames returns the names of the builtins defined in the outermost
+// table by their index.
+func (st *SymbolTable) BuiltinNames() []string {
+	for st.Outer != nil {
+		st = st.Outer
+	}
+	return st.builtins
+}
+
 func (st *SymbolTable) DefineFunctionName(funcName string) Symbol {
 	symbol := Symbol{Name: funcName, Index: 0, Scope: FunctionScope}
 	st.store[funcName] = symbol
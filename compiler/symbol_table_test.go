@@ -256,6 +256,39 @@ func TestResolveFree(t *testing.T) {
 	}
 }
 
+func TestCapturedLocals(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("b")
+
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("c")
+
+	thirdLocal := NewEnclosedSymbolTable(secondLocal)
+
+	thirdLocal.Resolve("a")
+	thirdLocal.Resolve("c")
+	if global.Captured || firstLocal.Captured {
+		t.Fatalf("globals and unreferenced locals must not be marked captured")
+	}
+	if !secondLocal.Captured {
+		t.Fatalf("secondLocal not marked captured after inner reference to c")
+	}
+
+	thirdLocal.Resolve("b")
+	if !firstLocal.Captured {
+		t.Errorf("firstLocal not marked captured after nested reference to b")
+	}
+	if secondLocal.FreeSymbols[0] != (Symbol{Name: "b", Scope: LocalScope, Index: 0}) {
+		t.Errorf("wrong free symbol in secondLocal. got=%+v", secondLocal.FreeSymbols[0])
+	}
+	if thirdLocal.FreeSymbols[1] != (Symbol{Name: "b", Scope: FreeScope, Index: 0}) {
+		t.Errorf("wrong free symbol in thirdLocal. got=%+v", thirdLocal.FreeSymbols[1])
+	}
+}
+
 func TestResolveUnresolvableFree(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
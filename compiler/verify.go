@@ -0,0 +1,236 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/object"
+)
+
+// Verify checks that the instructions of a program and of the functions
+// among its constants are complete, only refer to constants, locals, free
+// variables and offsets that exist, and never take more values off the
+// stack than they put on it, so that running them cannot make the virtual
+// machine read out of bounds. Programs made by the compiler always pass;
+// it is for programs read from files or put together by hand.
+func Verify(bc *Bytecode) error {
+	// the virtual machine runs the main function without locals or free
+	// variables
+	main := &object.CompiledFunction{Instructions: bc.Instructions, Name: "<main>", Handlers: bc.Handlers}
+	if err := verify(main, bc.Constants, true); err != nil {
+		return err
+	}
+
+	for _, constant := range bc.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			if err := verify(fn, bc.Constants, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func verify(fn *object.CompiledFunction, constants []object.Object, main bool) error {
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("invalid function %s: %s", name, fmt.Sprintf(format, args...))
+	}
+
+	if fn.NumParameters > fn.NumLocals {
+		return fail("%d parameters but %d locals", fn.NumParameters, fn.NumLocals)
+	}
+
+	ins := fn.Instructions
+	starts := make([]bool, len(ins)+1)
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return fail("%s at %d", err, i)
+		}
+		if i+def.Width() > len(ins) {
+			return fail("%s at %d needs %d bytes, %d left", def.Name, i, def.Width(), len(ins)-i)
+		}
+		starts[i] = true
+		i += def.Width()
+	}
+	// the end of the function is a valid jump target
+	starts[len(ins)] = true
+
+	target := func(offset int) bool {
+		return offset <= len(ins) && starts[offset]
+	}
+
+	for i := 0; i < len(ins); {
+		def, _ := code.Lookup(ins[i])
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		switch code.Opcode(ins[i]) {
+		case code.OpConstant:
+			if operands[0] >= len(constants) {
+				return fail("%s at %d: constant %d of %d", def.Name, i, operands[0], len(constants))
+			}
+		case code.OpClosure:
+			if operands[0] >= len(constants) {
+				return fail("%s at %d: constant %d of %d", def.Name, i, operands[0], len(constants))
+			}
+			closed, ok := constants[operands[0]].(*object.CompiledFunction)
+			if !ok {
+				return fail("%s at %d: constant %d is not a function", def.Name, i, operands[0])
+			}
+			if operands[1] != len(closed.FreeNames) {
+				return fail("%s at %d: %d free variables, function has %d",
+					def.Name, i, operands[1], len(closed.FreeNames))
+			}
+		case code.OpJump, code.OpJumpFalsy, code.OpIterNext:
+			if !target(operands[0]) {
+				return fail("%s at %d: jump to %d", def.Name, i, operands[0])
+			}
+		case code.OpGetLocal, code.OpSetLocal, code.OpCaptureLocal:
+			if operands[0] >= fn.NumLocals {
+				return fail("%s at %d: local %d of %d", def.Name, i, operands[0], fn.NumLocals)
+			}
+		case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+			if operands[0] >= len(fn.FreeNames) {
+				return fail("%s at %d: free variable %d of %d", def.Name, i, operands[0], len(fn.FreeNames))
+			}
+		case code.OpTailCall:
+			// the main function has no frame for the callee to take over
+			if main {
+				return fail("%s at %d: tail call outside of a function", def.Name, i)
+			}
+		}
+
+		i += 1 + read
+	}
+
+	for _, h := range fn.Handlers {
+		if h.Start > h.End || !target(h.Start) || !target(h.End) || h.Target >= len(ins) || !target(h.Target) {
+			return fail("handler [%d, %d) to %d", h.Start, h.End, h.Target)
+		}
+	}
+
+	return verifyStack(fn, main, fail)
+}
+
+// verifyStack follows every path through the instructions of fn, checking
+// that each instruction finds the values it takes on the stack, that paths
+// meet with the same number of values, and that only the main function
+// runs off its end.
+func verifyStack(fn *object.CompiledFunction, main bool, fail func(string, ...interface{}) error) error {
+	ins := fn.Instructions
+
+	depths := make([]int, len(ins))
+	for i := range depths {
+		depths[i] = -1
+	}
+	var work []int
+
+	reach := func(offset, depth int) error {
+		if offset == len(ins) {
+			if !main {
+				return fail("runs off the end")
+			}
+			return nil
+		}
+		switch depths[offset] {
+		case -1:
+			depths[offset] = depth
+			work = append(work, offset)
+		case depth:
+		default:
+			return fail("%d values on the stack at %d, %d on another path", depth, offset, depths[offset])
+		}
+		return nil
+	}
+
+	if err := reach(0, 0); err != nil {
+		return err
+	}
+	for _, h := range fn.Handlers {
+		// handlers start with the caught value above their depth
+		if err := reach(h.Target, h.Depth+1); err != nil {
+			return err
+		}
+	}
+
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		op := code.Opcode(ins[i])
+		def, _ := code.Lookup(ins[i])
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		next := i + 1 + read
+		depth := depths[i]
+
+		if takes := stackInputs(op, operands); depth < takes {
+			return fail("%s at %d takes %d values, %d on the stack", def.Name, i, takes, depth)
+		}
+
+		var err error
+		switch op {
+		case code.OpReturnValue, code.OpReturn, code.OpThrow:
+		case code.OpJump:
+			err = reach(operands[0], depth)
+		case code.OpJumpFalsy:
+			if err = reach(operands[0], depth-1); err == nil {
+				err = reach(next, depth-1)
+			}
+		case code.OpIterNext:
+			// the iterator is dropped once it is done
+			if err = reach(operands[0], depth-1); err == nil {
+				err = reach(next, depth+1)
+			}
+		default:
+			err = reach(next, depth+stackEffect(op, operands))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// unwinding cuts the stack back to a handler's depth, which the values
+	// of the instructions it covers must reach
+	for _, h := range fn.Handlers {
+		for i := h.Start; i < h.End; i++ {
+			if starts := depths[i]; starts >= 0 && starts < h.Depth {
+				return fail("handler [%d, %d) of depth %d covers %d with %d values on the stack",
+					h.Start, h.End, h.Depth, i, starts)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stackInputs returns the number of values an instruction takes off the
+// stack, or reads from its top.
+func stackInputs(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpPop, code.OpJumpFalsy, code.OpSetGlobal, code.OpSetLocal,
+		code.OpSetFree, code.OpReturnValue, code.OpThrow,
+		code.OpNegate, code.OpBang, code.OpBitNot, code.OpIter, code.OpIterNext:
+		return 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+		code.OpLessThan, code.OpLessThanOrEqual, code.OpIndex, code.OpDup2:
+		return 2
+	case code.OpSetIndex:
+		return 3
+	case code.OpArray:
+		return operands[0]
+	case code.OpHash:
+		return 2 * operands[0]
+	case code.OpCall, code.OpTailCall:
+		return operands[0] + 1
+	case code.OpClosure:
+		return operands[1]
+	default:
+		return 0
+	}
+}
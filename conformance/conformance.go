@@ -0,0 +1,183 @@
+// Package conformance runs Monkey programs through both the tree-walking
+// evaluator and the compiler and virtual machine and reports where the two
+// engines disagree.
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mehrankamal/monkey/ast"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/evaluator"
+	"github.com/mehrankamal/monkey/lexer"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/parser"
+	"github.com/mehrankamal/monkey/vm"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Result is what running a program produced, rendered so that results of
+// the two engines can be compared.
+type Result struct {
+	// Value is the value of the program's final expression statement. It is
+	// empty when the program ends in any other statement, whose value the
+	// engines do not agree on.
+	Value string
+	// Error is the message of the error that stopped the program, if any.
+	Error  string
+	Stdout string
+}
+
+// Parse parses input, failing on the first parser error.
+func Parse(input string) (*ast.Program, error) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, p.Errors()[0]
+	}
+	return program, nil
+}
+
+// Eval runs program with the evaluator.
+func Eval(program *ast.Program, config object.Config) Result {
+	var result Result
+
+	env := object.NewEnvironment()
+	*env.Config() = config
+
+	var evaluated object.Object
+	result.Stdout = captureStdout(func() {
+		evaluated = evaluator.Eval(program, env)
+	})
+
+	if err, ok := evaluated.(*object.Error); ok {
+		result.Error = err.Message
+	} else if endsInExpression(program) {
+		result.Value = render(evaluated)
+	}
+
+	return result
+}
+
+// Run compiles program and runs it on the virtual machine. Compilation
+// errors are reported like runtime errors.
+func Run(program *ast.Program, config object.Config) Result {
+	var result Result
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		result.Error = err.Error()
+		if compileErr, ok := err.(*compiler.Error); ok {
+			result.Error = compileErr.Message
+		}
+		return result
+	}
+
+	machine := vm.New(comp.Bytecode())
+	*machine.Config() = config
+
+	var err error
+	result.Stdout = captureStdout(func() {
+		err = machine.Run()
+	})
+
+	if err != nil {
+		result.Error = err.Error()
+	} else if endsInExpression(program) {
+		result.Value = render(machine.LastPoppedStackElem())
+	}
+
+	return result
+}
+
+// Diff runs program with both engines and describes each way in which
+// their results differ. It returns an empty string if they agree.
+func Diff(program *ast.Program, config object.Config) string {
+	return diffResults(Eval(program, config), Run(program, config))
+}
+
+func diffResults(evaluated, executed Result) string {
+	var out bytes.Buffer
+
+	field := func(name, evaluated, executed string) {
+		if evaluated != executed {
+			fmt.Fprintf(&out, "%s:\n\teval: %q\n\tvm:   %q\n", name, evaluated, executed)
+		}
+	}
+
+	field("value", evaluated.Value, executed.Value)
+	field("error", evaluated.Error, executed.Error)
+	field("stdout", evaluated.Stdout, executed.Stdout)
+
+	return out.String()
+}
+
+func endsInExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// render is like Inspect, but prints hash pairs in a fixed order and hides
+// how each engine represents functions.
+func render(obj object.Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "null"
+	case *object.Function, *object.Closure, *object.Builtin:
+		return "fn"
+	case *object.Array:
+		elements := make([]string, len(obj.Elements))
+		for i, el := range obj.Elements {
+			elements[i] = render(el)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.Hash:
+		pairs := make([]string, 0, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			pairs = append(pairs, render(pair.Key)+": "+render(pair.Value))
+		}
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ", ") + "}"
+	default:
+		return obj.Inspect()
+	}
+}
+
+// stdoutMu serializes captureStdout, which swaps the process-wide
+// os.Stdout that builtins such as puts print to.
+var stdoutMu sync.Mutex
+
+func captureStdout(fn func()) string {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+
+	captured := make(chan string)
+	go func() {
+		var out bytes.Buffer
+		_, _ = io.Copy(&out, r)
+		captured <- out.String()
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	fn()
+
+	_ = w.Close()
+	return <-captured
+}
@@ -0,0 +1,67 @@
+package conformance
+
+import (
+	"github.com/mehrankamal/monkey/object"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.mk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no programs in testdata")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			program, err := Parse(string(input))
+			if err != nil {
+				t.Fatalf("parser error: %s", err)
+			}
+
+			if diff := Diff(program, object.Config{}); diff != "" {
+				t.Errorf("engines disagree:\n%s", diff)
+			}
+		})
+	}
+}
+
+// generatedConfig runs generated programs with checked arithmetic, as
+// their loops can otherwise square numbers until they take up all memory.
+var generatedConfig = object.Config{CheckedArithmetic: true}
+
+func TestGeneratedPrograms(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		data := make([]byte, r.Intn(512))
+		r.Read(data)
+
+		if diff := Diff(Generate(data), generatedConfig); diff != "" {
+			t.Fatalf("engines disagree on program generated from %q:\n%s\n%s",
+				data, Generate(data).String(), diff)
+		}
+	}
+}
+
+func FuzzEngines(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("let x = fn(y) { y * 2 }; x(21)"))
+	f.Add([]byte{1, 3, 2, 1, 7, 5, 4, 1, 9, 9, 2, 0, 5, 3, 1, 1, 6, 0, 2, 4})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		program := Generate(data)
+		if diff := Diff(program, generatedConfig); diff != "" {
+			t.Errorf("engines disagree on\n%s\n%s", program.String(), diff)
+		}
+	})
+}
@@ -0,0 +1,476 @@
+package conformance
+
+import (
+	"fmt"
+	"github.com/mehrankamal/monkey/ast"
+	"github.com/mehrankamal/monkey/token"
+	"strconv"
+)
+
+// kind is the type of value a generated expression produces. Generating
+// expressions by kind keeps programs free of type errors, whose messages
+// the two engines are not expected to share.
+type kind int
+
+const (
+	intKind kind = iota
+	boolKind
+	stringKind
+	arrayKind // arrays of integers
+	fnKind    // functions from one integer to an integer
+	anyKind   // values only ever printed, such as caught exceptions
+)
+
+const (
+	maxExpressionDepth = 4
+	maxBlockDepth      = 3
+	maxStatements      = 6
+)
+
+type variable struct {
+	name string
+	kind kind
+	// readonly variables are loop counters, which must not be assigned
+	readonly bool
+}
+
+// Generate builds a well-formed program from data, such as the input of a
+// fuzz target. Each byte picks among the ways to continue the program;
+// once data runs out the simplest choices are made, so every input yields
+// a finite program that ends in an expression statement. Loops are bounded
+// and functions cannot refer to themselves, so programs always halt.
+func Generate(data []byte) *ast.Program {
+	g := &generator{data: data}
+	g.scopes = [][]variable{nil}
+
+	program := &ast.Program{}
+	for g.choose(maxStatements) != 0 {
+		program.Statements = append(program.Statements, g.statement(0))
+	}
+	program.Statements = append(program.Statements,
+		expressionStatement(g.expression(kind(g.choose(int(fnKind))), 0)))
+
+	return program
+}
+
+type generator struct {
+	data []byte
+	pos  int
+
+	// visible variables of each enclosing block, innermost last
+	scopes [][]variable
+	names  int
+
+	loopDepth  int
+	tryDepth   int
+	inFunction bool
+}
+
+// choose consumes a byte and returns a number in [0, n).
+func (g *generator) choose(n int) int {
+	if g.pos >= len(g.data) {
+		return 0
+	}
+	b := g.data[g.pos]
+	g.pos++
+	return int(b) % n
+}
+
+// newName returns an identifier not used before. The prefix keeps names
+// clear of keywords and builtins.
+func (g *generator) newName() string {
+	name := ""
+	for n := g.names; ; n = n/26 - 1 {
+		name = string(rune('a'+n%26)) + name
+		if n < 26 {
+			break
+		}
+	}
+	g.names++
+	return "v" + name
+}
+
+func (g *generator) define(k kind, readonly bool) *ast.Identifier {
+	name := g.newName()
+	scope := len(g.scopes) - 1
+	g.scopes[scope] = append(g.scopes[scope], variable{name: name, kind: k, readonly: readonly})
+	return identifier(name)
+}
+
+func (g *generator) visible(k kind, assignable bool) []variable {
+	var vars []variable
+	for _, scope := range g.scopes {
+		for _, v := range scope {
+			if v.kind == k && !(assignable && v.readonly) {
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars
+}
+
+// block generates statements in a new scope. Variables defined in it are
+// not visible afterwards, as the evaluator only defines them when the block
+// runs.
+func (g *generator) block(depth int, final ast.Statement) *ast.BlockStatement {
+	g.scopes = append(g.scopes, nil)
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+
+	block := &ast.BlockStatement{Token: token.Token{Type: token.LBRACE, Literal: "{"}}
+	for g.choose(maxStatements) != 0 {
+		block.Statements = append(block.Statements, g.statement(depth+1))
+	}
+	if final != nil {
+		block.Statements = append(block.Statements, final)
+	}
+	return block
+}
+
+func (g *generator) statement(depth int) ast.Statement {
+	if depth >= maxBlockDepth {
+		return g.letStatement(depth)
+	}
+
+	switch g.choose(8) {
+	case 1:
+		return expressionStatement(call(identifier("puts"), g.expression(g.printable(), depth)))
+	case 2:
+		if assign := g.assignment(depth); assign != nil {
+			return expressionStatement(assign)
+		}
+	case 3:
+		return g.whileStatement(depth)
+	case 4:
+		return g.forStatement(depth)
+	case 5:
+		return g.tryStatement(depth)
+	case 6:
+		if stmt := g.jumpStatement(depth); stmt != nil {
+			return stmt
+		}
+	case 7:
+		if g.tryDepth == 0 {
+			break
+		}
+		return &ast.ThrowStatement{
+			Token: token.Token{Type: token.THROW, Literal: "throw"},
+			Value: g.expression(stringKind, depth),
+		}
+	}
+	return g.letStatement(depth)
+}
+
+func (g *generator) printable() kind {
+	kinds := []kind{intKind, boolKind, stringKind, arrayKind, anyKind}
+	return kinds[g.choose(len(kinds))]
+}
+
+func (g *generator) letStatement(depth int) ast.Statement {
+	k := kind(g.choose(int(anyKind)))
+	value := g.expression(k, depth)
+	name := g.define(k, false)
+	if fn, ok := value.(*ast.FunctionLiteral); ok {
+		fn.Name = name.Value
+	}
+	return &ast.LetStatement{
+		Token: token.Token{Type: token.LET, Literal: "let"},
+		Name:  name,
+		Value: value,
+	}
+}
+
+func (g *generator) assignment(depth int) ast.Expression {
+	k := kind(g.choose(int(fnKind)))
+	vars := g.visible(k, true)
+	if len(vars) == 0 {
+		return nil
+	}
+	target := identifier(vars[g.choose(len(vars))].name)
+
+	operator := "="
+	if k == intKind && g.choose(2) == 1 {
+		operator = []string{"+=", "-=", "*="}[g.choose(3)]
+	}
+
+	return &ast.AssignExpression{
+		Token:    token.Token{Type: token.ASSIGN, Literal: operator},
+		Target:   target,
+		Operator: operator,
+		Value:    g.expression(k, depth),
+	}
+}
+
+// whileStatement generates a loop over a fresh counter, which only the
+// loop itself advances.
+func (g *generator) whileStatement(depth int) ast.Statement {
+	limit := integer(int64(g.choose(5)))
+	counter := g.define(intKind, true)
+
+	g.loopDepth++
+	body := g.block(depth, nil)
+	g.loopDepth--
+
+	// advance the counter first so that continue cannot skip it
+	advance := expressionStatement(&ast.AssignExpression{
+		Token:    token.Token{Type: token.PLUS_ASSIGN, Literal: "+="},
+		Target:   identifier(counter.Value),
+		Operator: "+=",
+		Value:    integer(1),
+	})
+	body.Statements = append([]ast.Statement{advance}, body.Statements...)
+
+	return &ast.BlockStatement{
+		Token: token.Token{Type: token.LBRACE, Literal: "{"},
+		Statements: []ast.Statement{
+			&ast.LetStatement{
+				Token: token.Token{Type: token.LET, Literal: "let"},
+				Name:  counter,
+				Value: integer(0),
+			},
+			&ast.WhileStatement{
+				Token:     token.Token{Type: token.WHILE, Literal: "while"},
+				Condition: infix(identifier(counter.Value), "<", limit),
+				Body:      body,
+			},
+		},
+	}
+}
+
+func (g *generator) forStatement(depth int) ast.Statement {
+	iterable := g.expression(arrayKind, depth)
+
+	g.scopes = append(g.scopes, nil)
+	variable := g.define(intKind, true)
+	g.loopDepth++
+	body := g.block(depth, nil)
+	g.loopDepth--
+	g.scopes = g.scopes[:len(g.scopes)-1]
+
+	return &ast.ForStatement{
+		Token:    token.Token{Type: token.FOR, Literal: "for"},
+		Variable: variable,
+		Iterable: iterable,
+		Body:     body,
+	}
+}
+
+func (g *generator) tryStatement(depth int) ast.Statement {
+	stmt := &ast.TryStatement{
+		Token: token.Token{Type: token.TRY, Literal: "try"},
+	}
+
+	// only throw where it may be caught
+	g.tryDepth++
+	stmt.Block = g.block(depth, nil)
+	g.tryDepth--
+
+	hasCatch := g.choose(3) != 0
+	if hasCatch {
+		g.scopes = append(g.scopes, nil)
+		stmt.Param = g.define(anyKind, true)
+		stmt.Catch = g.block(depth, nil)
+		g.scopes = g.scopes[:len(g.scopes)-1]
+	}
+	if !hasCatch || g.choose(2) == 1 {
+		stmt.Finally = g.block(depth, nil)
+	}
+
+	return stmt
+}
+
+// jumpStatement generates a conditional break, continue or return, if one
+// is allowed where the program is.
+func (g *generator) jumpStatement(depth int) ast.Statement {
+	var jump ast.Statement
+	switch {
+	case g.loopDepth > 0 && g.choose(3) == 0:
+		jump = &ast.BreakStatement{Token: token.Token{Type: token.BREAK, Literal: "break"}}
+	case g.loopDepth > 0 && g.choose(2) == 0:
+		jump = &ast.ContinueStatement{Token: token.Token{Type: token.CONTINUE, Literal: "continue"}}
+	case g.inFunction:
+		jump = &ast.ReturnStatement{
+			Token:       token.Token{Type: token.RETURN, Literal: "return"},
+			ReturnValue: g.expression(intKind, depth),
+		}
+	default:
+		return nil
+	}
+
+	return expressionStatement(&ast.IfExpression{
+		Token:       token.Token{Type: token.IF, Literal: "if"},
+		Condition:   g.expression(boolKind, depth),
+		Consequence: &ast.BlockStatement{Statements: []ast.Statement{jump}},
+	})
+}
+
+func (g *generator) expression(k kind, depth int) ast.Expression {
+	if depth >= maxExpressionDepth {
+		return g.literal(k)
+	}
+	depth++
+
+	if vars := g.visible(k, false); len(vars) > 0 && g.choose(3) == 1 {
+		return identifier(vars[g.choose(len(vars))].name)
+	}
+
+	switch k {
+	case intKind:
+		return g.intExpression(depth)
+	case boolKind:
+		return g.boolExpression(depth)
+	case stringKind:
+		switch g.choose(3) {
+		case 1:
+			return infix(g.expression(stringKind, depth), "+", g.expression(stringKind, depth))
+		case 2:
+			return g.ifExpression(stringKind, depth)
+		}
+	case arrayKind:
+		switch g.choose(3) {
+		case 1:
+			elements := make([]ast.Expression, g.choose(4))
+			for i := range elements {
+				elements[i] = g.expression(intKind, depth)
+			}
+			return &ast.ArrayLiteral{Token: token.Token{Type: token.LBRACKET, Literal: "["}, Elements: elements}
+		case 2:
+			return call(identifier("push"), g.expression(arrayKind, depth), g.expression(intKind, depth))
+		}
+	case fnKind:
+		return g.functionLiteral(depth)
+	case anyKind:
+		return g.expression(g.printable(), depth)
+	}
+
+	return g.literal(k)
+}
+
+func (g *generator) intExpression(depth int) ast.Expression {
+	switch g.choose(9) {
+	case 1:
+		operators := []string{"+", "-", "*", "/", "%", "&", "|", "^"}
+		return infix(g.expression(intKind, depth), operators[g.choose(len(operators))], g.expression(intKind, depth))
+	case 2:
+		// small constant shifts and powers keep numbers readable
+		operators := []string{"<<", ">>", "**"}
+		return infix(g.expression(intKind, depth), operators[g.choose(len(operators))], integer(int64(g.choose(4))))
+	case 3:
+		operators := []string{"-", "~"}
+		operator := operators[g.choose(len(operators))]
+		return &ast.PrefixExpression{
+			Token:    token.Token{Literal: operator},
+			Operator: operator,
+			Right:    g.expression(intKind, depth),
+		}
+	case 4:
+		return g.ifExpression(intKind, depth)
+	case 5:
+		return call(identifier("len"), g.expression(arrayKind, depth))
+	case 6:
+		return call(identifier("len"), g.expression(stringKind, depth))
+	case 7:
+		return call(g.expression(fnKind, depth), g.expression(intKind, depth))
+	}
+	return g.literal(intKind)
+}
+
+func (g *generator) boolExpression(depth int) ast.Expression {
+	switch g.choose(6) {
+	case 1:
+		operators := []string{"<", ">", "<=", ">=", "==", "!="}
+		return infix(g.expression(intKind, depth), operators[g.choose(len(operators))], g.expression(intKind, depth))
+	case 2:
+		operators := []string{"==", "!="}
+		return infix(g.expression(stringKind, depth), operators[g.choose(len(operators))], g.expression(stringKind, depth))
+	case 3:
+		operators := []string{"&&", "||"}
+		return infix(g.expression(boolKind, depth), operators[g.choose(len(operators))], g.expression(boolKind, depth))
+	case 4:
+		return &ast.PrefixExpression{
+			Token:    token.Token{Type: token.BANG, Literal: "!"},
+			Operator: "!",
+			Right:    g.expression(boolKind, depth),
+		}
+	case 5:
+		return g.ifExpression(boolKind, depth)
+	}
+	return g.literal(boolKind)
+}
+
+// ifExpression always has an alternative, as an if without one may
+// produce null.
+func (g *generator) ifExpression(k kind, depth int) ast.Expression {
+	return &ast.IfExpression{
+		Token:       token.Token{Type: token.IF, Literal: "if"},
+		Condition:   g.expression(boolKind, depth),
+		Consequence: g.block(depth, expressionStatement(g.expression(k, depth))),
+		Alternative: g.block(depth, expressionStatement(g.expression(k, depth))),
+	}
+}
+
+func (g *generator) functionLiteral(depth int) ast.Expression {
+	inFunction, loopDepth, tryDepth := g.inFunction, g.loopDepth, g.tryDepth
+	g.inFunction, g.loopDepth, g.tryDepth = true, 0, 0
+	defer func() { g.inFunction, g.loopDepth, g.tryDepth = inFunction, loopDepth, tryDepth }()
+
+	g.scopes = append(g.scopes, nil)
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+
+	param := g.define(intKind, false)
+	return &ast.FunctionLiteral{
+		Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+		Parameters: []*ast.Identifier{param},
+		Body:       g.block(depth, expressionStatement(g.expression(intKind, depth))),
+	}
+}
+
+func (g *generator) literal(k kind) ast.Expression {
+	switch k {
+	case boolKind:
+		value := g.choose(2) == 1
+		return &ast.Boolean{Token: token.Token{Literal: strconv.FormatBool(value)}, Value: value}
+	case stringKind:
+		value := []string{"", "a", "mon", "key", "monkey"}[g.choose(5)]
+		return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: value}, Value: value}
+	case arrayKind:
+		return &ast.ArrayLiteral{Token: token.Token{Type: token.LBRACKET, Literal: "["}}
+	case fnKind:
+		param := identifier(g.newName())
+		return &ast.FunctionLiteral{
+			Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+			Parameters: []*ast.Identifier{param},
+			Body:       &ast.BlockStatement{Statements: []ast.Statement{expressionStatement(identifier(param.Value))}},
+		}
+	default:
+		return integer(int64(g.choose(256)) - 128)
+	}
+}
+
+func identifier(name string) *ast.Identifier {
+	return &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+}
+
+func integer(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: fmt.Sprint(value)}, Value: value}
+}
+
+func infix(left ast.Expression, operator string, right ast.Expression) ast.Expression {
+	return &ast.InfixExpression{
+		Token:    token.Token{Literal: operator},
+		Left:     left,
+		Operator: operator,
+		Right:    right,
+	}
+}
+
+func call(function ast.Expression, args ...ast.Expression) ast.Expression {
+	return &ast.CallExpression{
+		Token:     token.Token{Type: token.LPAREN, Literal: "("},
+		Function:  function,
+		Arguments: args,
+	}
+}
+
+func expressionStatement(expression ast.Expression) *ast.ExpressionStatement {
+	return &ast.ExpressionStatement{Expression: expression}
+}
@@ -0,0 +1,5 @@
+let a = 5 * (2 + 3) - 10 / 2;
+let b = a % 7;
+let c = 2 ** 10 + (1 << 4) - (256 >> 2);
+let d = (a & 12) | (b ^ 3);
+[a, b, c, d, -a, ~d, 1.5 * 2.0, 7 / 2, 2 ** -1]
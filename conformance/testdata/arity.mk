@@ -0,0 +1,2 @@
+let f = fn(a, b) { a + b };
+f(1)
@@ -0,0 +1,5 @@
+let xs = [1, 2, 3, 4];
+let ys = push(xs, 5);
+xs[0] = 10;
+ys[1] += 20;
+[xs, ys, first(ys), last(ys), rest(ys), len(ys), xs[10], [][0], first([]), rest([])]
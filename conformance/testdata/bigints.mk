@@ -0,0 +1,3 @@
+let big = 9223372036854775807 + 1;
+let literal = 0x1_0000_0000_0000_0000;
+[big, big * big, big - 1, 2 ** 100, -(big * 2) / 3, literal, literal - 1 == big * 2 - 1, -9223372036854775808, 99999999999999999999 % 7]
@@ -0,0 +1,12 @@
+let counter = fn() {
+	let n = 0;
+	let inc = fn() { n += 1 };
+	let get = fn() { n };
+	[inc, get]
+};
+let c = counter();
+let inc = c[0];
+let get = c[1];
+inc(); inc(); inc();
+let adder = fn(x) { fn(y) { x + y } };
+[get(), adder(2)(3), fn() { 1 }]
@@ -0,0 +1,11 @@
+let message = fn(f) {
+	let m = "";
+	try { f() } catch (e) { m = e["message"] };
+	m
+};
+[1 < 2, 2 <= 2, 3 > 4, 4 >= 5, 1 == 1, 1 != 1, true == false, "a" == "a",
+ !true, !!5, true && false, false || 5, "" || "x",
+ "a" != "b", "a" == "b",
+ message(fn() { "a" < "b" }), message(fn() { "a" <= "b" }),
+ message(fn() { "b" > "a" }), message(fn() { "b" >= "a" }),
+ message(fn() { "a" - "b" }), message(fn() { true < false }), message(fn() { 1 < "a" })]
@@ -0,0 +1,2 @@
+let divide = fn(a, b) { a / b };
+divide(1, 0)
@@ -0,0 +1,11 @@
+let log = [];
+let f = fn(name, value) { log = push(log, name); value };
+let results = [
+	f("a", 1) < f("b", 2),
+	f("c", 1) <= f("d", 1),
+	f("e", 2.5) > f("g", 1),
+	f("h", 1 << 64) >= f("i", 2),
+	f("j", 1) + f("k", 2) * f("l", 3)
+];
+puts(log);
+results
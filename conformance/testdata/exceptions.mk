@@ -0,0 +1,28 @@
+let log = [];
+let risky = fn(x) {
+	if (x > 2) { throw "too big: " + "x"; }
+	x
+};
+let safe = fn(x) {
+	try {
+		risky(x)
+	} catch (e) {
+		log = push(log, e);
+		-1
+	} finally {
+		log = push(log, "done");
+	}
+};
+let r = [];
+for (x in [1, 3]) {
+	try {
+		r = push(r, risky(x));
+	} catch (e) {
+		r = push(r, e);
+	}
+}
+let caught = "";
+try { len(1); } catch (e) { caught = e["message"]; }
+let divided = "";
+try { 1 / 0; } catch (e) { divided = e["message"]; }
+[r, log, caught, divided]
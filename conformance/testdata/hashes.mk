@@ -0,0 +1,5 @@
+let key = "two";
+let h = {"one": 1, key: 2, 3: "three", true: [1]};
+h["four"] = 4;
+h["one"] *= 10;
+[h, h["one"], h[3], h[true], h["missing"]]
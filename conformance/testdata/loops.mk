@@ -0,0 +1,24 @@
+let i = 0;
+let total = 0;
+while (i < 10) {
+	i += 1;
+	if (i % 2 == 0) { continue; }
+	if (i > 7) { break; }
+	total += i;
+}
+let names = [];
+for (x in ["a", "b", "c"]) {
+	if (x == "b") { continue; }
+	names = push(names, x);
+	puts(x);
+}
+let r = [];
+for (x in [1, 2, 3]) { r = push(r, if (x == 2) { continue } else { x }) }
+let n = 0;
+while (n < 5) { n += 1; puts(if (n > 2) { break }) }
+let bound = [];
+for (c in [false, true]) {
+	let x = if (c) { break };
+	bound = push(bound, x);
+}
+[i, total, names, r, n, bound]
@@ -0,0 +1,9 @@
+let message = fn(f) {
+	let m = "";
+	try { f() } catch (e) { m = e["message"] };
+	m
+};
+[message(fn() { ~1.5 }), message(fn() { ~"a" }),
+ message(fn() { 1.5 & 1 }), message(fn() { 1 | 2.5 }), message(fn() { 1.5 ^ 2.5 }),
+ message(fn() { 1.5 << 1 }), message(fn() { 1 >> 0.5 }), message(fn() { (2 ** 70) & 1.5 }),
+ message(fn() { "a" % "b" }), message(fn() { "a" ** "b" }), message(fn() { "a" & "b" })]
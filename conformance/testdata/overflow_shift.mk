@@ -0,0 +1 @@
+[1 << 62, 1 << 63, 1 << 64, -1 >> 1, 5 % -3]
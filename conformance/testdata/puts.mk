@@ -0,0 +1,5 @@
+puts(1, "two", [3], true);
+puts();
+puts(puts("nested"));
+let h = {"k": [1, 2]};
+puts(h["k"]);
@@ -0,0 +1,3 @@
+let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+let sum = fn(n, acc) { if (n == 0) { return acc; } sum(n - 1, acc + n) };
+[fib(15), sum(10000, 0)]
@@ -0,0 +1,4 @@
+let f = fn(x) { len(x) };
+puts("before");
+f(1);
+puts("after");
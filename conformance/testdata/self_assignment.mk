@@ -0,0 +1,8 @@
+let f = fn() { f = 1; f };
+let a = f();
+let outer = fn() { let g = fn() { fn() { g = 5 } }; let set = g(); set(); g };
+let r = outer();
+let h = fn(n) { if (n == 0) { h = "done"; return 0 } h(n - 1) };
+h(3);
+let k = fn(n) { let k = n; k = k + 1; k };
+[a, f, r, h, k(1), k(2)]
@@ -0,0 +1,6 @@
+let f = fn() { 1 + f() };
+let g = fn(n) { if (n == 0) { 0 } else { 1 + g(n - 1) } };
+let r = "";
+try { f() } catch (e) { r = e["message"] };
+puts(r, g(500));
+f()
@@ -0,0 +1,20 @@
+let inner = fn(x) {
+	len(x)
+};
+let outer = fn(x) {
+	let r = inner(x);
+	r
+};
+let stack = fn(f, x) {
+	let s = [];
+	try { f(x); } catch (e) { s = e["stack"]; }
+	s
+};
+let thrower = fn() {
+	1 + "a"
+};
+[
+	stack(outer, 1),
+	stack(inner, true),
+	stack(fn(x) { thrower() }, 0)
+]
@@ -0,0 +1,4 @@
+let greet = fn(name) { "Hello, " + name + "!" };
+let s = greet("Monkey");
+puts(s);
+[s, len(s), "" + ""]
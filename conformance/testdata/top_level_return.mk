@@ -0,0 +1,7 @@
+let double = fn(x) { x * 2 };
+let r = [];
+for (x in [1, 2, 3]) {
+	if (x == 3) { return [r, double(x)]; }
+	r = push(r, x);
+}
+"unreachable"
@@ -0,0 +1,2 @@
+let check = fn(x) { if (x < 0) { throw "negative"; } x };
+check(1) + check(-1)
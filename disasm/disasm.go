@@ -0,0 +1,287 @@
+// Package disasm prints readable listings of compiled Monkey programs.
+package disasm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/object"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Disassemble returns the listing of bc.
+func Disassemble(bc *compiler.Bytecode) string {
+	var out bytes.Buffer
+	_ = Fprint(&out, bc)
+	return out.String()
+}
+
+// Fprint writes the listing of bc to w: the main program followed by every
+// function in the constant pool, each listed after the function that
+// creates it. Instructions are annotated with the constants, builtins and
+// free variables they refer to, jump targets are labeled and source lines
+// marked.
+func Fprint(w io.Writer, bc *compiler.Bytecode) error {
+	d := &disassembler{
+		constants: bc.Constants,
+		builtins:  bc.Builtins,
+		listed:    map[int]bool{},
+	}
+
+	d.function(&object.CompiledFunction{
+		Instructions: bc.Instructions,
+		Name:         "<main>",
+		Filename:     bc.Filename,
+		Lines:        bc.Lines,
+		Handlers:     bc.Handlers,
+	}, "")
+
+	// functions no listed code creates, such as those of earlier REPL lines
+	for idx, constant := range bc.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && !d.listed[idx] {
+			d.constantFunction(idx, fn)
+		}
+	}
+
+	_, err := w.Write(d.out.Bytes())
+	return err
+}
+
+type disassembler struct {
+	out       bytes.Buffer
+	constants []object.Object
+	builtins  []string     // names of the builtins the program was compiled with
+	listed    map[int]bool // indices of the functions listed so far
+}
+
+// instruction is a decoded instruction. Malformed instructions have err set.
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	def      *code.Definition
+	operands []int
+	err      string
+}
+
+func decode(ins code.Instructions) []instruction {
+	var decoded []instruction
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			decoded = append(decoded, instruction{offset: i, err: err.Error()})
+			i++
+			continue
+		}
+
+		if width := def.Width(); i+width > len(ins) {
+			decoded = append(decoded, instruction{offset: i, err: fmt.Sprintf(
+				"%s needs %d bytes, %d left", def.Name, width, len(ins)-i)})
+			break
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		decoded = append(decoded, instruction{offset: i, op: code.Opcode(ins[i]), def: def, operands: operands})
+		i += 1 + read
+	}
+
+	return decoded
+}
+
+// isJump reports whether the first operand of op is an instruction offset.
+func isJump(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpJumpFalsy, code.OpIterNext:
+		return true
+	}
+	return false
+}
+
+// labels names the jump and handler targets of a function L0, L1, ... in
+// the order they appear.
+func labels(instructions []instruction, handlers code.HandlerTable) map[int]string {
+	targets := map[int]bool{}
+	for _, ins := range instructions {
+		if ins.err == "" && isJump(ins.op) {
+			targets[ins.operands[0]] = true
+		}
+	}
+	for _, h := range handlers {
+		targets[h.Target] = true
+	}
+
+	offsets := make([]int, 0, len(targets))
+	for offset := range targets {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	names := make(map[int]string, len(offsets))
+	for i, offset := range offsets {
+		names[offset] = fmt.Sprintf("L%d", i)
+	}
+	return names
+}
+
+func (d *disassembler) constantFunction(idx int, fn *object.CompiledFunction) {
+	d.listed[idx] = true
+	d.out.WriteString("\n")
+	d.function(fn, fmt.Sprintf("constant %d", idx))
+}
+
+func (d *disassembler) function(fn *object.CompiledFunction, origin string) {
+	d.header(fn, origin)
+
+	instructions := decode(fn.Instructions)
+	labels := labels(instructions, fn.Handlers)
+
+	// functions this one creates, listed after it
+	var created []int
+
+	line := 0
+	lines := fn.Lines
+	for _, ins := range instructions {
+		for len(lines) > 0 && lines[0].Offset <= ins.offset {
+			if lines[0].Line != line {
+				line = lines[0].Line
+				d.lineMarker(fn.Filename, line)
+			}
+			lines = lines[1:]
+		}
+
+		if label, ok := labels[ins.offset]; ok {
+			fmt.Fprintf(&d.out, "%s:\n", label)
+		}
+
+		if ins.err != "" {
+			fmt.Fprintf(&d.out, "  %04d ERROR: %s\n", ins.offset, ins.err)
+			continue
+		}
+
+		text, comment := d.instruction(fn, ins, labels)
+		if comment == "" {
+			fmt.Fprintf(&d.out, "  %04d %s\n", ins.offset, text)
+		} else {
+			fmt.Fprintf(&d.out, "  %04d %-24s ; %s\n", ins.offset, text, comment)
+		}
+
+		if ins.op == code.OpConstant || ins.op == code.OpClosure {
+			idx := ins.operands[0]
+			if _, ok := d.constant(idx).(*object.CompiledFunction); ok {
+				created = append(created, idx)
+			}
+		}
+	}
+
+	if label, ok := labels[len(fn.Instructions)]; ok {
+		fmt.Fprintf(&d.out, "%s:\n", label)
+	}
+
+	for _, h := range fn.Handlers {
+		fmt.Fprintf(&d.out, "  handler %04d-%04d -> %s, depth %d\n", h.Start, h.End, labels[h.Target], h.Depth)
+	}
+
+	for _, idx := range created {
+		if !d.listed[idx] {
+			d.constantFunction(idx, d.constants[idx].(*object.CompiledFunction))
+		}
+	}
+}
+
+func (d *disassembler) header(fn *object.CompiledFunction, origin string) {
+	fmt.Fprintf(&d.out, "== %s", functionName(fn))
+
+	var details []string
+	if origin != "" {
+		details = append(details, origin)
+	}
+	if fn.NumParameters > 0 {
+		details = append(details, count(fn.NumParameters, "param"))
+	}
+	if fn.NumLocals > 0 {
+		details = append(details, count(fn.NumLocals, "local"))
+	}
+	if len(fn.FreeNames) > 0 {
+		details = append(details, "free "+strings.Join(fn.FreeNames, ", "))
+	}
+	if len(details) > 0 {
+		fmt.Fprintf(&d.out, " (%s)", strings.Join(details, "; "))
+	}
+
+	d.out.WriteString(" ==\n")
+}
+
+func (d *disassembler) lineMarker(filename string, line int) {
+	if filename != "" {
+		fmt.Fprintf(&d.out, "; %s:%d\n", filename, line)
+	} else {
+		fmt.Fprintf(&d.out, "; line %d\n", line)
+	}
+}
+
+// instruction returns the text of ins and a comment on what it refers to.
+func (d *disassembler) instruction(fn *object.CompiledFunction, ins instruction, labels map[int]string) (string, string) {
+	operands := make([]string, len(ins.operands))
+	for i, operand := range ins.operands {
+		operands[i] = strconv.Itoa(operand)
+	}
+	if isJump(ins.op) {
+		operands[0] = labels[ins.operands[0]]
+	}
+
+	text := strings.Join(append([]string{ins.def.Name}, operands...), " ")
+
+	var comment string
+	switch ins.op {
+	case code.OpConstant, code.OpClosure:
+		comment = d.describeConstant(ins.operands[0])
+	case code.OpGetBuiltin:
+		if idx := ins.operands[0]; idx < len(d.builtins) {
+			comment = d.builtins[idx]
+		}
+	case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+		if idx := ins.operands[0]; idx < len(fn.FreeNames) {
+			comment = fn.FreeNames[idx]
+		}
+	}
+
+	return text, comment
+}
+
+func (d *disassembler) constant(idx int) object.Object {
+	if idx < 0 || idx >= len(d.constants) {
+		return nil
+	}
+	return d.constants[idx]
+}
+
+func (d *disassembler) describeConstant(idx int) string {
+	switch constant := d.constant(idx).(type) {
+	case nil:
+		return "no such constant"
+	case *object.String:
+		return strconv.Quote(constant.Value)
+	case *object.CompiledFunction:
+		return "fn " + functionName(constant)
+	default:
+		return constant.Inspect()
+	}
+}
+
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
+
+func count(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
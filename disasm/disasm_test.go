@@ -0,0 +1,163 @@
+package disasm
+
+import (
+	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/lexer"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/parser"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `let greet = fn(name) {
+	let make = fn() { "hello " + name };
+	make
+};
+for (x in [1]) { if (x) { break; } }
+try { len(1) } catch (e) { puts(e) }
+greet("x")();`
+
+	expected := `== <main> ==
+; t.mk:1
+  0000 OpClosure 2 0            ; fn greet
+  0004 OpSetGlobal 0
+; t.mk:5
+  0007 OpConstant 3             ; 1
+  0010 OpArray 1
+  0013 OpIter
+L0:
+  0014 OpIterNext L3
+  0017 OpSetGlobal 1
+  0020 OpGetGlobal 1
+  0023 OpJumpFalsy L1
+  0026 OpPop
+  0027 OpJump L3
+  0030 OpNull
+  0031 OpJump L2
+L1:
+  0034 OpNull
+L2:
+  0035 OpPop
+  0036 OpJump L0
+; t.mk:6
+L3:
+  0039 OpGetBuiltin 0           ; len
+  0041 OpConstant 4             ; 1
+  0044 OpCall 1
+  0046 OpPop
+  0047 OpJump L5
+L4:
+  0050 OpSetGlobal 2
+  0053 OpGetBuiltin 1           ; puts
+  0055 OpGetGlobal 2
+  0058 OpCall 1
+  0060 OpPop
+; t.mk:7
+L5:
+  0061 OpGetGlobal 0
+  0064 OpConstant 5             ; "x"
+  0067 OpCall 1
+  0069 OpCall 0
+  0071 OpPop
+  handler 0039-0047 -> L4, depth 0
+
+== greet (constant 2; 1 param; 2 locals) ==
+; t.mk:2
+  0000 OpCaptureLocal 0
+  0002 OpClosure 1 1            ; fn make
+  0006 OpSetLocal 1
+; t.mk:3
+  0008 OpGetLocal 1
+  0010 OpReturnValue
+
+== make (constant 1; free name) ==
+; t.mk:2
+  0000 OpConstant 0             ; "hello "
+  0003 OpGetFree 0              ; name
+  0005 OpAdd
+  0006 OpReturnValue
+`
+
+	p := parser.New(lexer.NewWithFilename(input, "t.mk"))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	listing := Disassemble(comp.Bytecode())
+	if listing != expected {
+		t.Errorf("wrong listing.\nwant:\n%s\ngot:\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleUnreferencedFunctions(t *testing.T) {
+	bc := &compiler.Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants: []object.Object{
+			&object.Integer{Value: 7},
+			&object.CompiledFunction{Instructions: code.Make(code.OpReturn)},
+		},
+	}
+
+	expected := `== <main> ==
+  0000 OpConstant 0             ; 7
+
+== <anonymous> (constant 1) ==
+  0000 OpReturn
+`
+
+	if listing := Disassemble(bc); listing != expected {
+		t.Errorf("wrong listing.\nwant:\n%s\ngot:\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleBuiltinSet(t *testing.T) {
+	comp := compiler.NewWithBuiltins(object.PureBuiltins())
+	if err := comp.Compile(parser.New(lexer.New("first(rest)")).ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `== <main> ==
+; line 1
+  0000 OpGetBuiltin 1           ; first
+  0002 OpGetBuiltin 3           ; rest
+  0004 OpCall 1
+  0006 OpPop
+`
+
+	if listing := Disassemble(comp.Bytecode()); listing != expected {
+		t.Errorf("wrong listing.\nwant:\n%s\ngot:\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleMalformed(t *testing.T) {
+	instructions := code.Instructions{}
+	instructions = append(instructions, code.Make(code.OpConstant, 9)...)
+	instructions = append(instructions, 255)
+	instructions = append(instructions, code.Make(code.OpJump, 0)...)
+	instructions = append(instructions, byte(code.OpGetFree))
+
+	expected := `== <main> ==
+L0:
+  0000 OpConstant 9             ; no such constant
+  0003 ERROR: opcode 255 undefined
+  0004 OpJump L0
+  0007 ERROR: OpGetFree needs 2 bytes, 1 left
+`
+
+	listing := Disassemble(&compiler.Bytecode{Instructions: instructions})
+	if listing != expected {
+		t.Errorf("wrong listing.\nwant:\n%s\ngot:\n%s", expected, listing)
+	}
+
+	if !strings.Contains(instructions.String(), "0003 ERROR: opcode 255 undefined") {
+		t.Errorf("Instructions.String() does not report the unknown opcode:\n%s", instructions)
+	}
+}
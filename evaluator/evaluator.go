@@ -1,18 +1,82 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
 	"github.com/mehrankamal/monkey/ast"
 	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/token"
+	"math"
+	"math/big"
+	"strings"
 )
 
 var (
 	NULL  = &object.Null{}
 	TRUE  = &object.Boolean{Value: true}
 	FALSE = &object.Boolean{Value: false}
+
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Budget().Step(); err != nil {
+		halt := haltError(err)
+		locate(halt, node.Pos(), env)
+		return halt
+	}
+
+	result := eval(node, env)
+
+	// errors are located at the innermost node they came out of
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() {
+		locate(err, node.Pos(), env)
+	}
+
+	return result
+}
+
+// locate places err, raised at pos, and completes its stack with the calls
+// env is in.
+func locate(err *object.Error, pos token.Position, env *object.Environment) {
+	err.Pos = pos
+	for _, frame := range env.Calls().Trace(pos) {
+		err.Stack = append(err.Stack, frame.String())
+	}
+}
+
+// EvalContext is like Eval, but also stops once ctx is done. Stopped
+// programs, including those that exceed the instruction or allocation
+// limits of the environment's config, evaluate to an *object.Error whose
+// Cause is the error of ctx or wraps object.ErrInstructionLimit or
+// object.ErrAllocationLimit. Try statements cannot catch these errors.
+// Eval on its own counts instructions and objects from the creation of the
+// environment or the end of the last EvalContext with it.
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment) object.Object {
+	budget := env.Budget()
+	budget.Start(ctx)
+	defer budget.Start(context.Background())
+
+	return Eval(node, env)
+}
+
+// haltError returns the error that stops the program when its budget is
+// spent. Try statements do not catch it.
+func haltError(err error) *object.Error {
+	return &object.Error{Message: err.Error(), Cause: err}
+}
+
+// allocate counts obj against the allocation limits of env and returns it,
+// or the error that stops the program when a limit is exceeded.
+func allocate(env *object.Environment, obj object.Object) object.Object {
+	if err := env.Budget().Allocate(obj); err != nil {
+		return haltError(err)
+	}
+	return obj
+}
+
+func eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
@@ -22,7 +86,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.BlockStatement:
 		return evalBlockStatements(node.Statements, env)
 	case *ast.ReturnStatement:
-		returnVal := Eval(node.ReturnValue, env)
+		var returnVal object.Object
+		if call, ok := node.ReturnValue.(*ast.CallExpression); ok {
+			returnVal = evalTailCall(call, env)
+		} else {
+			returnVal = Eval(node.ReturnValue, env)
+		}
 		if isError(returnVal) {
 			return returnVal
 		}
@@ -33,14 +102,34 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return val
 		}
 		env.Set(node.Name.Value, val)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return object.Thrown(val)
+	case *ast.TryStatement:
+		return evalTryStatement(node, env)
 
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return evalPrefixExpression(node.Operator, right, env)
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
@@ -49,7 +138,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return evalInfixExpression(node.Operator, left, right, env)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
 	case *ast.CallExpression:
@@ -61,7 +152,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return evalFunctionCall(function, args)
+		return callAt(node.Pos(), function, args, env)
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
 		if isError(left) {
@@ -74,7 +165,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalIndexExpression(left, index)
 
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return &object.BigInt{Value: node.Big}
+		}
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.Identifier:
@@ -82,7 +178,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return allocate(env, &object.Function{Name: node.Name, Parameters: params, Env: env, Body: body})
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.ArrayLiteral:
@@ -90,7 +186,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
+		return allocate(env, &object.Array{Elements: elements})
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, env)
 	}
@@ -121,7 +217,7 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 		pairs[hashed] = object.HashPair{Key: key, Value: value}
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return allocate(env, &object.Hash{Pairs: pairs})
 }
 
 func evalIndexExpression(left, index object.Object) object.Object {
@@ -130,12 +226,117 @@ func evalIndexExpression(left, index object.Object) object.Object {
 		return evalArrayIndexExpression(left, index)
 	case left.Type() == object.HASH:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.EXCEPTION && index.Type() == object.STRING:
+		if field, ok := left.(*object.Exception).Field(index.(*object.String).Value); ok {
+			return field
+		}
+		return NULL
 	default:
 		return newError("index operator not supported: %s", left.Type())
 
 	}
 }
 
+// evalAssignExpression stores into a variable, array element or hash entry
+// and returns the stored value. Compound operators such as += read the
+// current value first and evaluate the target's operands only once.
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	operator := strings.TrimSuffix(node.Operator, "=")
+
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		var current object.Object
+		if operator != "" {
+			current = evalIdentifier(target, env)
+			if isError(current) {
+				return current
+			}
+		}
+
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+
+		if operator != "" {
+			val = evalInfixExpression(operator, current, val, env)
+			if isError(val) {
+				return val
+			}
+		}
+
+		if !env.Assign(target.Value, val) {
+			if _, ok := env.Config().BuiltinSet().Lookup(target.Value); ok {
+				return newError("cannot assign to %s", target.Value)
+			}
+			return newError("identifier not found: " + target.Value)
+		}
+		return val
+
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+
+		var current object.Object
+		if operator != "" {
+			current = evalIndexExpression(left, index)
+			if isError(current) {
+				return current
+			}
+		}
+
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+
+		if operator != "" {
+			val = evalInfixExpression(operator, current, val, env)
+			if isError(val) {
+				return val
+			}
+		}
+
+		return evalSetIndexExpression(left, index, val, env.Budget())
+
+	default:
+		return newError("invalid assignment target %s", node.Target.String())
+	}
+}
+
+func evalSetIndexExpression(left, index, val object.Object, budget *object.Budget) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError("index out of range: %d (length %d)", idx.Value, len(left.Elements))
+		}
+		left.Elements[idx.Value] = val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+		if err := budget.CheckSize(left); err != nil {
+			return haltError(err)
+		}
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+
+	return val
+}
+
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 
@@ -165,22 +366,135 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
-func evalFunctionCall(fn object.Object, args []object.Object) object.Object {
-	switch function := fn.(type) {
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(function, args)
-		evaluated := Eval(function.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
-	case *object.Builtin:
-		if result := function.Fn(args...); result != nil {
+// callAt makes a call at pos from the innermost call of env. Its errors are
+// located there unless they were raised inside the callee.
+func callAt(pos token.Position, fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	env.Calls().Call(pos)
+	result := evalFunctionCall(fn, args, env)
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() {
+		locate(err, pos, env)
+	}
+	return result
+}
+
+// evalFunctionCall is a trampoline: a function whose body ends in a tail
+// call hands the call back as a *object.TailCall, which is made here in a
+// loop instead of recursing, in place of the frame of the function.
+func evalFunctionCall(fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	for {
+		switch function := fn.(type) {
+		case *object.Function:
+			if len(args) != len(function.Parameters) {
+				return newError("wrong number of arguments: want=%d, got=%d",
+					len(function.Parameters), len(args))
+			}
+
+			if env.Calls().Depth() >= object.MaxCallDepth {
+				return newError("stack overflow")
+			}
+
+			extendedEnv := extendFunctionEnv(function, args)
+			env.Calls().Push(functionName(function))
+			evaluated := evalFunctionBody(function.Body, extendedEnv)
+			if err := strayLoopControl(evaluated); err != nil {
+				evaluated = err
+			}
+
+			evaluated = unwrapReturnValue(evaluated)
+			if tailCall, ok := evaluated.(*object.TailCall); ok {
+				if _, ok := tailCall.Fn.(*object.Function); ok {
+					env.Calls().Pop()
+					fn, args = tailCall.Fn, tailCall.Args
+					continue
+				}
+				// anything else is called from this function's frame,
+				// which its errors then pass through
+				evaluated = callAt(tailCall.Pos, tailCall.Fn, tailCall.Args, env)
+			}
+
+			env.Calls().Pop()
+			return evaluated
+		case *object.Builtin:
+			result := function.Call(args...)
+			if err, ok := result.(*object.Error); ok {
+				frame := object.StackFrame{Function: function.Name, Builtin: true}
+				err.Stack = append(err.Stack, frame.String())
+				return err
+			}
+			if err := env.Budget().AllocateResult(result); err != nil {
+				return haltError(err)
+			}
+			if result != nil {
+				return result
+			}
+			return NULL
+		default:
+			return newError("not a function: %s", fn.Type())
+		}
+	}
+}
+
+func functionName(fn *object.Function) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
+
+// evalFunctionBody evaluates a function body, or a branch of an if in tail
+// position of one, leaving a call in tail position to evalFunctionCall.
+func evalFunctionBody(block *ast.BlockStatement, env *object.Environment) object.Object {
+	if len(block.Statements) == 0 {
+		return nil
+	}
+
+	last := len(block.Statements) - 1
+	for _, stmt := range block.Statements[:last] {
+		result := Eval(stmt, env)
+		if exitsBlock(result) {
+			return result
+		}
+	}
+
+	stmt, ok := block.Statements[last].(*ast.ExpressionStatement)
+	if !ok {
+		return Eval(block.Statements[last], env)
+	}
+
+	switch expr := stmt.Expression.(type) {
+	case *ast.CallExpression:
+		return evalTailCall(expr, env)
+	case *ast.IfExpression:
+		branch, err := selectBranch(expr, env)
+		if err != nil {
+			return err
+		}
+		if branch == nil {
+			return NULL
+		}
+		if result := evalFunctionBody(branch, env); result != nil {
 			return result
 		}
 		return NULL
 	default:
-		return newError("not a function: %s", fn.Type())
+		return Eval(expr, env)
 	}
 }
 
+// evalTailCall evaluates the callee and arguments of a call in tail
+// position and returns them as a *object.TailCall for evalFunctionCall.
+func evalTailCall(node *ast.CallExpression, env *object.Environment) object.Object {
+	function := Eval(node.Function, env)
+	if isError(function) {
+		return function
+	}
+	args := evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
+	}
+	return &object.TailCall{Fn: function, Args: args, Pos: node.Pos()}
+}
+
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
@@ -220,7 +534,7 @@ func evalIdentifier(ident *ast.Identifier, env *object.Environment) object.Objec
 		return val
 	}
 
-	if builtin, ok := builtins[ident.Value]; ok {
+	if builtin, ok := env.Config().BuiltinSet().Lookup(ident.Value); ok {
 		return builtin
 	}
 
@@ -233,31 +547,160 @@ func evalBlockStatements(statements []ast.Statement, env *object.Environment) ob
 	for _, stmt := range statements {
 		result = Eval(stmt, env)
 
-		if result != nil {
-			if result.Type() == object.RETURN_VALUE || result.Type() == object.ERROR {
-				return result
-			}
+		if exitsBlock(result) {
+			return result
 		}
 	}
 
 	return result
 }
 
+// exitsBlock reports whether a statement result ends the enclosing block.
+func exitsBlock(result object.Object) bool {
+	if result == nil {
+		return false
+	}
+
+	switch result.Type() {
+	case object.RETURN_VALUE, object.ERROR, object.BREAK, object.CONTINUE:
+		return true
+	default:
+		return false
+	}
+}
+
+// evalTryStatement runs the try block, hands an error raised in it to the
+// catch block and runs the finally block however the statement is left. A
+// return, break, continue or error in the finally block replaces the result
+// of the others.
+func evalTryStatement(node *ast.TryStatement, env *object.Environment) object.Object {
+	result := resolveTailCall(Eval(node.Block, env), env)
+
+	if err, ok := result.(*object.Error); ok && err.Cause == nil && node.Catch != nil {
+		env.Set(node.Param.Value, err.Caught())
+		result = resolveTailCall(Eval(node.Catch, env), env)
+	}
+
+	if node.Finally != nil {
+		if finally := Eval(node.Finally, env); exitsBlock(finally) {
+			return finally
+		}
+	}
+
+	if exitsBlock(result) {
+		return result
+	}
+	return NULL
+}
+
+// resolveTailCall makes a tail call returned from inside a try statement,
+// whose errors the statement must still see.
+func resolveTailCall(obj object.Object, env *object.Environment) object.Object {
+	returnValue, ok := obj.(*object.ReturnValue)
+	if !ok {
+		return obj
+	}
+
+	tailCall, ok := returnValue.Value.(*object.TailCall)
+	if !ok {
+		return obj
+	}
+
+	result := callAt(tailCall.Pos, tailCall.Fn, tailCall.Args, env)
+	if isError(result) {
+		return result
+	}
+	return &object.ReturnValue{Value: result}
+}
+
+func evalWhileStatement(node *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return NULL
+		}
+
+		result := Eval(node.Body, env)
+		if result, done := loopResult(result); done {
+			return result
+		}
+	}
+}
+
+func evalForStatement(node *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := Eval(node.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	iterator, ok := object.NewIterator(iterable)
+	if !ok {
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	for item, ok := iterator.Next(); ok; item, ok = iterator.Next() {
+		env.Set(node.Variable.Value, item)
+
+		result := Eval(node.Body, env)
+		if result, done := loopResult(result); done {
+			return result
+		}
+	}
+
+	return NULL
+}
+
+// loopResult reports whether the result of a loop body ends the loop, and
+// what the loop then evaluates to: NULL on break, or the return value or
+// error that propagates further.
+func loopResult(result object.Object) (object.Object, bool) {
+	if result == nil {
+		return nil, false
+	}
+
+	switch result.Type() {
+	case object.BREAK:
+		return NULL, true
+	case object.RETURN_VALUE, object.ERROR:
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
 func evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(node.Condition, env)
+	branch, err := selectBranch(node, env)
+	if err != nil {
+		return err
+	}
 
-	if isError(condition) {
-		return condition
+	var result object.Object
+	if branch != nil {
+		result = Eval(branch, env)
 	}
 
-	if isTruthy(condition) {
-		return Eval(node.Consequence, env)
-	} else if node.Alternative != nil {
-		return Eval(node.Alternative, env)
-	} else {
+	// a branch that is empty or ends in a statement has no value
+	if result == nil {
 		return NULL
 	}
+	return result
+}
+
+// selectBranch evaluates the condition of an if and returns the branch to
+// take, nil when there is none.
+func selectBranch(node *ast.IfExpression, env *object.Environment) (*ast.BlockStatement, object.Object) {
+	condition := Eval(node.Condition, env)
+	if isError(condition) {
+		return nil, condition
+	}
 
+	if isTruthy(condition) {
+		return node.Consequence, nil
+	}
+	return node.Alternative, nil
 }
 
 func isTruthy(condition object.Object) bool {
@@ -273,12 +716,16 @@ func isTruthy(condition object.Object) bool {
 	}
 }
 
-func evalInfixExpression(operator string, left, right object.Object) object.Object {
+func evalInfixExpression(operator string, left, right object.Object, env *object.Environment) object.Object {
 	switch {
 	case left.Type() == object.INTEGER && right.Type() == object.INTEGER:
-		return evaluateIntegerInfixExpression(operator, left, right)
+		return evaluateIntegerInfixExpression(operator, left, right, env)
+	case object.IsInteger(left) && object.IsInteger(right):
+		return evalBigIntInfixExpression(operator, left, right, env)
+	case isNumber(left) && isNumber(right):
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.STRING && right.Type() == object.STRING:
-		return evalStringInfixExpression(operator, left, right)
+		return allocateString(env, evalStringInfixExpression(operator, left, right))
 	case operator == "==":
 		return nativeBoolToBooleanObject(left == right)
 	case operator == "!=":
@@ -292,35 +739,252 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
-func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
-	if operator != "+" {
-		return newError("unknown operator: %s %s %s",
-			left.Type(), operator, right.Type())
+// evalLogicalExpression evaluates && and ||, skipping the right operand when
+// the left one decides the result. Both produce a boolean.
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
 	}
 
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
+// allocateString counts the result of a string operation if it is a new
+// string.
+func allocateString(env *object.Environment, result object.Object) object.Object {
+	if s, ok := result.(*object.String); ok {
+		return allocate(env, s)
+	}
+	return result
+}
+
+func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return &object.String{Value: leftVal + rightVal}
+
+	switch operator {
+	case "+":
+		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
 }
 
-func evaluateIntegerInfixExpression(operator string, left, right object.Object) object.Object {
+func evaluateIntegerInfixExpression(operator string, left, right object.Object, env *object.Environment) object.Object {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
 
+	switch operator {
+	case "+", "-", "*", "/", "%", "**", "<<":
+		var result int64
+		var overflow bool
+
+		switch operator {
+		case "+":
+			result, overflow = object.AddInt64(leftVal, rightVal)
+		case "-":
+			result, overflow = object.SubInt64(leftVal, rightVal)
+		case "*":
+			result, overflow = object.MulInt64(leftVal, rightVal)
+		case "/":
+			if rightVal == 0 {
+				return newError("division by zero")
+			}
+			result, overflow = object.DivInt64(leftVal, rightVal)
+		case "%":
+			if rightVal == 0 {
+				return newError("division by zero")
+			}
+			result = leftVal % rightVal
+		case "**":
+			if rightVal < 0 {
+				return evalFloatInfixExpression(operator, left, right)
+			}
+			result, overflow = object.PowInt64(leftVal, rightVal)
+		case "<<":
+			if rightVal < 0 {
+				return newError("negative shift count: %d", rightVal)
+			}
+			result, overflow = object.ShlInt64(leftVal, rightVal)
+		}
+
+		if overflow {
+			if env.Config().CheckedArithmetic {
+				return newError("integer overflow: %d %s %d", leftVal, operator, rightVal)
+			}
+			return evalBigIntInfixExpression(operator, left, right, env)
+		}
+		return &object.Integer{Value: result}
+
+	case "&":
+		return &object.Integer{Value: leftVal & rightVal}
+	case "|":
+		return &object.Integer{Value: leftVal | rightVal}
+	case "^":
+		return &object.Integer{Value: leftVal ^ rightVal}
+	case ">>":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal >> uint64(rightVal)}
+
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+// evalBigIntInfixExpression handles integers that overflowed int64 or
+// already are BigInts. Results that fit in int64 are demoted to Integer.
+func evalBigIntInfixExpression(operator string, left, right object.Object, env *object.Environment) object.Object {
+	leftVal, _ := object.BigValue(left)
+	rightVal, _ := object.BigValue(right)
+
+	result := new(big.Int)
+
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return allocateInteger(env, result.Add(leftVal, rightVal))
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return allocateInteger(env, result.Sub(leftVal, rightVal))
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return allocateInteger(env, result.Mul(leftVal, rightVal))
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal.Sign() == 0 {
+			return newError("division by zero")
+		}
+		return allocateInteger(env, result.Quo(leftVal, rightVal))
+	case "%":
+		if rightVal.Sign() == 0 {
+			return newError("division by zero")
+		}
+		return allocateInteger(env, result.Rem(leftVal, rightVal))
+	case "**":
+		if rightVal.Sign() < 0 {
+			return evalFloatInfixExpression(operator, left, right)
+		}
+		bits := int64(math.MaxInt64)
+		if rightVal.IsInt64() {
+			bits = object.PowBits(leftVal, rightVal.Int64())
+		}
+		if bits > object.MaxIntegerBits {
+			return newError("exponent too large: %s", rightVal)
+		}
+		if err := env.Budget().CheckIntegerBits(bits); err != nil {
+			return haltError(err)
+		}
+		return allocateInteger(env, result.Exp(leftVal, rightVal, nil))
+	case "&":
+		return allocateInteger(env, result.And(leftVal, rightVal))
+	case "|":
+		return allocateInteger(env, result.Or(leftVal, rightVal))
+	case "^":
+		return allocateInteger(env, result.Xor(leftVal, rightVal))
+	case "<<", ">>":
+		if rightVal.Sign() < 0 {
+			return newError("negative shift count: %s", rightVal)
+		}
+		if !rightVal.IsInt64() {
+			return newError("shift count too large: %s", rightVal)
+		}
+		if operator == ">>" {
+			return allocateInteger(env, result.Rsh(leftVal, uint(rightVal.Int64())))
+		}
+		bits := object.ShlBits(leftVal, rightVal.Int64())
+		if bits > object.MaxIntegerBits {
+			return newError("shift count too large: %s", rightVal)
+		}
+		if err := env.Budget().CheckIntegerBits(bits); err != nil {
+			return haltError(err)
+		}
+		return allocateInteger(env, result.Lsh(leftVal, uint(rightVal.Int64())))
+
+	case "<":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) < 0)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) > 0)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) <= 0)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) >= 0)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) != 0)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+// allocateInteger counts result against the allocation limits of env if
+// it does not fit in int64.
+func allocateInteger(env *object.Environment, result *big.Int) object.Object {
+	integer := object.NewInteger(result)
+	if _, ok := integer.(*object.BigInt); ok {
+		return allocate(env, integer)
+	}
+	return integer
+}
+
+// evalFloatInfixExpression handles two floats as well as a float mixed with
+// an integer, which is converted to float first.
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
 
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -331,24 +995,65 @@ func evaluateIntegerInfixExpression(operator string, left, right object.Object)
 	}
 }
 
-func evalPrefixExpression(operator string, right object.Object) object.Object {
+func isNumber(obj object.Object) bool {
+	return object.IsInteger(obj) || obj.Type() == object.FLOAT
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
+func evalPrefixExpression(operator string, right object.Object, env *object.Environment) object.Object {
 	switch operator {
 	case "!":
 		return evalBangOperatorExpression(right)
 	case "-":
-		return evaluateNegateExpression(right)
+		return evaluateNegateExpression(right, env.Config())
+	case "~":
+		return evalBitNotExpression(right)
 	default:
 		return newError("unknown operator: %s%s", operator, right.Type())
 	}
 }
 
-func evaluateNegateExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER {
+func evaluateNegateExpression(right object.Object, config *object.Config) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		if right.Value == math.MinInt64 {
+			if config.CheckedArithmetic {
+				return newError("integer overflow: -(%d)", right.Value)
+			}
+			return object.NewInteger(new(big.Int).Neg(big.NewInt(right.Value)))
+		}
+		return &object.Integer{Value: -right.Value}
+	case *object.BigInt:
+		return object.NewInteger(new(big.Int).Neg(right.Value))
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
+}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+func evalBitNotExpression(right object.Object) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: ^right.Value}
+	case *object.BigInt:
+		return object.NewInteger(new(big.Int).Not(right.Value))
+	default:
+		return newError("unknown operator: ~%s", right.Type())
+	}
 }
 
 func evalBangOperatorExpression(right object.Object) object.Object {
@@ -380,22 +1085,49 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
+			if tailCall, ok := result.Value.(*object.TailCall); ok {
+				return callAt(tailCall.Pos, tailCall.Fn, tailCall.Args, env)
+			}
 			return result.Value
 		case *object.Error:
 			return result
+		case *object.Break, *object.Continue:
+			return strayLoopControl(result)
 		}
 	}
 
 	return result
 }
 
+// strayLoopControl turns a break or continue that escaped to a function or
+// program body into an error.
+func strayLoopControl(obj object.Object) *object.Error {
+	switch obj.(type) {
+	case *object.Break:
+		return newError("break outside loop")
+	case *object.Continue:
+		return newError("continue outside loop")
+	default:
+		return nil
+	}
+}
+
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// isError reports whether obj ends the evaluation of the expression that
+// produced it: an error, or a break or continue from an if inside it, which
+// must reach its loop rather than become a value.
 func isError(obj object.Object) bool {
-	if obj != nil {
-		return obj.Type() == object.ERROR
+	if obj == nil {
+		return false
+	}
+
+	switch obj.Type() {
+	case object.ERROR, object.BREAK, object.CONTINUE:
+		return true
+	default:
+		return false
 	}
-	return false
 }
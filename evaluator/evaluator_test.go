@@ -1,10 +1,15 @@
 package evaluator
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"github.com/mehrankamal/monkey/lexer"
 	"github.com/mehrankamal/monkey/object"
 	"github.com/mehrankamal/monkey/parser"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -39,6 +44,116 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"1.5", 1.5},
+		{"-1.5", -1.5},
+		{"1.5 + 2.25", 3.75},
+		{"1 + 0.5", 1.5},
+		{"3.0 - 4", -1.0},
+		{"2 * 1.25", 2.5},
+		{"1 / 4.0", 0.25},
+		{"2.5e2", 250.0},
+		{"1.5 > 1", true},
+		{"1 < 1.5", true},
+		{"2 == 2.0", true},
+		{"2.5 != 2.5", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case float64:
+			assertFloatObject(t, evaluated, expected)
+		case bool:
+			assertBooleanObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestModulo(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7 % -3", 1},
+		{"10 + 7 % 3 * 2", 12},
+		{"7.5 % 2", 1.5},
+		{"(9223372036854775807 + 1) % 10", 8},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			assertFloatObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestPowerAndBitwiseOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"(-2) ** 3", -8},
+		{"2 ** -1", 0.5},
+		{"2.5 ** 2", 6.25},
+		{"4 ** 0.5", 2.0},
+		{"2 ** 64", "18446744073709551616"},
+		{"6 & 3", 2},
+		{"6 | 3", 7},
+		{"6 ^ 3", 5},
+		{"~5", -6},
+		{"~-1", 0},
+		{"1 << 10", 1024},
+		{"-1024 >> 3", -128},
+		{"1 >> 64", 0},
+		{"-1 >> 100", -1},
+		{"1 << 63", "9223372036854775808"},
+		{"(1 << 64) >> 60", 16},
+		{"(1 << 64) | 1", "18446744073709551617"},
+		{"~(1 << 64)", "-18446744073709551617"},
+		{"1 | 2 ^ 6 & 3", 1},
+		{"1 + 1 << 2", 8},
+		{"5 & 4 == 4", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			assertFloatObject(t, evaluated, expected)
+		case bool:
+			assertBooleanObject(t, evaluated, expected)
+		case string:
+			bigInt, ok := evaluated.(*object.BigInt)
+			if !ok {
+				t.Errorf("object is not BigInt for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if bigInt.Inspect() != expected {
+				t.Errorf("wrong BigInt for %q. want=%s, got=%s", tt.input, expected, bigInt.Inspect())
+			}
+		}
+	}
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -63,6 +178,24 @@ func TestBooleanExpressions(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"1.5 >= 1", true},
+		{"1 <= 0.5", false},
+		{"9223372036854775807 + 1 >= 9223372036854775807", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && \"a\"", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"false && (1 / 0 == 1)", false},
+		{"true || (1 / 0 == 1)", true},
 	}
 
 	for _, tc := range tests {
@@ -185,6 +318,21 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{"x = 1", "identifier not found: x"},
+		{"len = 1", "cannot assign to len"},
+		{"let a = [1]; a[1] = 2", "index out of range: 1 (length 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of range: -1 (length 1)"},
+		{`let a = [1]; a["x"] = 2`, "array index must be INTEGER, got STRING"},
+		{"let h = {}; h[fn() {}] = 2", "unusable as hash key: FUNCTION"},
+		{`let s = "abc"; s[0] = 2`, "index assignment not supported: STRING"},
+		{"for (x in 5) { }", "cannot iterate over INTEGER"},
+		{"break;", "break outside loop"},
+		{"let f = fn() { continue; }; while (true) { f(); }", "continue outside loop"},
+		{"fn(a) { a }(1, 2)", "wrong number of arguments: want=1, got=2"},
+		{"fn(a, b) { a }(1)", "wrong number of arguments: want=2, got=1"},
+		{`throw "boom"`, "uncaught exception: boom"},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1"},
+		{`try { 1 + "a" } catch (e) { throw e }`, "type mismatch: INTEGER + STRING"},
 	}
 
 	for _, tt := range tests {
@@ -202,6 +350,158 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestTryStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let r = 0; try { throw 5 } catch (e) { r = e }; r`, 5},
+		{`let r = 0; try { r = 1 } catch (e) { r = 2 }; r`, 1},
+		{`let x = 0; try { x = 1; throw 2; x = 3 } catch (e) { x += e * 10 } finally { x += 100 }; x`, 121},
+		{`let r = ""; try { [1][true] } catch (e) { r = e["message"] }; r`, "index operator not supported: ARRAY"},
+		{`let r = ""; let f = fn(a) { a }; try { f(1, 2) } catch (e) { r = e["message"] }; r`, "wrong number of arguments: want=1, got=2"},
+		{`let r = ""; try { 1 + "a" } catch (e) { r = e["nothing"] }; r`, nil},
+		{`1 + if (true) { try { throw 1 } catch (e) { }; 2 } + 3`, 6},
+		{`let f = fn(n) { if (n == 0) { throw "bottom" } 1 + f(n - 1) }; let r = ""; try { f(50) } catch (e) { r = e }; r`, "bottom"},
+		{`let f = fn(n) { if (n == 0) { throw "bottom" } f(n - 1) }; let r = ""; try { f(50) } catch (e) { r = e }; r`, "bottom"},
+		{`let f = fn() { try { throw "a" } catch (e) { throw e + "b" } }; let r = ""; try { f() } catch (e) { r = e }; r`, "ab"},
+		{`let r = 0; try { try { throw 1 } finally { r = 10 } } catch (e) { r += e }; r`, 11},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, 2},
+		{`let r = 0; let f = fn() { try { r = 1; return 5 } finally { r = 2 } }; f() + r`, 7},
+		{`let g = fn() { throw "late" }; let f = fn() { try { return g() } catch (e) { return e } }; f()`, "late"},
+		{`let f = fn() { try { 1 } catch (e) { 2 } }; f()`, nil},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue } n += x } finally { n += 10 } }; n`, 34},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { break } n += x } finally { n += 10 } }; n`, 21},
+		{`let k = 0; while (k < 3) { try { k += 1; if (k == 2) { throw k } } catch (e) { k += 10 } }; k`, 12},
+		{`let g = fn() { 1 + "a" }; let f = fn() { let r = g(); r }; let s = []; try { f() } catch (e) { s = e["stack"] }; len(s)`, 3},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong String for %q. want=%q, got=%q", tt.input, expected, str.Value)
+			}
+		default:
+			assertNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		checked         bool
+		expectedMessage string
+	}{
+		{"1 / 0", false, "division by zero"},
+		{"1 % 0", false, "division by zero"},
+		{"let f = fn(x) { 10 / x }; f(0)", false, "division by zero"},
+		{"9223372036854775807 + 1", true, "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", true, "integer overflow: -9223372036854775807 - 2"},
+		{"let f = fn(x) { x * x }; f(4294967296)", true, "integer overflow: 4294967296 * 4294967296"},
+		{"2 ** 63", true, "integer overflow: 2 ** 63"},
+		{"1 << 63", true, "integer overflow: 1 << 63"},
+		{"1 << -1", false, "negative shift count: -1"},
+		{"1 >> -1", false, "negative shift count: -1"},
+		{"(1 << 64) << -1", false, "negative shift count: -1"},
+		{"1 << (1 << 64)", false, "shift count too large: 18446744073709551616"},
+		{"2 ** (1 << 64)", false, "exponent too large: 18446744073709551616"},
+		{"1 << 9000000000000000000", false, "shift count too large: 9000000000000000000"},
+		{"(1 << 64) << 1048576", false, "shift count too large: 1048576"},
+		{"2 ** 9000000000000000000", false, "exponent too large: 9000000000000000000"},
+		{"3 ** 2000000", false, "exponent too large: 2000000"},
+		{"1.5 & 1", false, "unknown operator: FLOAT & INTEGER"},
+		{"~1.5", false, "unknown operator: ~FLOAT"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+		env.Config().CheckedArithmetic = tt.checked
+
+		evaluated := Eval(program, env)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. got=%T(%+v)",
+				tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expectedMessage {
+			t.Errorf("wrong error message. expected=%q, got=%q",
+				tt.expectedMessage, errObj.Message)
+		}
+	}
+}
+
+func TestBigIntPromotion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"-9223372036854775807 - 2", "-9223372036854775809"},
+		{"4294967296 * 4294967296", "18446744073709551616"},
+		{"let big = 9223372036854775807 * 4; big / 4", 9223372036854775807},
+		{"let big = 9223372036854775807 + 1; big - 1", 9223372036854775807},
+		{"let big = 9223372036854775807 * 3; big * big", "765635325572111542626572170058092511241"},
+		{"-(-9223372036854775807 - 1)", "9223372036854775808"},
+		{"let big = 9223372036854775807 + 1; -big", -9223372036854775808},
+		{"(-9223372036854775807 - 1) / -1", "9223372036854775808"},
+		{"9223372036854775807 + 1 > 9223372036854775807", true},
+		{"9223372036854775807 + 1 == 9223372036854775807 * 2 / 2 + 1", true},
+		{"(9223372036854775807 + 1) * 2 / 2 == 9223372036854775807 + 1", true},
+		{"9223372036854775807 + 1 != 5", true},
+		{"(9223372036854775807 + 1) * 1.0", 9223372036854775808.0},
+		{"let h = {9223372036854775807 + 1: \"big\"}; h[9223372036854775807 * 2 / 2 + 1]", "big"},
+		{"(9223372036854775807 + 1) / 0", "division by zero"},
+		{"99999999999999999999", "99999999999999999999"},
+		{"0x1_0000_0000_0000_0000 - 1", "18446744073709551615"},
+		{"-9223372036854775808", -9223372036854775808},
+		{"9223372036854775808 - 1", 9223372036854775807},
+		{"9223372036854775808 == 9223372036854775807 + 1", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			assertFloatObject(t, evaluated, expected)
+		case bool:
+			assertBooleanObject(t, evaluated, expected)
+		case string:
+			switch evaluated := evaluated.(type) {
+			case *object.BigInt:
+				if evaluated.Inspect() != expected {
+					t.Errorf("wrong BigInt for %q. want=%s, got=%s", tt.input, expected, evaluated.Inspect())
+				}
+			case *object.String:
+				if evaluated.Value != expected {
+					t.Errorf("wrong String for %q. want=%q, got=%q", tt.input, expected, evaluated.Value)
+				}
+			case *object.Error:
+				if evaluated.Message != expected {
+					t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, expected, evaluated.Message)
+				}
+			default:
+				t.Errorf("unexpected object for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+			}
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -218,6 +518,156 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x %= 4", 2},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"let f = fn(a) { a += 1; a * 2 }; f(1)", 4},
+		{"let f = fn() { let sum = 0; sum = sum + 10; sum }; f()", 10},
+		{"let f = fn() { let x = 1; let g = fn() { x += 1; x }; g() + g() }; f()", 5},
+		{"let a = [1, 2, 3]; a[1] = 20; a", []int64{1, 20, 3}},
+		{"let a = [1, 2, 3]; a[2] += 10", 13},
+		{"let a = [1, 2, 3]; let b = a; b[0] = 7; a[0]", 7},
+		{"let a = [[1], [2]]; a[1][0] *= 5; a[1][0]", 10},
+		{`let h = {"k": 1}; h["k"] += 1; h["k"]`, 2},
+		{`let h = {}; h["new"] = 5; h["new"]`, 5},
+		{"let i = 0; let a = [0, 0]; a[i = 1] = 9; a", []int64{0, 9}},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case []int64:
+			assertIntArrayObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestMutableClosures(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{`
+				let newCounter = fn() {
+					let count = 0;
+					fn() { count += 1 };
+				};
+				let counter = newCounter();
+				counter();
+				counter();
+				counter();`, 3},
+		{`
+				let pair = fn() {
+					let count = 0;
+					let inc = fn() { count += 1 };
+					let get = fn() { count };
+					[inc, get];
+				};
+				let p = pair();
+				p[0]();
+				p[0]();
+				p[1]();`, 2},
+		{`
+				let f = fn() {
+					let x = 1;
+					let set = fn(v) { x = v };
+					set(5);
+					x;
+				};
+				f();`, 5},
+		{`
+				let f = fn() {
+					let x = 1;
+					let get = fn() { x };
+					x = 10;
+					get();
+				};
+				f();`, 10},
+		{`
+				let f = fn(a) {
+					fn() {
+						fn() { a *= 2 };
+					};
+				};
+				let middle = f(3);
+				let double = middle();
+				double();
+				let again = middle();
+				again();`, 12},
+		{`
+				let make = fn(start) {
+					let count = start;
+					fn() { count += 1 };
+				};
+				let a = make(0);
+				let b = make(100);
+				a();
+				b();
+				a() + b();`, 104},
+	}
+
+	for _, tt := range tests {
+		assertIntegerObject(t, evalInput(tt.input), tt.expected)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let i = 0; let sum = 0; while (i < 5) { sum += i; i += 1; } sum", 10},
+		{"let i = 0; while (false) { i = 1; } i", 0},
+		{"let i = 0; while (true) { i += 1; if (i == 7) { break; } } i", 7},
+		{"let i = 0; let odd = 0; while (i < 10) { i += 1; if (i % 2 == 0) { continue; } odd += 1; } odd", 5},
+		{"let sum = 0; for (x in [1, 2, 3, 4]) { sum += x; } sum", 10},
+		{`let s = ""; for (c in "abc") { s = c + s; } s`, "cba"},
+		{`let keys = ""; for (k in {"b": 2, "a": 1, "c": 3}) { keys += k; } keys`, "abc"},
+		{`let total = 0; let h = {"x": 1, "y": 2}; for (k in h) { total += h[k]; } total`, 3},
+		{"let sum = 0; for (x in [1, 2, 3, 4, 5]) { if (x == 2) { continue; } if (x == 4) { break; } sum += x; } sum", 4},
+		{"let sum = 0; for (x in []) { sum += 1; } sum", 0},
+		{"let n = 0; for (a in [1, 2, 3]) { for (b in [1, 2, 3]) { if (b > a) { break; } n += 1; } } n", 6},
+		{"let f = fn(arr) { let sum = 0; for (x in arr) { sum += x; } sum }; f([10, 20]) + f([1])", 31},
+		{"let find = fn(arr, v) { let i = 0; for (x in arr) { if (x == v) { return i; } i += 1; } -1 }; find([5, 6, 7], 7)", 2},
+		{"let f = fn() { let i = 0; while (true) { i += 1; if (i > 3) { return i; } } }; f()", 4},
+		{"let f = fn() { while (false) { } }; f()", nil},
+		{"let i = 0; while (i < 100000) { i += 1; } i", 100000},
+		{"let fs = []; for (x in [1, 2, 3]) { fs = push(fs, fn() { x }); } fs[0]() + fs[2]()", 6},
+		{"let x = if (true) { let y = 1; }; x", nil},
+		{"let n = 0; while (n < 5) { n += 1; [if (n > 2) { break }] } n", 3},
+		{"let s = 0; for (x in [1, 2, 3]) { s += if (x == 2) { continue } else { x } } s", 4},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong String for %q. want=%q, got=%q", tt.input, expected, str.Value)
+			}
+		default:
+			assertNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestFunctionEvaluation(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 	evaluated := evalInput(input)
@@ -259,6 +709,57 @@ func TestFunctionCallsEvaluation(t *testing.T) {
 	}
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(100000)", 0},
+		{"let countDown = fn(x) { if (x == 0) { return 0; } return countDown(x - 1); }; countDown(100000)", 0},
+		{`let isEven = fn(n, isOdd) { if (n == 0) { true } else { isOdd(n - 1, isEven) } };
+		  let isOdd = fn(n, isEven) { if (n == 0) { false } else { isEven(n - 1, isOdd) } };
+		  isEven(100001, isOdd)`, false},
+		{"let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } }; loop(100000, 0)", 5000050000},
+		{"let f = fn(n) { if (n > 0) { f(n - 1) } }; f(3)", nil},
+		{"let size = fn(a) { len(a) }; size([1, 2, 3])", 3},
+		{"let f = fn(x) { x * 2 }; return f(21);", 42},
+		{"let f = fn(x) { if (x == 0) { return 0; } f(x - 1) + 1 }; f(100)", 100},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			assertIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			assertBooleanObject(t, evaluated, expected)
+		default:
+			assertNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestTailCallsOverLargeArray(t *testing.T) {
+	elements := make([]object.Object, 100000)
+	for i := range elements {
+		elements[i] = &object.Integer{Value: int64(i)}
+	}
+
+	input := `
+		let sum = fn(i, acc) {
+			if (i == len(arr)) { return acc; }
+			sum(i + 1, acc + arr[i])
+		};
+		sum(0, 0);`
+
+	env := object.NewEnvironment()
+	env.Set("arr", &object.Array{Elements: elements})
+
+	program := parser.New(lexer.New(input)).ParseProgram()
+	assertIntegerObject(t, Eval(program, env), 4999950000)
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World!"`
 	evaluated := evalInput(input)
@@ -285,6 +786,23 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestStringComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`"mon" + "key" == "monkey"`, true},
+		{`"monkey" == "banana"`, false},
+		{`"monkey" != "banana"`, true},
+		{`"monkey" != "monkey"`, false},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+		assertBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -338,6 +856,70 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestBuiltinErrorStack(t *testing.T) {
+	evaluated := evalInput("let f = fn(x) { len(x) }; f(1)")
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expected := []string{"len (builtin)", "f (line 1)", "<main> (line 1)"}
+	if strings.Join(errObj.Stack, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong stack. want=%v, got=%v", expected, errObj.Stack)
+	}
+}
+
+func TestBuiltinPanics(t *testing.T) {
+	boom := &object.Builtin{Name: "boom", Fn: func(args ...object.Object) object.Object {
+		return args[5]
+	}}
+	env := object.NewEnvironment()
+	env.Config().Builtins = append(object.PureBuiltins(), object.BuiltinDefinition{Name: "boom", Builtin: boom})
+
+	program := parser.New(lexer.New("let f = fn() { boom(1) }; f()")).ParseProgram()
+	errObj, ok := Eval(program, env).(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error from boom")
+	}
+
+	if errObj.Message != "boom panicked: runtime error: index out of range [5] with length 1" {
+		t.Errorf("wrong error message. got=%q", errObj.Message)
+	}
+	expected := []string{"boom (builtin)", "f (line 1)", "<main> (line 1)"}
+	if strings.Join(errObj.Stack, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong stack. want=%v, got=%v", expected, errObj.Stack)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 + true;", "1:3"},
+		{"let f = fn(x) {\n  x / 0\n};\nf(1)", "2:5"},
+		{"let x = 1;\nlen(x)", "2:4"},
+		{"if (true) {\n  throw 1;\n}", "2:3"},
+		{"let e = 0; try { 1 / 0 } catch (caught) { e = caught }; throw e", "1:57"},
+	}
+
+	for _, tt := range tests {
+		evaluated := evalInput(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Pos.String() != tt.expected {
+			t.Errorf("wrong error position for %q. want=%s, got=%s",
+				tt.input, tt.expected, errObj.Pos)
+		}
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 	evaluated := evalInput(input)
@@ -550,6 +1132,22 @@ func assertIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func assertFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+
+	if result.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func assertIntArrayObject(t *testing.T, evaluated object.Object, expected []int64) {
 	arr, ok := evaluated.(*object.Array)
 	if !ok {
@@ -564,3 +1162,153 @@ func assertIntArrayObject(t *testing.T, evaluated object.Object, expected []int6
 		assertIntegerObject(t, arr.Elements[idx], elem)
 	}
 }
+
+func TestInstructionLimit(t *testing.T) {
+	tests := []struct {
+		input           string
+		maxInstructions int64
+		stopped         bool
+	}{
+		{"1 + 2", 100, false},
+		{"while (true) { }", 1000, true},
+		{"let f = fn() { f() }; f()", 1000, true},
+		{"let n = 0; try { while (true) { n += 1 } } catch (e) { n = -1 } finally { n = -2 }", 1000, true},
+		{"let n = 0; while (n < 100) { n += 1 }; n", 0, false},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+		env.Config().MaxInstructions = tt.maxInstructions
+
+		result := Eval(program, env)
+		err, isError := result.(*object.Error)
+
+		if !tt.stopped {
+			if isError {
+				t.Errorf("error for %q: %s", tt.input, err.Message)
+			}
+			continue
+		}
+
+		if !isError || !errors.Is(err.Cause, object.ErrInstructionLimit) {
+			t.Errorf("expected the instruction limit to stop %q, got %s", tt.input, result.Inspect())
+			continue
+		}
+		if err.Message != "instruction limit exceeded" {
+			t.Errorf("wrong error message. got=%q", err.Message)
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	program := parser.New(lexer.New("try { while (true) { } } catch (e) { }")).ParseProgram()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+
+	tests := []struct {
+		ctx   context.Context
+		cause error
+	}{
+		{cancelled, context.Canceled},
+		{timeout, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		env := object.NewEnvironment()
+
+		result := EvalContext(tt.ctx, program, env)
+		err, ok := result.(*object.Error)
+		if !ok || !errors.Is(err.Cause, tt.cause) {
+			t.Errorf("wrong result. want cause %v, got=%s", tt.cause, result.Inspect())
+		}
+
+		// the environment is usable again once EvalContext returns
+		result = Eval(parser.New(lexer.New("1")).ParseProgram(), env)
+		if isError(result) {
+			t.Errorf("error after EvalContext: %s", result.Inspect())
+		}
+	}
+}
+
+func TestAllocationLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   object.Config
+		expected string
+	}{
+		{"push([1, 2], 3)", object.Config{MaxArrayLength: 3}, ""},
+		{"[1, 2, 3, 4]", object.Config{MaxArrayLength: 3}, "allocation limit exceeded: array of 4 elements, limit 3"},
+		{"let a = []; while (true) { a = push(a, 1) }", object.Config{MaxArrayLength: 3},
+			"allocation limit exceeded: array of 4 elements, limit 3"},
+		{`let s = "ab"; while (true) { s = s + s }`, object.Config{MaxStringLength: 8},
+			"allocation limit exceeded: string of 16 bytes, limit 8"},
+		{"{1: 1, 2: 2, 3: 3}", object.Config{MaxHashSize: 2}, "allocation limit exceeded: hash of 3 pairs, limit 2"},
+		{"let h = {}; h[1] = 1; h[1] = 2; h[2] = 2; h[3] = 3", object.Config{MaxHashSize: 2},
+			"allocation limit exceeded: hash of 3 pairs, limit 2"},
+		{"let n = 0; while (true) { let a = [n]; n += 1 }", object.Config{MaxAllocations: 10},
+			"allocation limit exceeded: more than 10 allocations"},
+		{"let f = fn() { fn() { 1 } }; while (true) { f() }", object.Config{MaxAllocations: 5},
+			"allocation limit exceeded: more than 5 allocations"},
+		{"let a = []; try { while (true) { a = push(a, 1) } } catch (e) { 0 }", object.Config{MaxArrayLength: 100},
+			"allocation limit exceeded: array of 101 elements, limit 100"},
+		{"let x = 1 << 100; while (true) { x = x * x }", object.Config{MaxStringLength: 100},
+			"allocation limit exceeded: integer of 104 bytes, limit 100"},
+		{"7 ** 1000", object.Config{MaxStringLength: 100}, "allocation limit exceeded: integer of 256 bytes, limit 100"},
+		{"try { 1 << 1000 } catch (e) { 0 }", object.Config{MaxStringLength: 100},
+			"allocation limit exceeded: integer of 128 bytes, limit 100"},
+		{"let n = 1 << 64; while (true) { n += 1 }", object.Config{MaxAllocations: 10},
+			"allocation limit exceeded: more than 10 allocations"},
+		{"(1 << 64) * 3", object.Config{MaxStringLength: 100, MaxAllocations: 10}, ""},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+		*env.Config() = tt.config
+
+		result := Eval(program, env)
+		err, isError := result.(*object.Error)
+
+		if tt.expected == "" {
+			if isError {
+				t.Errorf("error for %q: %s", tt.input, err.Message)
+			}
+			continue
+		}
+
+		if !isError || !errors.Is(err.Cause, object.ErrAllocationLimit) {
+			t.Errorf("expected an allocation limit to stop %q, got %s", tt.input, result.Inspect())
+			continue
+		}
+		if err.Message != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err.Message)
+		}
+	}
+}
+
+func TestBuiltinSets(t *testing.T) {
+	var stdout bytes.Buffer
+	env := object.NewEnvironment()
+	env.Config().Builtins = object.NewBuiltins(object.Host{Stdout: &stdout})
+
+	program := parser.New(lexer.New(`puts("out", len("four"))`)).ParseProgram()
+	if result := Eval(program, env); isError(result) {
+		t.Fatalf("eval error: %s", result.Inspect())
+	}
+	if stdout.String() != "out\n4\n" {
+		t.Errorf("wrong stdout. got=%q", stdout.String())
+	}
+
+	env = object.NewEnvironment()
+	env.Config().Builtins = object.PureBuiltins()
+	program = parser.New(lexer.New(`puts("out")`)).ParseProgram()
+	err, ok := Eval(program, env).(*object.Error)
+	if !ok || err.Message != "identifier not found: puts" {
+		t.Errorf("expected puts to be undefined with pure builtins, got %v", err)
+	}
+}
@@ -1,23 +1,74 @@
 package lexer
 
-import "github.com/mehrankamal/monkey/token"
+import (
+	"fmt"
+	"github.com/mehrankamal/monkey/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is a lexical error. The offending input is also returned as an
+// ILLEGAL token.
+type Error struct {
+	Pos     token.Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
 
 type Lexer struct {
+	filename     string
 	input        string
 	position     int
 	readPosition int
 	ch           byte
+
+	line   int // line of ch
+	column int // column of ch
+
+	keepComments bool
+	errors       []*Error
 }
 
 func New(input string) *Lexer {
+	return NewWithFilename(input, "")
+}
+
+func NewWithFilename(input string, filename string) *Lexer {
 	l := &Lexer{
-		input: input,
+		filename: filename,
+		input:    input,
+		line:     1,
 	}
 	l.readChar()
 	return l
 }
 
+// SetKeepComments controls whether comments are returned as COMMENT tokens
+// instead of being skipped like whitespace.
+func (l *Lexer) SetKeepComments(keep bool) {
+	l.keepComments = keep
+}
+
+func (l *Lexer) Errors() []*Error {
+	return l.errors
+}
+
+func (l *Lexer) errorf(pos token.Position, format string, a ...interface{}) {
+	l.errors = append(l.errors, &Error{Pos: pos, Message: fmt.Sprintf(format, a...)})
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line += 1
+		l.column = 1
+	} else {
+		l.column += 1
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -28,10 +79,40 @@ func (l *Lexer) readChar() {
 	l.readPosition += 1
 }
 
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
+}
+
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	for {
+		l.skipWhitespaces()
+
+		pos := l.currentPosition()
+
+		var tok token.Token
+		if l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+			tok = l.readComment(pos)
+			if tok.Type == token.COMMENT && !l.keepComments {
+				continue
+			}
+		} else {
+			tok = l.readToken()
+		}
+
+		tok.Pos = pos
+		tok.End = l.currentPosition()
+
+		return tok
+	}
+}
 
-	l.skipWhitespaces()
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '=':
@@ -42,9 +123,9 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.readCompoundAssign(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.readCompoundAssign(token.MINUS, token.MINUS_ASSIGN)
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case '(':
@@ -54,13 +135,56 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.readCompoundAssign(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			l.readChar()
+			tok = token.Token{Type: token.POWER, Literal: "**"}
+		} else {
+			tok = l.readCompoundAssign(token.ASTERISK, token.ASTERISK_ASSIGN)
+		}
+	case '%':
+		tok = l.readCompoundAssign(token.PERCENT, token.PERCENT_ASSIGN)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		switch l.peekChar() {
+		case '=':
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: "<="}
+		case '<':
+			l.readChar()
+			tok = token.Token{Type: token.SHL, Literal: "<<"}
+		default:
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		switch l.peekChar() {
+		case '=':
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: ">="}
+		case '>':
+			l.readChar()
+			tok = token.Token{Type: token.SHR, Literal: ">>"}
+		default:
+			tok = newToken(token.GT, l.ch)
+		}
+	case '&':
+		if l.peekChar() == '&' {
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			tok = newToken(token.BIT_AND, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		} else {
+			tok = newToken(token.BIT_OR, l.ch)
+		}
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
+	case '~':
+		tok = newToken(token.BIT_NOT, l.ch)
 	case '!':
 		if l.peekChar() == '=' {
 			l.readChar()
@@ -73,8 +197,9 @@ func (l *Lexer) NextToken() token.Token {
 	case '}':
 		tok = newToken(token.RBRACE, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readString()
+	case '`':
+		tok = l.readRawString()
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
@@ -90,10 +215,10 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Type, tok.Literal = l.readNumber()
 			return tok
 		} else {
+			l.errorf(l.currentPosition(), "illegal character %q", l.ch)
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
@@ -101,6 +226,17 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
+// readCompoundAssign returns a token of type assign when the current
+// operator character is followed by '=', and of type op otherwise.
+func (l *Lexer) readCompoundAssign(op, assign token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: assign, Literal: string(ch) + "="}
+	}
+	return newToken(op, l.ch)
+}
+
 func (l *Lexer) readIdentifier() string {
 	position := l.position
 	for isLetter(l.ch) {
@@ -109,14 +245,118 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads an integer or a float literal. Floats have a fractional
+// part, an exponent or both: 1.5, 2e10, 6.02E-23. Integers may be written
+// in hex, octal or binary with a 0x, 0o or 0b prefix, and any number may use
+// underscores between digits: 1_000_000.
+func (l *Lexer) readNumber() (token.TokenType, string) {
+	start := l.currentPosition()
 	position := l.position
 
-	for isDigit(l.ch) {
+	if l.ch == '0' && basePrefixes[l.peekChar()] != "" {
+		return l.readPrefixedInteger(start)
+	}
+
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
 		l.readChar()
+		l.readDigits()
 	}
 
-	return l.input[position:l.position]
+	if (l.ch == 'e' || l.ch == 'E') && l.atExponent() {
+		tokenType = token.FLOAT
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
+			l.readChar()
+		}
+		l.readDigits()
+	}
+
+	literal := l.input[position:l.position]
+	if !underscoresOK(literal, isDigit) {
+		l.errorf(start, "'_' must separate successive digits in %s", literal)
+		return token.ILLEGAL, literal
+	}
+
+	return tokenType, literal
+}
+
+var basePrefixes = map[byte]string{
+	'x': "hexadecimal", 'X': "hexadecimal",
+	'o': "octal", 'O': "octal",
+	'b': "binary", 'B': "binary",
+}
+
+func (l *Lexer) readPrefixedInteger(start token.Position) (token.TokenType, string) {
+	position := l.position
+	l.readChar()
+	kind := basePrefixes[l.ch]
+	l.readChar()
+
+	for isHexDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+
+	literal := l.input[position:l.position]
+	digits := literal[2:]
+
+	isBaseDigit := isHexDigit
+	switch kind {
+	case "octal":
+		isBaseDigit = func(ch byte) bool { return '0' <= ch && ch <= '7' }
+	case "binary":
+		isBaseDigit = func(ch byte) bool { return ch == '0' || ch == '1' }
+	}
+
+	if strings.Trim(digits, "_") == "" {
+		l.errorf(start, "%s literal has no digits", kind)
+		return token.ILLEGAL, literal
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] != '_' && !isBaseDigit(digits[i]) {
+			l.errorf(start, "invalid digit %q in %s literal", digits[i], kind)
+			return token.ILLEGAL, literal
+		}
+	}
+	if !underscoresOK(digits, isBaseDigit) {
+		l.errorf(start, "'_' must separate successive digits in %s", literal)
+		return token.ILLEGAL, literal
+	}
+
+	return token.INT, literal
+}
+
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+}
+
+// underscoresOK reports whether every '_' in digits sits between two digits.
+func underscoresOK(digits string, isBaseDigit func(byte) bool) bool {
+	for i := 0; i < len(digits); i++ {
+		if digits[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(digits)-1 || !isBaseDigit(digits[i-1]) || !isBaseDigit(digits[i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// atExponent reports whether the 'e' under the lexer starts an exponent,
+// i.e. is followed by digits with an optional sign.
+func (l *Lexer) atExponent() bool {
+	next := l.readPosition
+	if next < len(l.input) && (l.input[next] == '+' || l.input[next] == '-') {
+		next++
+	}
+	return next < len(l.input) && isDigit(l.input[next])
 }
 
 func (l *Lexer) skipWhitespaces() {
@@ -125,6 +365,31 @@ func (l *Lexer) skipWhitespaces() {
 	}
 }
 
+func (l *Lexer) readComment(start token.Position) token.Token {
+	position := l.position
+
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		return token.Token{Type: token.COMMENT, Literal: l.input[position:l.position]}
+	}
+
+	l.readChar()
+	l.readChar()
+	for !(l.ch == '*' && l.peekChar() == '/') {
+		if l.ch == 0 {
+			l.errorf(start, "unterminated block comment")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[position:l.position]}
+		}
+		l.readChar()
+	}
+	l.readChar()
+	l.readChar()
+
+	return token.Token{Type: token.COMMENT, Literal: l.input[position:l.position]}
+}
+
 func (l *Lexer) peekChar() byte {
 	if l.readPosition < len(l.input) {
 		return l.input[l.readPosition]
@@ -133,17 +398,122 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// readString reads a double-quoted string and decodes its escape sequences.
+// The token's literal is the decoded value.
+func (l *Lexer) readString() token.Token {
+	start := l.currentPosition()
+
+	var out strings.Builder
+	valid := true
 
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+
+		switch l.ch {
+		case '"':
+			if !valid {
+				return token.Token{Type: token.ILLEGAL, Literal: l.input[start.Offset : l.position+1]}
+			}
+			return token.Token{Type: token.STRING, Literal: out.String()}
+		case 0, '\n':
+			l.errorf(start, "unterminated string")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start.Offset:l.position]}
+		case '\\':
+			if !l.readEscape(&out) {
+				valid = false
+			}
+		default:
+			out.WriteByte(l.ch)
 		}
 	}
+}
 
-	return l.input[position:l.position]
+// readEscape decodes the escape sequence starting at the current backslash,
+// leaving the lexer on its last character.
+func (l *Lexer) readEscape(out *strings.Builder) bool {
+	pos := l.currentPosition()
+
+	switch l.peekChar() {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '0':
+		out.WriteByte(0)
+	case '"':
+		out.WriteByte('"')
+	case '\\':
+		out.WriteByte('\\')
+	case 'u':
+		l.readChar()
+		return l.readUnicodeEscape(pos, out)
+	case 0, '\n':
+		// leave the terminator for readString to report
+		l.errorf(pos, "invalid escape sequence at end of line")
+		return false
+	default:
+		l.errorf(pos, "invalid escape sequence \\%c", l.peekChar())
+		l.readChar()
+		return false
+	}
+
+	l.readChar()
+	return true
+}
+
+func (l *Lexer) readUnicodeEscape(pos token.Position, out *strings.Builder) bool {
+	if l.peekChar() != '{' {
+		l.errorf(pos, "invalid unicode escape: expected {")
+		return false
+	}
+	l.readChar()
+
+	digits := l.readPosition
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+	}
+	hex := l.input[digits:l.readPosition]
+
+	if l.peekChar() != '}' {
+		l.errorf(pos, "invalid unicode escape: expected }")
+		return false
+	}
+	l.readChar()
+
+	if len(hex) == 0 || len(hex) > 6 {
+		l.errorf(pos, "invalid unicode escape \\u{%s}", hex)
+		return false
+	}
+
+	value, _ := strconv.ParseUint(hex, 16, 32)
+	if !utf8.ValidRune(rune(value)) {
+		l.errorf(pos, "invalid unicode code point \\u{%s}", hex)
+		return false
+	}
+
+	out.WriteRune(rune(value))
+	return true
+}
+
+// readRawString reads a backtick string. Its content is taken verbatim and
+// may span lines.
+func (l *Lexer) readRawString() token.Token {
+	start := l.currentPosition()
+	position := l.position + 1
+
+	for {
+		l.readChar()
+
+		switch l.ch {
+		case '`':
+			return token.Token{Type: token.STRING, Literal: l.input[position:l.position]}
+		case 0:
+			l.errorf(start, "unterminated raw string")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start.Offset:l.position]}
+		}
+	}
 }
 
 func isLetter(ch byte) bool {
@@ -154,6 +524,10 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
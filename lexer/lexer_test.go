@@ -34,7 +34,7 @@ func TestNextTokenExtendedSet(t *testing.T) {
 		x + y;
 	};
 	let result = add(five, ten);
-	!-/*5;
+	!-/ *5;
 	5 < 10 > 5;
 	if (5 < 10) {
 		return true;
@@ -168,3 +168,388 @@ func assertNextTokens(t *testing.T, input string, testCases []struct {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = 5;
+  "ab" + x`
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedPos    token.Position
+		expectedEndCol int
+	}{
+		{token.LET, token.Position{Filename: "test.mk", Offset: 0, Line: 1, Column: 1}, 4},
+		{token.IDENT, token.Position{Filename: "test.mk", Offset: 4, Line: 1, Column: 5}, 6},
+		{token.ASSIGN, token.Position{Filename: "test.mk", Offset: 6, Line: 1, Column: 7}, 8},
+		{token.INT, token.Position{Filename: "test.mk", Offset: 8, Line: 1, Column: 9}, 10},
+		{token.SEMICOLON, token.Position{Filename: "test.mk", Offset: 9, Line: 1, Column: 10}, 11},
+		{token.STRING, token.Position{Filename: "test.mk", Offset: 13, Line: 2, Column: 3}, 7},
+		{token.PLUS, token.Position{Filename: "test.mk", Offset: 18, Line: 2, Column: 8}, 9},
+		{token.IDENT, token.Position{Filename: "test.mk", Offset: 20, Line: 2, Column: 10}, 11},
+		{token.EOF, token.Position{Filename: "test.mk", Offset: 21, Line: 2, Column: 11}, 12},
+	}
+
+	l := NewWithFilename(input, "test.mk")
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos != tt.expectedPos {
+			t.Fatalf("tests[%d] - position wrong. expected=%+v, got=%+v",
+				i, tt.expectedPos, tok.Pos)
+		}
+		if tok.End.Column != tt.expectedEndCol {
+			t.Fatalf("tests[%d] - end column wrong. expected=%d, got=%d",
+				i, tt.expectedEndCol, tok.End.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// leading comment
+let x = 5; // trailing comment
+/* block
+   comment */ x / 2;
+/**/
+`
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestKeepComments(t *testing.T) {
+	input := `// doc
+let x = 5; /* inline */ x`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.COMMENT, "// doc"},
+		{token.LET, "let"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.COMMENT, "/* inline */"},
+		{token.IDENT, "x"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	l.SetKeepComments(true)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"let x = 1;\n  /* never closed", "2:3: unterminated block comment"},
+		{"/*/", "1:1: unterminated block comment"},
+		{"let @ = 1;", "1:5: illegal character '@'"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+
+		sawIllegal := false
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+			if tok.Type == token.ILLEGAL {
+				sawIllegal = true
+			}
+		}
+
+		if !sawIllegal {
+			t.Errorf("expected ILLEGAL token for %q", tt.input)
+		}
+
+		errors := l.Errors()
+		if len(errors) != 1 {
+			t.Fatalf("wrong number of errors for %q. want=1, got=%d", tt.input, len(errors))
+		}
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	input := `"a\nb" "tab\there" "say \"hi\"" "back\\slash" "\u{48}\u{e9}\u{1F600}" "nul\0"
+` + "`raw \\n \"string\"`" + `
+` + "`multi\nline`"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.STRING, "a\nb"},
+		{token.STRING, "tab\there"},
+		{token.STRING, `say "hi"`},
+		{token.STRING, `back\slash`},
+		{token.STRING, "Hé😀"},
+		{token.STRING, "nul\x00"},
+		{token.STRING, `raw \n "string"`},
+		{token.STRING, "multi\nline"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{`"never closed`, "1:1: unterminated string"},
+		{"let s = \"broken\nline\"", "1:9: unterminated string"},
+		{"x `raw", "1:3: unterminated raw string"},
+		{`"bad \q escape"`, `1:6: invalid escape sequence \q`},
+		{`"\u41"`, "1:2: invalid unicode escape: expected {"},
+		{`"\u{}"`, `1:2: invalid unicode escape \u{}`},
+		{`"\u{41"`, "1:2: invalid unicode escape: expected }"},
+		{`"\u{D800}"`, `1:2: invalid unicode code point \u{D800}`},
+		{`"\u{1234567}"`, `1:2: invalid unicode escape \u{1234567}`},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+
+		sawIllegal := false
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+			if tok.Type == token.ILLEGAL {
+				sawIllegal = true
+			}
+		}
+
+		if !sawIllegal {
+			t.Errorf("expected ILLEGAL token for %q", tt.input)
+		}
+
+		errors := l.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected lexer errors for %q, got none", tt.input)
+		}
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
+func TestFloatLiterals(t *testing.T) {
+	input := `3.14 0.5 10e3 6.02E-23 1e+9 1.x 2e`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "0.5"},
+		{token.FLOAT, "10e3"},
+		{token.FLOAT, "6.02E-23"},
+		{token.FLOAT, "1e+9"},
+		{token.INT, "1"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "x"},
+		{token.INT, "2"},
+		{token.IDENT, "e"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestIntegerLiteralForms(t *testing.T) {
+	input := `0x1F 0o17 0b1010 1_000_000 0XdeadBEEF 3.141_592`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "0x1F"},
+		{token.INT, "0o17"},
+		{token.INT, "0b1010"},
+		{token.INT, "1_000_000"},
+		{token.INT, "0XdeadBEEF"},
+		{token.FLOAT, "3.141_592"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestIntegerLiteralErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"0x", "1:1: hexadecimal literal has no digits"},
+		{"x = 0b12", "1:5: invalid digit '2' in binary literal"},
+		{"0o78", "1:1: invalid digit '8' in octal literal"},
+		{"1_", "1:1: '_' must separate successive digits in 1_"},
+		{"0x_FF", "1:1: '_' must separate successive digits in 0x_FF"},
+		{"1_.5", "1:1: '_' must separate successive digits in 1_.5"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		}
+
+		errors := l.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected lexer errors for %q, got none", tt.input)
+		}
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
+func TestComparisonAndLogicalOperators(t *testing.T) {
+	input := `a <= b >= c && d || e % f < g > h`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.AND, "&&"},
+		{token.IDENT, "d"},
+		{token.OR, "||"},
+		{token.IDENT, "e"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "f"},
+		{token.LT, "<"},
+		{token.IDENT, "g"},
+		{token.GT, ">"},
+		{token.IDENT, "h"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestPowerAndBitwiseOperators(t *testing.T) {
+	input := `a ** b * c & d | e ^ ~f << g >> h`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.POWER, "**"},
+		{token.IDENT, "b"},
+		{token.ASTERISK, "*"},
+		{token.IDENT, "c"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "d"},
+		{token.BIT_OR, "|"},
+		{token.IDENT, "e"},
+		{token.BIT_XOR, "^"},
+		{token.BIT_NOT, "~"},
+		{token.IDENT, "f"},
+		{token.SHL, "<<"},
+		{token.IDENT, "g"},
+		{token.SHR, ">>"},
+		{token.IDENT, "h"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestAssignmentOperators(t *testing.T) {
+	input := `x = 1; x += 2; x -= 3; x *= 4; x /= 5; x %= 6;`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "x"}, {token.ASSIGN, "="}, {token.INT, "1"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PLUS_ASSIGN, "+="}, {token.INT, "2"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.MINUS_ASSIGN, "-="}, {token.INT, "3"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.ASTERISK_ASSIGN, "*="}, {token.INT, "4"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.SLASH_ASSIGN, "/="}, {token.INT, "5"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PERCENT_ASSIGN, "%="}, {token.INT, "6"}, {token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestExceptionKeywords(t *testing.T) {
+	input := `try catch finally throw tryAgain`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.TRY, "try"},
+		{token.CATCH, "catch"},
+		{token.FINALLY, "finally"},
+		{token.THROW, "throw"},
+		{token.IDENT, "tryAgain"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
+
+func TestLoopKeywords(t *testing.T) {
+	input := `while for in break continue inner`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.WHILE, "while"},
+		{token.FOR, "for"},
+		{token.IN, "in"},
+		{token.BREAK, "break"},
+		{token.CONTINUE, "continue"},
+		{token.IDENT, "inner"},
+		{token.EOF, ""},
+	}
+
+	assertNextTokens(t, input, tests)
+}
@@ -1,20 +1,85 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/mehrankamal/monkey/repl"
+	"io"
 	"os"
 	"os/user"
 )
 
+var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+
+// streams are the standard streams the commands read scripts from and
+// write output and errors to.
+type streams struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// std holds the streams of the process; tests replace it.
+var std = streams{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+	monkey [flags]                      start the REPL, or run a script piped to stdin
+	monkey [flags] script.mk [args...]  run script.mk; "-" reads the script from stdin
+	monkey run [flags] file [args...]   run a script or a compiled .mkc file
+	monkey build script.mk [-o out.mkc] compile script.mk to bytecode
+	monkey disasm file                  list the bytecode of a script or .mkc file
+
+The script sees its arguments as the array args.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	switch {
+	case flag.Arg(0) == "run":
+		os.Exit(runCommand(flag.Args()[1:]))
+	case flag.Arg(0) == "build":
+		os.Exit(buildCommand(flag.Args()[1:]))
+	case flag.Arg(0) == "disasm":
+		os.Exit(disasmCommand(flag.Args()[1:]))
+	case flag.NArg() > 0:
+		os.Exit(runFile(flag.Arg(0), flag.Args()[1:]))
+	case stdinScript():
+		os.Exit(runFile("-", nil))
+	default:
+		startRepl()
+	}
+}
+
+func startRepl() {
 	current, err := user.Current()
 
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Printf("Hello %s! This is the Monkey programming language!\n", current.Username)
-	fmt.Printf("Feel free to type in Monkey commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	fmt.Fprintf(std.stdout, "Hello %s! This is the Monkey programming language!\n", current.Username)
+	fmt.Fprintf(std.stdout, "Feel free to type in Monkey commands\n")
+	repl.Start(std.stdin, std.stdout)
+}
+
+// stdinScript reports whether stdin holds a script to run, rather than
+// being a terminal to start the REPL on.
+func stdinScript() bool {
+	f, ok := std.stdin.(*os.File)
+	return !ok || !isTerminal(f)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mehrankamal/monkey/code"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// capture runs f with stdin reading input and the engine set to name, and
+// returns its exit code and what it wrote to stdout and stderr.
+func capture(t *testing.T, input, name string, f func() int) (int, string, string) {
+	t.Helper()
+
+	saved, savedEngine := std, *engine
+	t.Cleanup(func() { std, *engine = saved, savedEngine })
+
+	var stdout, stderr bytes.Buffer
+	std = streams{stdin: strings.NewReader(input), stdout: &stdout, stderr: &stderr}
+	*engine = name
+
+	code := f()
+	return code, stdout.String(), stderr.String()
+}
+
+func writeScript(t *testing.T, name, source string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("write script: %s", err)
+	}
+	return path
+}
+
+func TestRunFile(t *testing.T) {
+	failing := writeScript(t, "failing.mk", "let f = fn(x) {\n  x / 0\n};\nf(1)\n")
+	broken := writeScript(t, "broken.mk", "let x = ;\n")
+	greet := writeScript(t, "greet.mk", `let greeting = "hello"; puts(greeting, args)`)
+
+	tests := []struct {
+		engine string
+		path   string
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"vm", greet, []string{"a", "b"}, "", 0, "hello\n[a, b]\n", ""},
+		{"eval", greet, []string{"a", "b"}, "", 0, "hello\n[a, b]\n", ""},
+		{"vm", greet, nil, "", 0, "hello\n[]\n", ""},
+		{"vm", "-", []string{"x"}, "puts(len(args))", 0, "1\n", ""},
+		{"eval", "-", nil, "puts(1 + 2)", 0, "3\n", ""},
+		{"vm", failing, nil, "", 1, "",
+			failing + ":2: division by zero\n\tat f (" + failing + ":2)\n\tat <main> (" + failing + ":4)\n"},
+		{"eval", failing, nil, "", 1, "",
+			failing + ":2:5: division by zero\n\tat f (" + failing + ":2)\n\tat <main> (" + failing + ":4)\n"},
+		{"vm", "-", nil, "puts(1);\nthrow 2", 1, "1\n", "<stdin>:2: uncaught exception: 2\n\tat <main> (<stdin>:2)\n"},
+		{"vm", broken, nil, "", 1, "", broken + ":1:9: no prefix parse function for ; found\n"},
+		{"eval", "-", nil, "let x = ;", 1, "", "<stdin>:1:9: no prefix parse function for ; found\n"},
+		{"vm", filepath.Join(t.TempDir(), "missing.mk"), nil, "", 1, "", ""},
+		{"js", greet, nil, "", 2, "", "unknown engine \"js\": use 'vm' or 'eval'\n"},
+	}
+
+	for _, tt := range tests {
+		code, stdout, stderr := capture(t, tt.stdin, tt.engine, func() int {
+			return runFile(tt.path, tt.args)
+		})
+
+		if code != tt.code {
+			t.Errorf("%s -engine %s: wrong exit code. want=%d, got=%d (%q)", tt.path, tt.engine, tt.code, code, stderr)
+		}
+		if stdout != tt.stdout {
+			t.Errorf("%s -engine %s: wrong stdout. want=%q, got=%q", tt.path, tt.engine, tt.stdout, stdout)
+		}
+		// the message of a missing file depends on the system
+		if tt.stderr == "" && tt.code != 0 {
+			if stderr == "" {
+				t.Errorf("%s -engine %s: no error printed", tt.path, tt.engine)
+			}
+		} else if stderr != tt.stderr {
+			t.Errorf("%s -engine %s: wrong stderr. want=%q, got=%q", tt.path, tt.engine, tt.stderr, stderr)
+		}
+	}
+}
+
+func TestArgsIndex(t *testing.T) {
+	program, err := parseScript("test.mk", "args")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	bc, err := compileScript(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := code.Make(code.OpGetGlobal, argsIndex)
+	if !bytes.HasPrefix(bc.Instructions, expected) {
+		t.Errorf("args is not global %d:\n%s", argsIndex, bc.Instructions)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	script := writeScript(t, "script.mk", "puts(args[0])")
+	output := filepath.Join(t.TempDir(), "script.mkc")
+
+	tests := []struct {
+		name   string
+		run    func(args []string) int
+		args   []string
+		engine string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"run", runCommand, nil, "vm", 2, "", "usage: monkey run [flags] file [args...]\n"},
+		{"build", buildCommand, nil, "vm", 2, "", "usage: monkey build file [-o output]\n"},
+		{"build", buildCommand, []string{script, "extra"}, "vm", 2, "", "usage: monkey build file [-o output]\n"},
+		{"disasm", disasmCommand, nil, "vm", 2, "", "usage: monkey disasm file\n"},
+		{"disasm", disasmCommand, []string{script, script}, "vm", 2, "", "usage: monkey disasm file\n"},
+		{"build", buildCommand, []string{script, "-o", output}, "vm", 0, "", ""},
+		{"run", runCommand, []string{output, "compiled"}, "vm", 0, "compiled\n", ""},
+		{"run", runCommand, []string{"-engine", "eval", script, "evaluated"}, "vm", 0, "evaluated\n", ""},
+		{"run", runCommand, []string{output}, "eval", 1, "", output + ": cannot evaluate bytecode, use -engine=vm\n"},
+		{"run", runCommand, []string{"-engine", "js", script}, "vm", 2, "", "unknown engine \"js\": use 'vm' or 'eval'\n"},
+	}
+
+	for _, tt := range tests {
+		code, stdout, stderr := capture(t, "", tt.engine, func() int {
+			return tt.run(tt.args)
+		})
+
+		if code != tt.code {
+			t.Errorf("%s %v: wrong exit code. want=%d, got=%d (%q)", tt.name, tt.args, tt.code, code, stderr)
+		}
+		if stdout != tt.stdout {
+			t.Errorf("%s %v: wrong stdout. want=%q, got=%q", tt.name, tt.args, tt.stdout, stdout)
+		}
+		if stderr != tt.stderr {
+			t.Errorf("%s %v: wrong stderr. want=%q, got=%q", tt.name, tt.args, tt.stderr, stderr)
+		}
+	}
+
+	code, stdout, _ := capture(t, "", "vm", func() int { return disasmCommand([]string{output}) })
+	if code != 0 || !strings.Contains(stdout, "OpGetBuiltin 1           ; puts") {
+		t.Errorf("wrong disassembly (exit code %d):\n%s", code, stdout)
+	}
+}
+
+func TestStdinScript(t *testing.T) {
+	saved := std
+	t.Cleanup(func() { std = saved })
+
+	std.stdin = strings.NewReader("puts(1)")
+	if !stdinScript() {
+		t.Errorf("a reader is not taken for a script")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	std.stdin = r
+	if !stdinScript() {
+		t.Errorf("a pipe is not taken for a script")
+	}
+
+	// a character device, like a terminal
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Skipf("no %s: %s", os.DevNull, err)
+	}
+	defer null.Close()
+	std.stdin = null
+	if stdinScript() {
+		t.Errorf("%s is taken for a script", os.DevNull)
+	}
+}
@@ -0,0 +1,130 @@
+package object
+
+import (
+	"math"
+	"math/big"
+)
+
+// MaxIntegerBits bounds the integers shifts and powers produce. Larger
+// results would take all the memory of the process or hours to compute.
+const MaxIntegerBits = 1 << 20
+
+// ShlBits returns the number of bits of a << n for n >= 0, or
+// math.MaxInt64 if that is more.
+func ShlBits(a *big.Int, n int64) int64 {
+	bits := int64(a.BitLen())
+	if bits == 0 {
+		return 0
+	}
+	if n > math.MaxInt64-bits {
+		return math.MaxInt64
+	}
+	return bits + n
+}
+
+// PowBits returns a lower bound of the number of bits of a ** n for n >= 0,
+// at most math.MaxInt64. It is exact for powers of two.
+func PowBits(a *big.Int, n int64) int64 {
+	// |a| >= 2 ** bits, so a ** n has at least bits * n + 1 bits.
+	bits := int64(a.BitLen()) - 1
+	switch {
+	case n == 0:
+		return 1
+	case bits < 0:
+		return 0
+	case bits == 0:
+		return 1
+	}
+	if n > (math.MaxInt64-1)/bits {
+		return math.MaxInt64
+	}
+	return bits*n + 1
+}
+
+// NewInteger returns v as an *Integer if it fits in int64 and as a *BigInt
+// otherwise.
+func NewInteger(v *big.Int) Object {
+	if v.IsInt64() {
+		return &Integer{Value: v.Int64()}
+	}
+	return &BigInt{Value: v}
+}
+
+// BigValue returns the value of an INTEGER or BIGINT object as a big.Int.
+func BigValue(obj Object) (*big.Int, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return big.NewInt(obj.Value), true
+	case *BigInt:
+		return obj.Value, true
+	default:
+		return nil, false
+	}
+}
+
+// IsInteger reports whether obj is an INTEGER or a BIGINT.
+func IsInteger(obj Object) bool {
+	return obj.Type() == INTEGER || obj.Type() == BIGINT
+}
+
+// AddInt64 returns a + b and whether the result overflowed.
+func AddInt64(a, b int64) (int64, bool) {
+	result := a + b
+	return result, (a > 0 && b > 0 && result < 0) || (a < 0 && b < 0 && result >= 0)
+}
+
+// SubInt64 returns a - b and whether the result overflowed.
+func SubInt64(a, b int64) (int64, bool) {
+	result := a - b
+	return result, (a >= 0 && b < 0 && result < 0) || (a < 0 && b > 0 && result >= 0)
+}
+
+// MulInt64 returns a * b and whether the result overflowed.
+func MulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, false
+	}
+	result := a * b
+	overflow := result/b != a ||
+		(a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64)
+	return result, overflow
+}
+
+// DivInt64 returns a / b and whether the result overflowed. b must not be 0.
+func DivInt64(a, b int64) (int64, bool) {
+	return a / b, a == math.MinInt64 && b == -1
+}
+
+// PowInt64 returns a ** b for b >= 0 and whether the result overflowed.
+func PowInt64(a, b int64) (int64, bool) {
+	result := int64(1)
+	overflow := false
+
+	for b > 0 {
+		var o bool
+		if b&1 == 1 {
+			result, o = MulInt64(result, a)
+			overflow = overflow || o
+		}
+		b >>= 1
+		if b > 0 {
+			a, o = MulInt64(a, a)
+			overflow = overflow || o
+		}
+	}
+
+	return result, overflow
+}
+
+// ShlInt64 returns a << n for n >= 0 and whether the result overflowed.
+func ShlInt64(a, n int64) (int64, bool) {
+	if a == 0 {
+		return 0, false
+	}
+	if n >= 63 {
+		return 0, !(n == 63 && a == -1)
+	}
+
+	result := a << uint(n)
+	return result, result>>uint(n) != a
+}
@@ -0,0 +1,104 @@
+package object
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestCheckedInt64Arithmetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func(a, b int64) (int64, bool)
+		a, b     int64
+		expected int64
+		overflow bool
+	}{
+		{"add", AddInt64, 1, 2, 3, false},
+		{"add", AddInt64, math.MaxInt64, 1, math.MinInt64, true},
+		{"add", AddInt64, math.MinInt64, -1, math.MaxInt64, true},
+		{"add", AddInt64, math.MaxInt64, math.MinInt64, -1, false},
+		{"sub", SubInt64, 1, 2, -1, false},
+		{"sub", SubInt64, math.MinInt64, 1, math.MaxInt64, true},
+		{"sub", SubInt64, 0, math.MinInt64, math.MinInt64, true},
+		{"sub", SubInt64, -1, math.MinInt64, math.MaxInt64, false},
+		{"mul", MulInt64, 3, -4, -12, false},
+		{"mul", MulInt64, math.MaxInt64, 2, -2, true},
+		{"mul", MulInt64, math.MinInt64, -1, math.MinInt64, true},
+		{"mul", MulInt64, -1, math.MinInt64, math.MinInt64, true},
+		{"mul", MulInt64, 1 << 32, 1 << 31, math.MinInt64, true},
+		{"mul", MulInt64, 0, math.MinInt64, 0, false},
+		{"div", DivInt64, 7, -2, -3, false},
+		{"div", DivInt64, math.MinInt64, -1, math.MinInt64, true},
+	}
+
+	for _, tt := range tests {
+		result, overflow := tt.fn(tt.a, tt.b)
+		if result != tt.expected || overflow != tt.overflow {
+			t.Errorf("%s(%d, %d) wrong. want=(%d, %t), got=(%d, %t)",
+				tt.name, tt.a, tt.b, tt.expected, tt.overflow, result, overflow)
+		}
+	}
+}
+
+func TestPowAndShiftInt64(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func(a, b int64) (int64, bool)
+		a, b     int64
+		expected int64
+		overflow bool
+	}{
+		{"pow", PowInt64, 2, 10, 1024, false},
+		{"pow", PowInt64, -3, 3, -27, false},
+		{"pow", PowInt64, 7, 0, 1, false},
+		{"pow", PowInt64, 0, 0, 1, false},
+		{"pow", PowInt64, 2, 62, 1 << 62, false},
+		{"pow", PowInt64, -2, 63, math.MinInt64, false},
+		{"pow", PowInt64, 2, 63, math.MinInt64, true},
+		{"pow", PowInt64, 10, 19, -8446744073709551616, true},
+		{"shl", ShlInt64, 1, 62, 1 << 62, false},
+		{"shl", ShlInt64, 1, 63, 0, true},
+		{"shl", ShlInt64, -1, 63, 0, false},
+		{"shl", ShlInt64, 3, 62, math.MinInt64 + (1 << 62), true},
+		{"shl", ShlInt64, -5, 2, -20, false},
+		{"shl", ShlInt64, 0, 100, 0, false},
+		{"shl", ShlInt64, 1, 100, 0, true},
+	}
+
+	for _, tt := range tests {
+		result, overflow := tt.fn(tt.a, tt.b)
+		if overflow != tt.overflow || (!overflow && result != tt.expected) {
+			t.Errorf("%s(%d, %d) wrong. want=(%d, %t), got=(%d, %t)",
+				tt.name, tt.a, tt.b, tt.expected, tt.overflow, result, overflow)
+		}
+	}
+}
+
+func TestShiftAndPowBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func(a *big.Int, n int64) int64
+		a, n     int64
+		expected int64
+	}{
+		{"shl", ShlBits, 1, 10, 11},
+		{"shl", ShlBits, -4, 10, 13},
+		{"shl", ShlBits, 0, math.MaxInt64, 0},
+		{"shl", ShlBits, 5, math.MaxInt64, math.MaxInt64},
+		{"pow", PowBits, 2, 10, 11},
+		{"pow", PowBits, -8, 3, 10},
+		{"pow", PowBits, 7, 3, 7},
+		{"pow", PowBits, 1000, math.MaxInt64, math.MaxInt64},
+		{"pow", PowBits, 1, math.MaxInt64, 1},
+		{"pow", PowBits, -1, math.MaxInt64, 1},
+		{"pow", PowBits, 0, 5, 0},
+		{"pow", PowBits, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		if bits := tt.fn(big.NewInt(tt.a), tt.n); bits != tt.expected {
+			t.Errorf("%s(%d, %d) wrong. want=%d, got=%d", tt.name, tt.a, tt.n, tt.expected, bits)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrInstructionLimit stops a program that has run Config.MaxInstructions
+// instructions.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// ErrAllocationLimit stops a program that allocates more objects in all, or
+// larger arrays, hashes, strings or integers, than its config allows. The errors returned
+// wrap it with the limit that was exceeded.
+var ErrAllocationLimit = errors.New("allocation limit exceeded")
+
+// checkInterval is the number of instructions run between checks of the
+// context of a Budget.
+const checkInterval = 1024
+
+// Budget bounds a running program. It counts the instructions the program
+// runs and stops it once its context is done or the instruction limit of
+// its config is reached. The evaluator counts each node it evaluates as an
+// instruction. It also counts the objects the program allocates over the
+// whole run and checks their sizes against the allocation limits of the
+// config.
+type Budget struct {
+	ctxs   []context.Context
+	config *Config
+
+	instructions int64
+	nextCheck    int64
+
+	allocations int64
+}
+
+// NewBudget returns a budget bounded by ctx and the MaxInstructions of
+// config.
+func NewBudget(ctx context.Context, config *Config) *Budget {
+	return &Budget{ctxs: []context.Context{ctx}, config: config}
+}
+
+// Start restarts the counts of instructions and allocations and bounds the
+// budget by ctx.
+func (b *Budget) Start(ctx context.Context) {
+	b.ctxs = []context.Context{ctx}
+	b.instructions = 0
+	b.nextCheck = 0
+	b.allocations = 0
+}
+
+// Nest bounds the budget by ctx as well as its current contexts, keeping
+// the counts, until the returned function is called. It is used for calls
+// made by the host while a program runs.
+func (b *Budget) Nest(ctx context.Context) (restore func()) {
+	n := len(b.ctxs)
+	b.ctxs = append(b.ctxs, ctx)
+	b.nextCheck = b.instructions
+
+	return func() { b.ctxs = b.ctxs[:n] }
+}
+
+// Instructions returns the number of instructions counted since the start.
+func (b *Budget) Instructions() int64 {
+	return b.instructions
+}
+
+// Step counts one instruction. Once the budget is spent it returns the
+// error of the context or ErrInstructionLimit, and keeps returning it.
+func (b *Budget) Step() error {
+	b.instructions++
+	if b.instructions < b.nextCheck {
+		return nil
+	}
+	return b.check()
+}
+
+func (b *Budget) check() error {
+	for _, ctx := range b.ctxs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	max := b.config.MaxInstructions
+	if max > 0 && b.instructions > max {
+		return ErrInstructionLimit
+	}
+
+	b.nextCheck = b.instructions + checkInterval
+	if max > 0 && b.nextCheck > max+1 {
+		b.nextCheck = max + 1
+	}
+	return nil
+}
+
+// Allocate counts obj, a newly created array, hash, string, integer or
+// function, against Config.MaxAllocations and checks its size with CheckSize.
+func (b *Budget) Allocate(obj Object) error {
+	b.allocations++
+	if max := b.config.MaxAllocations; max > 0 && b.allocations > max {
+		return fmt.Errorf("%w: more than %d allocations", ErrAllocationLimit, max)
+	}
+	return b.CheckSize(obj)
+}
+
+// AllocateResult counts the result of a builtin function like Allocate if
+// it is an array, hash, string or big integer.
+func (b *Budget) AllocateResult(obj Object) error {
+	switch obj.(type) {
+	case *Array, *Hash, *String, *BigInt:
+		return b.Allocate(obj)
+	}
+	return nil
+}
+
+// CheckSize checks the length of an array, hash, string or big integer
+// against the limits of the config. Other objects always pass.
+func (b *Budget) CheckSize(obj Object) error {
+	switch obj := obj.(type) {
+	case *Array:
+		if max := b.config.MaxArrayLength; max > 0 && len(obj.Elements) > max {
+			return fmt.Errorf("%w: array of %d elements, limit %d", ErrAllocationLimit, len(obj.Elements), max)
+		}
+	case *Hash:
+		if max := b.config.MaxHashSize; max > 0 && len(obj.Pairs) > max {
+			return fmt.Errorf("%w: hash of %d pairs, limit %d", ErrAllocationLimit, len(obj.Pairs), max)
+		}
+	case *String:
+		if max := b.config.MaxStringLength; max > 0 && len(obj.Value) > max {
+			return fmt.Errorf("%w: string of %d bytes, limit %d", ErrAllocationLimit, len(obj.Value), max)
+		}
+	case *BigInt:
+		return b.CheckIntegerBits(int64(obj.Value.BitLen()))
+	}
+	return nil
+}
+
+// CheckIntegerBits checks an integer of n bits against
+// Config.MaxStringLength, which bounds the bytes of big integers as well as
+// those of strings. Integers take whole words of memory. Checking the size
+// of a result before computing it keeps the program from spending the time
+// to compute it.
+func (b *Budget) CheckIntegerBits(n int64) error {
+	max := b.config.MaxStringLength
+	if max <= 0 {
+		return nil
+	}
+
+	words := n / bits.UintSize
+	if n%bits.UintSize != 0 {
+		words++
+	}
+	if size := words * (bits.UintSize / 8); size > int64(max) {
+		return fmt.Errorf("%w: integer of %d bytes, limit %d", ErrAllocationLimit, size, max)
+	}
+	return nil
+}
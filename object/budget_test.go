@@ -0,0 +1,123 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestBudgetInstructionLimit(t *testing.T) {
+	for _, max := range []int64{1, 10, checkInterval, checkInterval + 1, 3000} {
+		budget := NewBudget(context.Background(), &Config{MaxInstructions: max})
+
+		for i := int64(1); i <= max; i++ {
+			if err := budget.Step(); err != nil {
+				t.Fatalf("limit %d: step %d failed: %s", max, i, err)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			if err := budget.Step(); err != ErrInstructionLimit {
+				t.Fatalf("limit %d: expected ErrInstructionLimit, got %v", max, err)
+			}
+		}
+
+		budget.Start(context.Background())
+		if err := budget.Step(); err != nil {
+			t.Errorf("limit %d: step after Start failed: %s", max, err)
+		}
+	}
+}
+
+func TestBudgetContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	budget := NewBudget(ctx, &Config{})
+
+	for i := 0; i < 10; i++ {
+		if err := budget.Step(); err != nil {
+			t.Fatalf("step %d failed: %s", i, err)
+		}
+	}
+
+	cancel()
+	var err error
+	for i := 0; i <= checkInterval && err == nil; i++ {
+		err = budget.Step()
+	}
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled within %d steps, got %v", checkInterval, err)
+	}
+}
+
+func TestBudgetNest(t *testing.T) {
+	budget := NewBudget(context.Background(), &Config{MaxInstructions: 10})
+	for i := 0; i < 5; i++ {
+		budget.Step()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	restore := budget.Nest(ctx)
+	if err := budget.Step(); err != context.Canceled {
+		t.Errorf("expected the nested context to stop the budget, got %v", err)
+	}
+
+	restore()
+	for i := 0; i < 4; i++ {
+		if err := budget.Step(); err != nil {
+			t.Fatalf("step after restore failed: %s", err)
+		}
+	}
+	if err := budget.Step(); err != ErrInstructionLimit {
+		t.Errorf("expected the nested steps to count, got %v", err)
+	}
+}
+
+func TestBudgetAllocationLimits(t *testing.T) {
+	config := &Config{MaxArrayLength: 2, MaxHashSize: 1, MaxStringLength: 3, MaxAllocations: 4}
+
+	tests := []struct {
+		obj      Object
+		expected string
+	}{
+		{&Array{Elements: []Object{&Integer{}, &Integer{}}}, ""},
+		{&Array{Elements: []Object{&Integer{}, &Integer{}, &Integer{}}}, "allocation limit exceeded: array of 3 elements, limit 2"},
+		{&String{Value: "abcd"}, "allocation limit exceeded: string of 4 bytes, limit 3"},
+		{&Hash{Pairs: map[HashKey]HashPair{{Type: INTEGER, Value: 1}: {}, {Type: INTEGER, Value: 2}: {}}},
+			"allocation limit exceeded: hash of 2 pairs, limit 1"},
+		{&Integer{Value: 1 << 40}, ""},
+		{&BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 64)}, "allocation limit exceeded: integer of 16 bytes, limit 3"},
+	}
+
+	for _, tt := range tests {
+		err := NewBudget(context.Background(), config).CheckSize(tt.obj)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %s: %s", tt.obj.Inspect(), err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrAllocationLimit) || err.Error() != tt.expected {
+			t.Errorf("wrong error for %s. want=%q, got=%v", tt.obj.Inspect(), tt.expected, err)
+		}
+	}
+
+	budget := NewBudget(context.Background(), config)
+	for i := 0; i < 4; i++ {
+		if err := budget.Allocate(&String{}); err != nil {
+			t.Fatalf("allocation %d failed: %s", i, err)
+		}
+	}
+	if err := budget.AllocateResult(&Integer{}); err != nil {
+		t.Errorf("integer result counted as an object: %s", err)
+	}
+	if err := budget.AllocateResult(&Array{}); err == nil || err.Error() != "allocation limit exceeded: more than 4 allocations" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	budget.Start(context.Background())
+	if err := budget.Allocate(&String{}); err != nil {
+		t.Errorf("allocation after Start failed: %s", err)
+	}
+}
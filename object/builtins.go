@@ -1,144 +1,195 @@
 package object
 
-import "fmt"
-
-var Builtins = []struct {
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// BuiltinDefinition names a builtin function.
+type BuiltinDefinition struct {
 	Name    string
 	Builtin *Builtin
-}{
-	{
-		"len",
-		&Builtin{Fn: func(args ...Object) Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			switch arg := args[0].(type) {
-			case *Array:
-				return &Integer{Value: int64(len(arg.Elements))}
-			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
-			default:
-				return newError("argument to `len` not supported, got %s",
-					args[0].Type())
-			}
-		},
-		},
-	},
-	{
-		"puts",
-		&Builtin{Fn: func(args ...Object) Object {
-
-			for _, arg := range args {
-				fmt.Println(arg.Inspect())
-			}
-
-			return nil
-		},
-		},
-	},
-	{
-		"first",
-		&Builtin{Fn: func(args ...Object) Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			if args[0].Type() != ARRAY {
-				return newError("argument to `first` not supported, got %s",
-					args[0].Type())
-			}
-			arr := args[0].(*Array)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[0]
-			}
-			return nil
-		},
-		},
-	},
-	{
-		"last",
-		&Builtin{Fn: func(args ...Object) Object {
-
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-
-			if args[0].Type() != ARRAY {
-				return newError("argument to `last` not supported, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*Array)
-			length := len(arr.Elements)
-			if length > 0 {
-				return arr.Elements[length-1]
-			}
-
-			return nil
-		},
-		},
-	},
-	{
-		"rest",
-		&Builtin{Fn: func(args ...Object) Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			if args[0].Type() != ARRAY {
-				return newError("argument to `rest` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*Array)
-			length := len(arr.Elements)
-			if length > 0 {
-				newElements := make([]Object, length-1, length-1)
-				copy(newElements, arr.Elements[1:length])
-				return &Array{Elements: newElements}
-			}
-
-			return nil
-		},
-		},
-	},
-	{
-		"push",
-		&Builtin{Fn: func(args ...Object) Object {
-			if len(args) != 2 {
-				return newError("wrong number of arguments. got=%d, want=2",
-					len(args))
-			}
-
-			if args[0].Type() != ARRAY {
-				return newError("argument to `push` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*Array)
-			length := len(arr.Elements)
-
-			newElements := make([]Object, length+1, length+1)
-			copy(newElements, arr.Elements)
-			newElements[length] = args[1]
-
-			return &Array{Elements: newElements}
-		},
-		},
-	},
 }
 
-func GetBuiltinByName(name string) *Builtin {
-	for _, def := range Builtins {
+// BuiltinSet lists the builtin functions available to a program. The
+// compiler refers to builtins by their index in the set, so a program must
+// run with the set it was compiled with.
+type BuiltinSet []BuiltinDefinition
+
+// Lookup returns the builtin called name.
+func (s BuiltinSet) Lookup(name string) (*Builtin, bool) {
+	for _, def := range s {
 		if def.Name == name {
-			return def.Builtin
+			return def.Builtin, true
+		}
+	}
+	return nil, false
+}
+
+// Host is the outside world of the builtins with side effects.
+type Host struct {
+	// Stdout receives the output of puts. Output to a nil writer is
+	// discarded.
+	Stdout io.Writer
+}
+
+// Builtins is the builtin set of the monkey command: the pure builtins,
+// and puts writing to the standard output of the process.
+var Builtins = NewBuiltins(Host{Stdout: processOutput{}})
+
+// PureBuiltins returns the builtins without side effects: len, first,
+// last, rest and push.
+func PureBuiltins() BuiltinSet {
+	return BuiltinSet{
+		define("len", builtinLen),
+		define("first", builtinFirst),
+		define("last", builtinLast),
+		define("rest", builtinRest),
+		define("push", builtinPush),
+	}
+}
+
+// NewBuiltins returns the builtins working on host: len, puts, first,
+// last, rest and push.
+func NewBuiltins(host Host) BuiltinSet {
+	return BuiltinSet{
+		define("len", builtinLen),
+		define("puts", printer(host.Stdout)),
+		define("first", builtinFirst),
+		define("last", builtinLast),
+		define("rest", builtinRest),
+		define("push", builtinPush),
+	}
+}
+
+func define(name string, fn BuiltinFunction) BuiltinDefinition {
+	return BuiltinDefinition{Name: name, Builtin: &Builtin{Name: name, Fn: fn}}
+}
+
+// processOutput writes to the standard output of the process at the time
+// of the write, so that replacing os.Stdout redirects it.
+type processOutput struct{}
+
+func (processOutput) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func GetBuiltinByName(name string) *Builtin {
+	builtin, _ := Builtins.Lookup(name)
+	return builtin
+}
+
+func builtinLen(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Array:
+		return &Integer{Value: int64(len(arg.Elements))}
+	case *String:
+		return &Integer{Value: int64(len(arg.Value))}
+	default:
+		return newError("argument to `len` not supported, got %s",
+			args[0].Type())
+	}
+}
+
+// printer returns a builtin printing each argument on a line of its own
+// to w.
+func printer(w io.Writer) BuiltinFunction {
+	if w == nil {
+		w = io.Discard
+	}
+
+	return func(args ...Object) Object {
+		for _, arg := range args {
+			fmt.Fprintln(w, arg.Inspect())
 		}
+
+		return nil
 	}
+}
+
+func builtinFirst(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	if args[0].Type() != ARRAY {
+		return newError("argument to `first` not supported, got %s",
+			args[0].Type())
+	}
+	arr := args[0].(*Array)
+	if len(arr.Elements) > 0 {
+		return arr.Elements[0]
+	}
+	return nil
+}
+
+func builtinLast(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+
+	if args[0].Type() != ARRAY {
+		return newError("argument to `last` not supported, got %s",
+			args[0].Type())
+	}
+
+	arr := args[0].(*Array)
+	length := len(arr.Elements)
+	if length > 0 {
+		return arr.Elements[length-1]
+	}
+
+	return nil
+}
+
+func builtinRest(args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	if args[0].Type() != ARRAY {
+		return newError("argument to `rest` must be ARRAY, got %s",
+			args[0].Type())
+	}
+
+	arr := args[0].(*Array)
+	length := len(arr.Elements)
+	if length > 0 {
+		newElements := make([]Object, length-1, length-1)
+		copy(newElements, arr.Elements[1:length])
+		return &Array{Elements: newElements}
+	}
+
 	return nil
 }
 
+func builtinPush(args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+
+	if args[0].Type() != ARRAY {
+		return newError("argument to `push` must be ARRAY, got %s",
+			args[0].Type())
+	}
+
+	arr := args[0].(*Array)
+	length := len(arr.Elements)
+
+	newElements := make([]Object, length+1, length+1)
+	copy(newElements, arr.Elements)
+	newElements[length] = args[1]
+
+	return &Array{Elements: newElements}
+}
+
 func newError(format string, a ...interface{}) *Error {
 	return &Error{Message: fmt.Sprintf(format, a...)}
 }
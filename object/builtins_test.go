@@ -0,0 +1,54 @@
+package object
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuiltinSets(t *testing.T) {
+	tests := []struct {
+		set      BuiltinSet
+		expected []string
+	}{
+		{PureBuiltins(), []string{"len", "first", "last", "rest", "push"}},
+		{NewBuiltins(Host{}), []string{"len", "puts", "first", "last", "rest", "push"}},
+		{Builtins, []string{"len", "puts", "first", "last", "rest", "push"}},
+	}
+
+	for _, tt := range tests {
+		if len(tt.set) != len(tt.expected) {
+			t.Errorf("wrong number of builtins. want=%d, got=%d", len(tt.expected), len(tt.set))
+			continue
+		}
+		for i, name := range tt.expected {
+			if tt.set[i].Name != name {
+				t.Errorf("builtin %d has wrong name. want=%q, got=%q", i, name, tt.set[i].Name)
+			}
+			if builtin, ok := tt.set.Lookup(name); !ok || builtin != tt.set[i].Builtin {
+				t.Errorf("Lookup(%q) did not return builtin %d", name, i)
+			}
+		}
+	}
+
+	if _, ok := PureBuiltins().Lookup("puts"); ok {
+		t.Errorf("pure builtins have puts")
+	}
+}
+
+func TestHostOutput(t *testing.T) {
+	var stdout bytes.Buffer
+	set := NewBuiltins(Host{Stdout: &stdout})
+
+	puts, _ := set.Lookup("puts")
+	puts.Fn(&String{Value: "out"}, &Integer{Value: 1})
+
+	if stdout.String() != "out\n1\n" {
+		t.Errorf("wrong stdout. got=%q", stdout.String())
+	}
+
+	discard := NewBuiltins(Host{})
+	puts, _ = discard.Lookup("puts")
+	if result := puts.Fn(&String{Value: "lost"}); result != nil {
+		t.Errorf("puts without a writer returned %s", result.Inspect())
+	}
+}
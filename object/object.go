@@ -2,10 +2,16 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/mehrankamal/monkey/ast"
 	"github.com/mehrankamal/monkey/code"
+	"github.com/mehrankamal/monkey/token"
 	"hash/fnv"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -22,10 +28,16 @@ type Hashable interface {
 
 const (
 	INTEGER           Type = "INTEGER"
+	FLOAT                  = "FLOAT"
+	BIGINT                 = "BIGINT"
 	BOOLEAN                = "BOOLEAN"
 	NULL                   = "NULL"
 	RETURN_VALUE           = "RETURN_VALUE"
+	BREAK                  = "BREAK"
+	CONTINUE               = "CONTINUE"
+	TAIL_CALL              = "TAIL_CALL"
 	ERROR                  = "ERROR"
+	EXCEPTION              = "EXCEPTION"
 	FUNCTION               = "FUNCTION"
 	STRING                 = "STRING"
 	BUILTIN                = "BUILTIN"
@@ -33,6 +45,8 @@ const (
 	HASH                   = "HASH"
 	COMPILED_FUNCTION      = "COMPILED_FUNCTION"
 	CLOSURE                = "CLOSURE"
+	CELL                   = "CELL"
+	ITERATOR               = "ITERATOR"
 )
 
 type Integer struct {
@@ -45,6 +59,50 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// BigInt is an integer outside the int64 range. Arithmetic promotes integers
+// to BigInt on overflow and demotes results back to Integer when they fit,
+// see NewInteger.
+type BigInt struct {
+	Value *big.Int
+}
+
+func (bi *BigInt) Inspect() string { return bi.Value.String() }
+func (bi *BigInt) Type() Type      { return BIGINT }
+func (bi *BigInt) HashKey() HashKey {
+	if bi.Value.IsInt64() {
+		return (&Integer{Value: bi.Value.Int64()}).HashKey()
+	}
+
+	h := fnv.New64a()
+	if bi.Value.Sign() < 0 {
+		h.Write([]byte{'-'})
+	}
+	h.Write(bi.Value.Bytes())
+
+	return HashKey{Type: bi.Type(), Value: h.Sum64()}
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() Type { return FLOAT }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEnN") {
+		// keep floats with integral values distinguishable from integers
+		s += ".0"
+	}
+	return s
+}
+func (f *Float) HashKey() HashKey {
+	value := f.Value
+	if value == 0 {
+		value = 0 // -0 and +0 are the same key
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(value)}
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -72,6 +130,21 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+
+	Name     string
+	Filename string
+	Lines    code.LineTable
+
+	// Handlers catch errors raised in the function's try blocks.
+	Handlers code.HandlerTable
+
+	// FreeNames names the variables the function closes over, indexed by
+	// the operand of OpGetFree.
+	FreeNames []string
+
+	// CapturesLocals is set when an inner closure captures one of the
+	// function's locals, whose cells then need closing on return.
+	CapturesLocals bool
 }
 
 func (cf *CompiledFunction) Type() Type { return COMPILED_FUNCTION }
@@ -81,7 +154,7 @@ func (cf *CompiledFunction) Inspect() string {
 
 type Closure struct {
 	Fn   *CompiledFunction
-	Free []Object
+	Free []*Cell
 }
 
 func (c *Closure) Type() Type { return CLOSURE }
@@ -89,6 +162,39 @@ func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
 
+// Cell holds a variable captured by a closure, like an upvalue in Lua.
+// While the frame that defines the variable is live the cell is open and
+// Ref points into that frame's stack slot, so the frame and every closure
+// sharing the cell see the same value. Close moves the value into the cell
+// itself once the frame returns.
+type Cell struct {
+	Ref  *Object
+	Slot int // stack slot of an open cell
+
+	closed Object
+}
+
+// NewClosedCell returns a cell holding value that is not backed by a stack
+// slot.
+func NewClosedCell(value Object) *Cell {
+	c := &Cell{Slot: -1, closed: value}
+	c.Ref = &c.closed
+	return c
+}
+
+func (c *Cell) Type() Type      { return CELL }
+func (c *Cell) Inspect() string { return (*c.Ref).Inspect() }
+func (c *Cell) Get() Object     { return *c.Ref }
+func (c *Cell) Set(value Object) {
+	*c.Ref = value
+}
+
+func (c *Cell) Close() {
+	c.closed = *c.Ref
+	c.Ref = &c.closed
+	c.Slot = -1
+}
+
 type ReturnValue struct {
 	Value Object
 }
@@ -96,28 +202,169 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() Type      { return RETURN_VALUE }
 func (rv *ReturnValue) Inspect() string { return rv.Value.Inspect() }
 
+// Break and Continue unwind the evaluator out of a loop body.
+type Break struct{}
+
+func (b *Break) Type() Type      { return BREAK }
+func (b *Break) Inspect() string { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() Type      { return CONTINUE }
+func (c *Continue) Inspect() string { return "continue" }
+
+// TailCall is a call in tail position. The evaluator hands it back to the
+// enclosing function call, which makes the call in its place, so that tail
+// recursion runs in constant stack depth.
+type TailCall struct {
+	Fn   Object
+	Args []Object
+	Pos  token.Position
+}
+
+func (tc *TailCall) Type() Type      { return TAIL_CALL }
+func (tc *TailCall) Inspect() string { return "tail call" }
+
 type Error struct {
 	Message string
+
+	// Stack lists the calls the error was raised in, innermost first, as
+	// rendered by StackFrame.String.
+	Stack []string
+
+	// Value is the value of the throw statement that raised the error, nil
+	// for errors raised by the runtime.
+	Value Object
+
+	// Pos is where the evaluator raised the error. The virtual machine
+	// leaves it unset and reports lines in its stack trace instead.
+	Pos token.Position
+
+	// Cause is set for errors that stop the program, such as a cancelled
+	// context or ErrInstructionLimit. They cannot be caught.
+	Cause error
 }
 
 func (e *Error) Type() Type      { return ERROR }
 func (e *Error) Inspect() string { return "ERROR: " + e.Message }
 
+// Thrown returns the error raised by throwing value. Throwing a caught
+// exception raises it again with its original message.
+func Thrown(value Object) *Error {
+	if exception, ok := value.(*Exception); ok {
+		return &Error{Message: exception.Message, Value: exception}
+	}
+	return &Error{Message: "uncaught exception: " + value.Inspect(), Value: value}
+}
+
+// Caught returns the value a catch binds for the error: the thrown value,
+// or an Exception describing an error raised by the runtime.
+func (e *Error) Caught() Object {
+	if e.Value != nil {
+		return e.Value
+	}
+	return &Exception{Message: e.Message, Stack: e.Stack}
+}
+
+// Exception is a runtime error caught by a catch block. Unlike an Error it
+// is an ordinary value; scripts read its "message" and "stack" by indexing.
+type Exception struct {
+	Message string
+	Stack   []string
+}
+
+func (e *Exception) Type() Type      { return EXCEPTION }
+func (e *Exception) Inspect() string { return "EXCEPTION: " + e.Message }
+
+// Field returns the "message" or "stack" of an exception.
+func (e *Exception) Field(name string) (Object, bool) {
+	switch name {
+	case "message":
+		return &String{Value: e.Message}, true
+	case "stack":
+		frames := make([]Object, len(e.Stack))
+		for i, frame := range e.Stack {
+			frames[i] = &String{Value: frame}
+		}
+		return &Array{Elements: frames}, true
+	default:
+		return nil, false
+	}
+}
+
+// Config holds the runtime settings of an evaluator or a virtual machine.
+type Config struct {
+	// CheckedArithmetic turns integer overflow of + - * / into a runtime
+	// error instead of promoting the result to a BigInt.
+	CheckedArithmetic bool
+
+	// MaxInstructions stops a program with ErrInstructionLimit once it has
+	// run this many instructions. Zero means no limit.
+	MaxInstructions int64
+
+	// The allocation limits stop a program with ErrAllocationLimit once it
+	// builds an array, hash or string longer than allowed, or once it has
+	// created MaxAllocations arrays, hashes, strings, functions and BigInts
+	// in all. MaxAllocations caps the allocations of a whole run, not the
+	// objects in use at one time: objects that are no longer reachable
+	// still count. MaxStringLength also bounds the bytes of a BigInt.
+	// Results of builtin functions are checked when the builtin returns.
+	// Zero means no limit.
+	MaxArrayLength  int
+	MaxHashSize     int
+	MaxStringLength int
+	MaxAllocations  int64
+
+	// Builtins is the builtin set programs can use, Builtins if nil.
+	// Programs for the virtual machine must be compiled with the same set.
+	Builtins BuiltinSet
+}
+
+// BuiltinSet returns the builtin set of the config.
+func (c *Config) BuiltinSet() BuiltinSet {
+	if c.Builtins == nil {
+		return Builtins
+	}
+	return c.Builtins
+}
+
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store  map[string]Object
+	outer  *Environment
+	config *Config
+	budget *Budget
+	calls  *CallStack
 }
 
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
+	config := &Config{}
 
-	return &Environment{store: s, outer: nil}
+	return &Environment{store: s, outer: nil, config: config, budget: NewBudget(context.Background(), config), calls: newCallStack()}
 }
 
 func NewEnclosedEnvironment(outer *Environment) *Environment {
-	env := NewEnvironment()
-	env.outer = outer
-	return env
+	s := make(map[string]Object)
+
+	return &Environment{store: s, outer: outer, config: outer.config, budget: outer.budget, calls: outer.calls}
+}
+
+// Config returns the settings shared by this environment and all the
+// environments enclosed by it.
+func (e *Environment) Config() *Config {
+	return e.config
+}
+
+// Budget returns the budget shared by this environment and all the
+// environments enclosed by it.
+func (e *Environment) Budget() *Budget {
+	return e.budget
+}
+
+// Calls returns the call stack shared by this environment and all the
+// environments enclosed by it.
+func (e *Environment) Calls() *CallStack {
+	return e.calls
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -133,7 +380,20 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// Assign replaces the value of an existing binding in the innermost
+// environment that defines name. It reports false if name is not bound.
+func (e *Environment) Assign(name string, val Object) bool {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			env.store[name] = val
+			return true
+		}
+	}
+	return false
+}
+
 type Function struct {
+	Name       string
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
@@ -172,12 +432,26 @@ func (s *String) HashKey() HashKey {
 type BuiltinFunction func(args ...Object) Object
 
 type Builtin struct {
-	Fn BuiltinFunction
+	Name string
+	Fn   BuiltinFunction
 }
 
 func (b *Builtin) Type() Type      { return BUILTIN }
 func (b *Builtin) Inspect() string { return "builtin function" }
 
+// Call calls the builtin with args. A panic in the builtin, such as a host
+// function indexing out of range, becomes an error result rather than
+// taking the interpreter down.
+func (b *Builtin) Call(args ...Object) (result Object) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = &Error{Message: fmt.Sprintf("%s panicked: %v", b.Name, r)}
+		}
+	}()
+
+	return b.Fn(args...)
+}
+
 type Array struct {
 	Elements []Object
 }
@@ -212,6 +486,39 @@ type Hash struct {
 	Pairs map[HashKey]HashPair
 }
 
+// Keys returns the keys of the hash in a deterministic order: grouped by
+// type, numbers and strings in ascending order.
+func (h *Hash) Keys() []Object {
+	keys := make([]Object, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		keys = append(keys, pair.Key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	return keys
+}
+
+func keyLess(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *BigInt:
+		return a.Value.Cmp(b.(*BigInt).Value) < 0
+	case *Float:
+		return a.Value < b.(*Float).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	default:
+		return a.Inspect() < b.Inspect()
+	}
+}
+
 func (h *Hash) Type() Type { return HASH }
 func (h *Hash) Inspect() string {
 	var out bytes.Buffer
@@ -228,3 +535,43 @@ func (h *Hash) Inspect() string {
 
 	return out.String()
 }
+
+// Iterator steps through the elements of an array, the characters of a
+// string or the keys of a hash for a for-in loop.
+type Iterator struct {
+	items []Object
+	next  int
+}
+
+// NewIterator returns an iterator over obj, or false if obj is not
+// iterable.
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		return &Iterator{items: obj.Elements}, true
+	case *String:
+		items := make([]Object, 0, len(obj.Value))
+		for _, ch := range obj.Value {
+			items = append(items, &String{Value: string(ch)})
+		}
+		return &Iterator{items: items}, true
+	case *Hash:
+		return &Iterator{items: obj.Keys()}, true
+	default:
+		return nil, false
+	}
+}
+
+func (it *Iterator) Type() Type      { return ITERATOR }
+func (it *Iterator) Inspect() string { return "Iterator" }
+
+// Next returns the next item, or false once the iterator is exhausted.
+func (it *Iterator) Next() (Object, bool) {
+	if it.next >= len(it.items) {
+		return nil, false
+	}
+
+	item := it.items[it.next]
+	it.next++
+	return item, true
+}
@@ -1,6 +1,10 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"math/big"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -55,3 +59,139 @@ func TestBooleanHashKey(t *testing.T) {
 		t.Errorf("boolean with different value have same hash keys")
 	}
 }
+
+func TestFloatHashKey(t *testing.T) {
+	hello1 := &Float{Value: 1.5}
+	hello2 := &Float{Value: 1.5}
+
+	diff1 := &Float{Value: 2.5}
+	diff2 := &Float{Value: 2.5}
+
+	if hello1.HashKey() != hello2.HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+	if diff1.HashKey() != diff2.HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+	if hello1.HashKey() == diff1.HashKey() {
+		t.Errorf("floats with different value have same hash keys")
+	}
+	if (&Float{Value: 0}).HashKey() != (&Float{Value: math.Copysign(0, -1)}).HashKey() {
+		t.Errorf("positive and negative zero have different hash keys")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1.5, "1.5"},
+		{2, "2.0"},
+		{-0.25, "-0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		if got := (&Float{Value: tt.value}).Inspect(); got != tt.expected {
+			t.Errorf("wrong inspect for %v. want=%q, got=%q", tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestBigIntHashKey(t *testing.T) {
+	big1 := &BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 70)}
+	big2 := &BigInt{Value: new(big.Int).Lsh(big.NewInt(1), 70)}
+	neg := &BigInt{Value: new(big.Int).Neg(big1.Value)}
+
+	if big1.HashKey() != big2.HashKey() {
+		t.Errorf("bigints with same value have different hash keys")
+	}
+	if big1.HashKey() == neg.HashKey() {
+		t.Errorf("bigints with different sign have same hash keys")
+	}
+	if (&BigInt{Value: big.NewInt(42)}).HashKey() != (&Integer{Value: 42}).HashKey() {
+		t.Errorf("bigint and integer with same value have different hash keys")
+	}
+}
+
+func TestNewInteger(t *testing.T) {
+	if _, ok := NewInteger(big.NewInt(math.MaxInt64)).(*Integer); !ok {
+		t.Errorf("value in int64 range not demoted to Integer")
+	}
+
+	huge := new(big.Int).Add(big.NewInt(math.MaxInt64), big.NewInt(1))
+	bi, ok := NewInteger(huge).(*BigInt)
+	if !ok {
+		t.Fatalf("value out of int64 range not kept as BigInt")
+	}
+	if bi.Inspect() != "9223372036854775808" {
+		t.Errorf("wrong Inspect. got=%q", bi.Inspect())
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	keys := []Object{
+		&String{Value: "b"},
+		&Integer{Value: 10},
+		&Boolean{Value: true},
+		&Integer{Value: -3},
+		&String{Value: "a"},
+		&Boolean{Value: false},
+	}
+
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, k := range keys {
+		hash.Pairs[k.(Hashable).HashKey()] = HashPair{Key: k, Value: k}
+	}
+
+	expected := []string{"false", "true", "-3", "10", "a", "b"}
+
+	result := hash.Keys()
+	if len(result) != len(expected) {
+		t.Fatalf("wrong number of keys. want=%d, got=%d", len(expected), len(result))
+	}
+	for i, key := range result {
+		if key.Inspect() != expected[i] {
+			t.Errorf("keys[%d] wrong. want=%s, got=%s", i, expected[i], key.Inspect())
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	tests := []struct {
+		iterable Object
+		expected []string
+	}{
+		{&Array{Elements: []Object{&Integer{Value: 1}, &String{Value: "x"}}}, []string{"1", "x"}},
+		{&String{Value: "héllo"}, []string{"h", "é", "l", "l", "o"}},
+		{&Array{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		it, ok := NewIterator(tt.iterable)
+		if !ok {
+			t.Fatalf("NewIterator(%s) not ok", tt.iterable.Inspect())
+		}
+
+		got := []string{}
+		for item, ok := it.Next(); ok; item, ok = it.Next() {
+			got = append(got, item.Inspect())
+		}
+
+		if len(got) != len(tt.expected) {
+			t.Fatalf("wrong number of items for %s. want=%v, got=%v", tt.iterable.Inspect(), tt.expected, got)
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("item %d wrong. want=%s, got=%s", i, tt.expected[i], got[i])
+			}
+		}
+	}
+
+	if _, ok := NewIterator(&Integer{Value: 1}); ok {
+		t.Errorf("NewIterator accepted an INTEGER")
+	}
+}
@@ -0,0 +1,87 @@
+package object
+
+import (
+	"fmt"
+	"github.com/mehrankamal/monkey/token"
+)
+
+// StackFrame describes one active function call at the time of a runtime
+// error.
+type StackFrame struct {
+	Function string
+	Filename string
+	Line     int
+
+	// Builtin marks the frame of a builtin function, which has no location.
+	Builtin bool
+}
+
+func (sf StackFrame) String() string {
+	location := sf.Filename
+	switch {
+	case sf.Builtin:
+		location = "builtin"
+	case location != "" && sf.Line > 0:
+		location = fmt.Sprintf("%s:%d", location, sf.Line)
+	case sf.Line > 0:
+		location = fmt.Sprintf("line %d", sf.Line)
+	case location == "":
+		location = "unknown"
+	}
+
+	return fmt.Sprintf("%s (%s)", sf.Function, location)
+}
+
+// MaxCallDepth is the number of calls, counting the program itself, that
+// either engine can be in at once before it stops with a stack overflow.
+const MaxCallDepth = 1024
+
+// CallStack holds the function calls the evaluator is in, outermost first,
+// starting with the program itself as <main>. Each call records the
+// position of the call it is making in turn.
+type CallStack struct {
+	frames []callFrame
+}
+
+type callFrame struct {
+	function string
+	pos      token.Position
+}
+
+func newCallStack() *CallStack {
+	return &CallStack{frames: []callFrame{{function: "<main>"}}}
+}
+
+// Push enters a call of function.
+func (s *CallStack) Push(function string) {
+	s.frames = append(s.frames, callFrame{function: function})
+}
+
+// Depth returns the number of calls, including <main>.
+func (s *CallStack) Depth() int {
+	return len(s.frames)
+}
+
+// Pop leaves the innermost call.
+func (s *CallStack) Pop() {
+	s.frames = s.frames[:len(s.frames)-1]
+}
+
+// Call records that the innermost call is making a call at pos.
+func (s *CallStack) Call(pos token.Position) {
+	s.frames[len(s.frames)-1].pos = pos
+}
+
+// Trace returns the calls innermost first, for an error raised at pos in
+// the innermost call.
+func (s *CallStack) Trace(pos token.Position) []StackFrame {
+	trace := make([]StackFrame, len(s.frames))
+	for i := range s.frames {
+		frame := s.frames[len(s.frames)-1-i]
+		if i > 0 {
+			pos = frame.pos
+		}
+		trace[i] = StackFrame{Function: frame.function, Filename: pos.Filename, Line: pos.Line}
+	}
+	return trace
+}
@@ -1,11 +1,14 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mehrankamal/monkey/ast"
 	"github.com/mehrankamal/monkey/lexer"
 	"github.com/mehrankamal/monkey/token"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
 type (
@@ -16,26 +19,51 @@ type (
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // = or +=
+	OR          // ||
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
+	BITOR       // |
+	BITXOR      // ^
+	BITAND      // &
+	SHIFT       // << or >>
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
+	POWER       // ** binds tighter than a prefix operator, so -2 ** 2 is -4
 	CALL        // myFunction(X)
 	INDEX       // array[index]
 )
 
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.PERCENT_ASSIGN:  ASSIGN,
+	token.OR:              OR,
+	token.AND:             AND,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LT_EQ:           LESSGREATER,
+	token.GT_EQ:           LESSGREATER,
+	token.BIT_OR:          BITOR,
+	token.BIT_XOR:         BITXOR,
+	token.BIT_AND:         BITAND,
+	token.SHL:             SHIFT,
+	token.SHR:             SHIFT,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	token.POWER:           POWER,
+	token.LPAREN:          CALL,
+	token.LBRACKET:        INDEX,
 }
 
 func (p *Parser) peekPrecedence() int {
@@ -54,20 +82,31 @@ func (p *Parser) currentPrecedence() int {
 	return LOWEST
 }
 
+// Error is a parse error located at the token that caused it.
+type Error struct {
+	Pos     token.Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
+
 type Parser struct {
 	l *lexer.Lexer
 
 	currentToken token.Token
 	peekToken    token.Token
 
-	errors []string
+	errors      []*Error
+	lexerErrors int // number of lexer errors already copied into errors
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: make([]string, 0)}
+	p := &Parser{l: l, errors: make([]*Error, 0)}
 
 	p.nextToken()
 	p.nextToken()
@@ -75,8 +114,10 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefixFunc(token.IDENT, p.parseIdentifier)
 	p.registerPrefixFunc(token.INT, p.parseIntegerLiteral)
+	p.registerPrefixFunc(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefixFunc(token.BANG, p.parsePrefixExpression)
 	p.registerPrefixFunc(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefixFunc(token.BIT_NOT, p.parsePrefixExpression)
 	p.registerPrefixFunc(token.TRUE, p.parseBoolean)
 	p.registerPrefixFunc(token.FALSE, p.parseBoolean)
 	p.registerPrefixFunc(token.LPAREN, p.parseGroupedExpression)
@@ -91,10 +132,27 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfixFunc(token.MINUS, p.parseInfixExpression)
 	p.registerInfixFunc(token.SLASH, p.parseInfixExpression)
 	p.registerInfixFunc(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfixFunc(token.PERCENT, p.parseInfixExpression)
+	p.registerInfixFunc(token.POWER, p.parseInfixExpression)
+	p.registerInfixFunc(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfixFunc(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfixFunc(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfixFunc(token.SHL, p.parseInfixExpression)
+	p.registerInfixFunc(token.SHR, p.parseInfixExpression)
 	p.registerInfixFunc(token.EQ, p.parseInfixExpression)
 	p.registerInfixFunc(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfixFunc(token.LT, p.parseInfixExpression)
 	p.registerInfixFunc(token.GT, p.parseInfixExpression)
+	p.registerInfixFunc(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfixFunc(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfixFunc(token.AND, p.parseInfixExpression)
+	p.registerInfixFunc(token.OR, p.parseInfixExpression)
+	p.registerInfixFunc(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfixFunc(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfixFunc(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfixFunc(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfixFunc(token.SLASH_ASSIGN, p.parseAssignExpression)
+	p.registerInfixFunc(token.PERCENT_ASSIGN, p.parseAssignExpression)
 	p.registerInfixFunc(token.LPAREN, p.parseCallExpression)
 	p.registerInfixFunc(token.LBRACKET, p.parseIndexExpression)
 
@@ -112,6 +170,15 @@ func (p *Parser) registerInfixFunc(tokenType token.TokenType, fn infixParseFn) {
 func (p *Parser) nextToken() {
 	p.currentToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	for p.peekToken.Type == token.COMMENT {
+		p.peekToken = p.l.NextToken()
+	}
+
+	lexerErrors := p.l.Errors()
+	for _, err := range lexerErrors[p.lexerErrors:] {
+		p.errorf(err.Pos, "%s", err.Message)
+	}
+	p.lexerErrors = len(lexerErrors)
 }
 
 func (p *Parser) currentTokenIs(tt token.TokenType) bool {
@@ -179,11 +246,176 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.WHILE:
+		return p.parseWhileStatement()
+	case token.FOR:
+		return p.parseForStatement()
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.TRY:
+		return p.parseTryStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.currentToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseTryStatement() *ast.TryStatement {
+	stmt := &ast.TryStatement{Token: p.currentToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Block = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LPAREN) {
+			return nil
+		}
+
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		stmt.Param = &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
+
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+
+		stmt.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+
+		stmt.Finally = p.parseBlockStatement()
+	}
+
+	if stmt.Catch == nil && stmt.Finally == nil {
+		p.errorf(stmt.Token.Pos, "try without catch or finally")
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	stmt := &ast.WhileStatement{Token: p.currentToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseForStatement() *ast.ForStatement {
+	stmt := &ast.ForStatement{Token: p.currentToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	stmt.Variable = &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseBreakStatement() *ast.BreakStatement {
+	stmt := &ast.BreakStatement{Token: p.currentToken}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
+	stmt := &ast.ContinueStatement{Token: p.currentToken}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpression(precedence int) ast.Expression {
 	prefixFn := p.prefixParseFns[p.currentToken.Type]
 
@@ -232,14 +464,17 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
-func (p *Parser) Errors() []string {
+func (p *Parser) Errors() []*Error {
 	return p.errors
 }
 
+func (p *Parser) errorf(pos token.Position, format string, a ...interface{}) {
+	p.errors = append(p.errors, &Error{Pos: pos, Message: fmt.Sprintf(format, a...)})
+}
+
 func (p *Parser) peekError(tt token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
+	p.errorf(p.peekToken.Pos, "expected next token to be %s, got %s instead",
 		tt, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
 }
 
 func (p *Parser) parseIdentifier() ast.Expression {
@@ -252,10 +487,54 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	exp := &ast.IntegerLiteral{Token: p.currentToken}
 
-	value, err := strconv.ParseInt(p.currentToken.Literal, 0, 64)
+	digits, base := splitIntegerLiteral(p.currentToken.Literal)
+
+	value, err := strconv.ParseInt(digits, base, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if n, ok := new(big.Int).SetString(digits, base); ok {
+			exp.Big = n
+			return exp
+		}
+	}
+	if err != nil {
+		p.errorf(p.currentToken.Pos, "could not parse %q as integer", p.currentToken.Literal)
+		return nil
+	}
+
+	exp.Value = value
+	return exp
+}
+
+// splitIntegerLiteral strips the base prefix and digit separators from an
+// integer literal, returning its digits and base.
+func splitIntegerLiteral(literal string) (string, int) {
+	literal = strings.ReplaceAll(literal, "_", "")
+
+	base := 10
+	if len(literal) > 2 && literal[0] == '0' {
+		switch literal[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		}
+	}
+
+	if base != 10 {
+		literal = literal[2:]
+	}
+
+	return literal, base
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	exp := &ast.FloatLiteral{Token: p.currentToken}
+
+	value, err := strconv.ParseFloat(strings.ReplaceAll(p.currentToken.Literal, "_", ""), 64)
 	if err != nil {
-		msg := fmt.Sprintf("Could not parse %q as integer", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorf(p.currentToken.Pos, "could not parse %q as float", p.currentToken.Literal)
 		return nil
 	}
 
@@ -276,8 +555,11 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 }
 
 func (p *Parser) noPrefixParseFnError(tokenType token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", tokenType)
-	p.errors = append(p.errors, msg)
+	if tokenType == token.ILLEGAL {
+		// already reported by the lexer
+		return
+	}
+	p.errorf(p.currentToken.Pos, "no prefix parse function for %s found", tokenType)
 }
 
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
@@ -288,6 +570,10 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 
 	precedence := p.currentPrecedence()
+	if exp.Operator == "**" {
+		// right-associative: 2 ** 3 ** 2 is 2 ** (3 ** 2)
+		precedence--
+	}
 	p.nextToken()
 
 	exp.Right = p.parseExpression(precedence)
@@ -295,6 +581,28 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	exp := &ast.AssignExpression{
+		Token:    p.currentToken,
+		Target:   target,
+		Operator: p.currentToken.Literal,
+	}
+
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.errorf(p.currentToken.Pos, "invalid assignment target %s", target.String())
+		return nil
+	}
+
+	p.nextToken()
+
+	// right-associative: a = b = c is a = (b = c)
+	exp.Value = p.parseExpression(ASSIGN - 1)
+
+	return exp
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{
 		Token: p.currentToken,
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/mehrankamal/monkey/ast"
 	"github.com/mehrankamal/monkey/lexer"
+	"strings"
 	"testing"
 )
 
@@ -192,6 +193,101 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	assertIntegerLiteral(t, stmt.Expression, 5)
 }
 
+func TestIntegerLiteralBases(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0x1F;", 31},
+		{"0XfF;", 255},
+		{"0o17;", 15},
+		{"0b1010;", 10},
+		{"1_000_000;", 1000000},
+		{"0xFF_FF;", 65535},
+		{"0b1111_0000;", 240},
+		{"017;", 17},
+		{"0x7FFF_FFFF_FFFF_FFFF;", 9223372036854775807},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+		}
+
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %d for %q. got=%d", tt.expected, tt.input, literal.Value)
+		}
+	}
+}
+
+func TestBigIntegerLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775808;", "9223372036854775808"},
+		{"99999999999999999999;", "99999999999999999999"},
+		{"0x1_0000_0000_0000_0000;", "18446744073709551616"},
+		{"0b1" + strings.Repeat("0", 70) + ";", "1180591620717411303424"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+		}
+
+		if literal.Big == nil || literal.Big.String() != tt.expected {
+			t.Errorf("literal.Big not %s for %q. got=%v", tt.expected, tt.input, literal.Big)
+		}
+		if literal.Value != 0 {
+			t.Errorf("literal.Value not 0 for %q. got=%d", tt.input, literal.Value)
+		}
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"1.5;", 1.5},
+		{"2e3;", 2000},
+		{"0.25E-1;", 0.025},
+		{"1_000.5;", 1000.5},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input    string
@@ -200,6 +296,7 @@ func TestParsingPrefixExpressions(t *testing.T) {
 	}{
 		{"!5;", "!", 5},
 		{"-15;", "-", 15},
+		{"~15;", "~", 15},
 		{"!true", "!", true},
 		{"!false", "!", false},
 	}
@@ -252,6 +349,17 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
 		{"5 != 5;", 5, "!=", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 >= 5;", 5, ">=", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 ** 5;", 5, "**", 5},
+		{"5 & 5;", 5, "&", 5},
+		{"5 | 5;", 5, "|", 5},
+		{"5 ^ 5;", 5, "^", 5},
+		{"5 << 5;", 5, "<<", 5},
+		{"5 >> 5;", 5, ">>", 5},
+		{"true && false", true, "&&", false},
+		{"true || false", true, "||", false},
 		{"true == true", true, "==", true},
 		{"true != false", true, "!=", false},
 		{"false == false", false, "==", false},
@@ -391,6 +499,58 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a || b && c == d",
+			"(a || (b && (c == d)))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"a ** b ** c",
+			"(a ** (b ** c))",
+		},
+		{
+			"-a ** b",
+			"(-(a ** b))",
+		},
+		{
+			"a * b ** c",
+			"(a * (b ** c))",
+		},
+		{
+			"a ** -b",
+			"(a ** (-b))",
+		},
+		{
+			"a | b ^ c & d",
+			"(a | (b ^ (c & d)))",
+		},
+		{
+			"a & b << c + d",
+			"(a & (b << (c + d)))",
+		},
+		{
+			"a << b >> c",
+			"((a << b) >> c)",
+		},
+		{
+			"a & b == c | d",
+			"((a & b) == (c | d))",
+		},
+		{
+			"~a & ~b",
+			"((~a) & (~b))",
+		},
 	}
 	for _, tt := range tests {
 		l := lexer.New(tt.input)
@@ -405,6 +565,57 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5;", "(x = 5)"},
+		{"x += y * 2;", "(x += (y * 2))"},
+		{"x -= 1", "(x -= 1)"},
+		{"x *= 1", "(x *= 1)"},
+		{"x /= 1", "(x /= 1)"},
+		{"x %= 1", "(x %= 1)"},
+		{"a = b = c", "(a = (b = c))"},
+		{"arr[i + 1] = v", "((arr[(i + 1)]) = v)"},
+		{"h[\"k\"] += 1", "((h[k]) += 1)"},
+		{"x = y || z", "(x = (y || z))"},
+		{"let x = y = 1;", "let x = (y = 1);"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statement. got=%d",
+				len(program.Statements))
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("x += 1"))
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.AssignExpression. got=%T", stmt.Expression)
+	}
+	if !assertIdentifier(t, exp.Target, "x") {
+		return
+	}
+	if exp.Operator != "+=" {
+		t.Errorf("exp.Operator is not '+='. got=%s", exp.Operator)
+	}
+	assertLiteralExpression(t, exp.Value, 1)
+}
+
 func TestBooleanExpression(t *testing.T) {
 	input := `true;
 false;`
@@ -542,6 +753,189 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < y) { x += 1; continue; break; }`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !assertInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body is not 3 statements. got=%d", len(stmt.Body.Statements))
+	}
+	if _, ok := stmt.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("Statements[1] is not ast.ContinueStatement. got=%T", stmt.Body.Statements[1])
+	}
+	if _, ok := stmt.Body.Statements[2].(*ast.BreakStatement); !ok {
+		t.Errorf("Statements[2] is not ast.BreakStatement. got=%T", stmt.Body.Statements[2])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	input := `for (item in [1, 2]) { item; }; 5`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ForStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !assertIdentifier(t, stmt.Variable, "item") {
+		return
+	}
+	if stmt.Iterable.String() != "[1, 2]" {
+		t.Errorf("stmt.Iterable wrong. got=%s", stmt.Iterable.String())
+	}
+	if stmt.String() != "for (item in [1, 2]) item" {
+		t.Errorf("stmt.String() wrong. got=%q", stmt.String())
+	}
+}
+
+func TestLoopParseErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"while x { }", "1:7: expected next token to be (, got IDENT instead"},
+		{"for (x of y) { }", "1:8: expected next token to be IN, got IDENT instead"},
+		{"for (1 in y) { }", "1:6: expected next token to be IDENT, got INT instead"},
+		{"while (true) x", "1:14: expected next token to be {, got IDENT instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. expected=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
+func TestThrowStatement(t *testing.T) {
+	input := `throw "boom"; throw x + 1`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	expected := []string{`throw boom;`, `throw (x + 1);`}
+	for i, want := range expected {
+		stmt, ok := program.Statements[i].(*ast.ThrowStatement)
+		if !ok {
+			t.Fatalf("program.Statements[%d] is not ast.ThrowStatement. got=%T",
+				i, program.Statements[i])
+		}
+		if stmt.String() != want {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", want, stmt.String())
+		}
+	}
+}
+
+func TestTryStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		param    string
+		catch    bool
+		finally  bool
+		expected string
+	}{
+		{"try { f(); } catch (e) { e; }", "e", true, false, "try f() catch (e) e"},
+		{"try { f(); } finally { g(); }", "", false, true, "try f() finally g()"},
+		{"try { f(); } catch (err) { err; } finally { g(); };", "err", true, true, "try f() catch (err) err finally g()"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statement. got=%d",
+				len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.TryStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.TryStatement. got=%T",
+				program.Statements[0])
+		}
+
+		if (stmt.Catch != nil) != tt.catch {
+			t.Errorf("stmt.Catch wrong for %q. got=%v", tt.input, stmt.Catch)
+		}
+		if tt.catch && !assertIdentifier(t, stmt.Param, tt.param) {
+			return
+		}
+		if (stmt.Finally != nil) != tt.finally {
+			t.Errorf("stmt.Finally wrong for %q. got=%v", tt.input, stmt.Finally)
+		}
+		if stmt.String() != tt.expected {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", tt.expected, stmt.String())
+		}
+	}
+}
+
+func TestTryParseErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"try { f(); }", "1:1: try without catch or finally"},
+		{"try { } catch { }", "1:15: expected next token to be (, got { instead"},
+		{"try { } catch (1) { }", "1:16: expected next token to be IDENT, got INT instead"},
+		{"try f()", "1:5: expected next token to be {, got IDENT instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. expected=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 	l := lexer.New(input)
@@ -1008,3 +1402,130 @@ func assertBoolean(t *testing.T, boolExp ast.Expression, value bool) bool {
 
 	return true
 }
+
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"let x 5;", "1:7: expected next token to be =, got INT instead"},
+		{"let x = 5;\nlet = 10;", "2:5: expected next token to be IDENT, got = instead"},
+		{"let a = 1;\n\n  add(1, 2", "3:11: expected next token to be ), got EOF instead"},
+		{"5 + ;", "1:5: no prefix parse function for ; found"},
+		{"0b102", "1:1: invalid digit '2' in binary literal"},
+		{"0o", "1:1: octal literal has no digits"},
+		{"1__000", "1:1: '_' must separate successive digits in 1__000"},
+		{"1 + 2 = 3", "1:7: invalid assignment target (1 + 2)"},
+		{"let f = fn() {};\nf() += 1", "2:5: invalid assignment target f()"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+
+		if errors[0].Error() != tt.expectedMessage {
+			t.Errorf("wrong error for %q. expected=%q, got=%q",
+				tt.input, tt.expectedMessage, errors[0].Error())
+		}
+	}
+}
+
+func TestParserErrorFilename(t *testing.T) {
+	p := New(lexer.NewWithFilename("let = 1;", "script.mk"))
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+
+	if errors[0].Pos.Filename != "script.mk" {
+		t.Errorf("wrong filename. expected=%q, got=%q", "script.mk", errors[0].Pos.Filename)
+	}
+	if errors[0].Error() != "script.mk:1:5: expected next token to be IDENT, got = instead" {
+		t.Errorf("wrong error message. got=%q", errors[0].Error())
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	input := "let x = 1;\n  x + 2;"
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	if pos := program.Pos(); pos.Line != 1 || pos.Column != 1 {
+		t.Errorf("program position wrong. got=%s", pos)
+	}
+
+	stmt := program.Statements[1].(*ast.ExpressionStatement)
+	if pos := stmt.Pos(); pos.Line != 2 || pos.Column != 3 {
+		t.Errorf("statement position wrong. got=%s", pos)
+	}
+
+	infix := stmt.Expression.(*ast.InfixExpression)
+	if pos := infix.Right.Pos(); pos.Line != 2 || pos.Column != 7 {
+		t.Errorf("right operand position wrong. got=%s", pos)
+	}
+}
+
+func TestCommentsAndLexerErrors(t *testing.T) {
+	l := lexer.New("let x = 1; // one\n/* two */ x;")
+	l.SetKeepComments(true)
+	p := New(l)
+	program := p.ParseProgram()
+	assertNoParserErrors(t, p)
+
+	if program.String() != "let x = 1;x" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+
+	p = New(lexer.New("let x = 1;\n/* oops"))
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) != 1 {
+		t.Fatalf("wrong number of parser errors. want=1, got=%d (%v)", len(errors), errors)
+	}
+	if errors[0].Error() != "2:1: unterminated block comment" {
+		t.Errorf("wrong error. got=%q", errors[0].Error())
+	}
+}
+
+func TestStringLiteralEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"line\none";`, "line\none"},
+		{`"\"quoted\" \u{263A}";`, "\"quoted\" ☺"},
+		{"`{\"raw\": \"\\n\"}`;", `{"raw": "\n"}`},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		assertNoParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		literal, ok := stmt.Expression.(*ast.StringLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.StringLiteral. got=%T", stmt.Expression)
+		}
+
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %q. got=%q", tt.expected, literal.Value)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package monkey
+
+import (
+	"fmt"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/vm"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+var (
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	bigIntType = reflect.TypeOf((*big.Int)(nil))
+)
+
+// ToObject converts a Go value to a Monkey object:
+//
+//   - nil and nil pointers become null
+//   - bools, integers, floats and strings become the matching Monkey values;
+//     unsigned integers too large for an int64 become big integers
+//   - *big.Int becomes an integer
+//   - slices and arrays become arrays
+//   - maps with string keys become hashes
+//   - structs become hashes of their exported fields, named like the field
+//     or by a `monkey:"name"` tag; fields tagged `monkey:"-"` are left out
+//   - funcs become builtins, see Func
+//   - pointers are converted as the value they point to
+//   - object.Object values are returned as is
+//
+// Other types, such as channels and complex numbers, cannot be converted,
+// and neither can values that contain themselves, such as a struct with a
+// pointer to itself.
+func ToObject(v interface{}) (object.Object, error) {
+	if v == nil {
+		return vm.Null, nil
+	}
+	return toObject(reflect.ValueOf(v), map[visit]bool{})
+}
+
+// visit identifies a pointer, map or slice being converted. Slices of the
+// same array with different lengths are different values.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func toObject(v reflect.Value, visiting map[visit]bool) (object.Object, error) {
+	if v.Type().Implements(objectType) {
+		if nillable(v.Kind()) && v.IsNil() {
+			return vm.Null, nil
+		}
+		return v.Interface().(object.Object), nil
+	}
+	if v.Type() == bigIntType {
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		return bigInteger(new(big.Int).Set(v.Interface().(*big.Int))), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			break
+		}
+		key := visit{ptr: v.Pointer(), typ: v.Type()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if visiting[key] {
+			return nil, fmt.Errorf("cannot convert %s to a Monkey value: it contains itself", v.Type())
+		}
+		visiting[key] = true
+		defer delete(visiting, key)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return vm.True, nil
+		}
+		return vm.False, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n > math.MaxInt64 {
+			return &object.BigInt{Value: new(big.Int).SetUint64(n)}, nil
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}, nil
+
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+
+	case reflect.Slice, reflect.Array:
+		elements := make([]object.Object, v.Len())
+		for i := range elements {
+			element, err := toObject(v.Index(i), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			elements[i] = element
+		}
+		return &object.Array{Elements: elements}, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot convert %s to a Monkey value: hash keys must be strings", v.Type())
+		}
+
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, v.Len())}
+		iter := v.MapRange()
+		for iter.Next() {
+			key := &object.String{Value: iter.Key().String()}
+			value, err := toObject(iter.Value(), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.Value, err)
+			}
+			hash.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return hash, nil
+
+	case reflect.Struct:
+		hash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+		for _, field := range fields(v.Type()) {
+			fieldValue, err := v.FieldByIndexErr(field.index)
+			if err != nil {
+				// promoted through a nil embedded pointer
+				continue
+			}
+			value, err := toObject(fieldValue, visiting)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.goName, err)
+			}
+			key := &object.String{Value: field.name}
+			hash.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return hash, nil
+
+	case reflect.Func:
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		return Func(v.Interface())
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return vm.Null, nil
+		}
+		return toObject(v.Elem(), visiting)
+	}
+
+	return nil, fmt.Errorf("cannot convert %s to a Monkey value", v.Type())
+}
+
+func nillable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+// bigInteger returns n as an Integer if it fits in one.
+func bigInteger(n *big.Int) object.Object {
+	if n.IsInt64() {
+		return &object.Integer{Value: n.Int64()}
+	}
+	return &object.BigInt{Value: n}
+}
+
+// FromObject stores the Go value of obj in the value out points to, the
+// reverse of ToObject. Integers fit into any integer or float type they do
+// not overflow, arrays into slices and arrays of the same length, hashes
+// with string keys into maps and structs, and null into pointers, slices,
+// maps and interfaces, which it sets to nil. Into an empty interface obj is
+// stored as a bool, int64, *big.Int, float64, string, []interface{} or
+// map[string]interface{}; functions are stored as the object.Object itself.
+func FromObject(obj object.Object, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("FromObject needs a non-nil pointer, got %T", out)
+	}
+	return fromObject(obj, v.Elem())
+}
+
+func fromObject(obj object.Object, v reflect.Value) error {
+	if obj == nil {
+		obj = vm.Null
+	}
+	if cell, ok := obj.(*object.Cell); ok {
+		obj = cell.Get()
+	}
+
+	t := v.Type()
+
+	if t == objectType || (t.Kind() != reflect.Interface && t.Implements(objectType)) {
+		if reflect.TypeOf(obj).AssignableTo(t) {
+			v.Set(reflect.ValueOf(obj))
+			return nil
+		}
+		return cannotConvert(obj, t)
+	}
+
+	if obj.Type() == object.NULL {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface, reflect.Func:
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		return cannotConvert(obj, t)
+	}
+
+	if t == bigIntType {
+		switch obj := obj.(type) {
+		case *object.Integer:
+			v.Set(reflect.ValueOf(big.NewInt(obj.Value)))
+		case *object.BigInt:
+			v.Set(reflect.ValueOf(new(big.Int).Set(obj.Value)))
+		default:
+			return cannotConvert(obj, t)
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return cannotConvert(obj, t)
+		}
+		value, err := goValue(obj)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+
+	case reflect.Bool:
+		b, ok := obj.(*object.Boolean)
+		if !ok {
+			return cannotConvert(obj, t)
+		}
+		v.SetBool(b.Value)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := integer(obj)
+		if !ok || !n.IsInt64() || v.OverflowInt(n.Int64()) {
+			return cannotConvert(obj, t)
+		}
+		v.SetInt(n.Int64())
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := integer(obj)
+		if !ok || !n.IsUint64() || v.OverflowUint(n.Uint64()) {
+			return cannotConvert(obj, t)
+		}
+		v.SetUint(n.Uint64())
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		switch obj := obj.(type) {
+		case *object.Float:
+			v.SetFloat(obj.Value)
+		case *object.Integer:
+			v.SetFloat(float64(obj.Value))
+		default:
+			return cannotConvert(obj, t)
+		}
+		return nil
+
+	case reflect.String:
+		s, ok := obj.(*object.String)
+		if !ok {
+			return cannotConvert(obj, t)
+		}
+		v.SetString(s.Value)
+		return nil
+
+	case reflect.Slice, reflect.Array:
+		array, ok := obj.(*object.Array)
+		if !ok {
+			return cannotConvert(obj, t)
+		}
+
+		if t.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(t, len(array.Elements), len(array.Elements)))
+		} else if len(array.Elements) != t.Len() {
+			return fmt.Errorf("cannot convert ARRAY of %d elements to %s", len(array.Elements), t)
+		}
+
+		for i, element := range array.Elements {
+			if err := fromObject(element, v.Index(i)); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		hash, ok := obj.(*object.Hash)
+		if !ok || t.Key().Kind() != reflect.String {
+			return cannotConvert(obj, t)
+		}
+
+		m := reflect.MakeMapWithSize(t, len(hash.Pairs))
+		for _, key := range hash.Keys() {
+			s, ok := key.(*object.String)
+			if !ok {
+				return fmt.Errorf("cannot convert HASH with %s keys to %s", key.Type(), t)
+			}
+
+			value := reflect.New(t.Elem()).Elem()
+			if err := fromObject(hash.Pairs[s.HashKey()].Value, value); err != nil {
+				return fmt.Errorf("key %q: %w", s.Value, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(s.Value).Convert(t.Key()), value)
+		}
+		v.Set(m)
+		return nil
+
+	case reflect.Struct:
+		hash, ok := obj.(*object.Hash)
+		if !ok {
+			return cannotConvert(obj, t)
+		}
+
+		for _, field := range fields(t) {
+			pair, ok := hash.Pairs[(&object.String{Value: field.name}).HashKey()]
+			if !ok {
+				continue
+			}
+			fieldValue, err := settableField(v, field.index)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", field.goName, err)
+			}
+			if err := fromObject(pair.Value, fieldValue); err != nil {
+				return fmt.Errorf("field %s: %w", field.goName, err)
+			}
+		}
+		return nil
+
+	case reflect.Pointer:
+		value := reflect.New(t.Elem())
+		if err := fromObject(obj, value.Elem()); err != nil {
+			return err
+		}
+		v.Set(value)
+		return nil
+	}
+
+	return cannotConvert(obj, t)
+}
+
+// goValue returns the value of obj stored into an empty interface.
+func goValue(obj object.Object) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *object.Null:
+		return nil, nil
+	case *object.Boolean:
+		return obj.Value, nil
+	case *object.Integer:
+		return obj.Value, nil
+	case *object.BigInt:
+		return new(big.Int).Set(obj.Value), nil
+	case *object.Float:
+		return obj.Value, nil
+	case *object.String:
+		return obj.Value, nil
+	case *object.Array:
+		var elements []interface{}
+		err := fromObject(obj, reflect.ValueOf(&elements).Elem())
+		return elements, err
+	case *object.Hash:
+		var m map[string]interface{}
+		err := fromObject(obj, reflect.ValueOf(&m).Elem())
+		return m, err
+	case *object.Closure, *object.Builtin, *object.Function:
+		return obj, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to a Go value", obj.Type())
+}
+
+func integer(obj object.Object) (*big.Int, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return big.NewInt(obj.Value), true
+	case *object.BigInt:
+		return obj.Value, true
+	}
+	return nil, false
+}
+
+func cannotConvert(obj object.Object, t reflect.Type) error {
+	return fmt.Errorf("cannot convert %s to %s", obj.Type(), t)
+}
+
+type field struct {
+	name   string // the hash key
+	goName string
+	index  []int
+}
+
+// settableField returns the field of struct v at index, allocating the
+// embedded structs it is promoted through whose pointers are nil.
+func settableField(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot allocate unexported embedded %s", v.Type())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// fields returns the exported fields of struct type t that are converted.
+func fields(t reflect.Type) []field {
+	var fields []field
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("monkey"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		fields = append(fields, field{name: name, goName: f.Name, index: f.Index})
+	}
+	return fields
+}
+
+// Func wraps the Go function fn as a builtin. Its arguments are converted
+// with FromObject and its result with ToObject. fn may return nothing, one
+// value, an error, or a value and an error; a non-nil error is raised as a
+// runtime error. Calls with the wrong number of arguments, or arguments
+// that do not convert to the parameter types, are runtime errors too.
+func Func(fn interface{}) (*object.Builtin, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("Func needs a function, got %T", fn)
+	}
+
+	t := v.Type()
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	if t.NumOut() > 2 || (t.NumOut() == 2 && !returnsError) {
+		return nil, fmt.Errorf("cannot convert %s to a Monkey value: it must return at most a value and an error", t)
+	}
+
+	call := func(args ...object.Object) object.Object {
+		in, err := funcArguments(t, args)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+
+		out := v.Call(in)
+
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return &object.Error{Message: err.Error(), Cause: haltCause(err)}
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return nil
+		}
+
+		result, err := toObject(out[0], map[visit]bool{})
+		if err != nil {
+			return &object.Error{Message: "result: " + err.Error()}
+		}
+		return result
+	}
+
+	return &object.Builtin{Fn: call}, nil
+}
+
+// funcArguments converts args to the parameters of function type t.
+func funcArguments(t reflect.Type, args []object.Object) ([]reflect.Value, error) {
+	params := t.NumIn()
+	if t.IsVariadic() {
+		if len(args) < params-1 {
+			return nil, fmt.Errorf("wrong number of arguments. got=%d, want at least %d", len(args), params-1)
+		}
+	} else if len(args) != params {
+		return nil, fmt.Errorf("wrong number of arguments. got=%d, want=%d", len(args), params)
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var paramType reflect.Type
+		if t.IsVariadic() && i >= params-1 {
+			paramType = t.In(params - 1).Elem()
+		} else {
+			paramType = t.In(i)
+		}
+
+		in[i] = reflect.New(paramType).Elem()
+		if err := fromObject(arg, in[i]); err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+	}
+	return in, nil
+}
+
+// Bind converts v with ToObject and assigns it to the global variable
+// name. Functions become builtins called name.
+func (in *Interpreter) Bind(name string, v interface{}) error {
+	obj, err := ToObject(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if builtin, ok := obj.(*object.Builtin); ok && builtin.Name == "" {
+		builtin.Name = name
+	}
+	in.Set(name, obj)
+	return nil
+}
+
+// CallValue is like Call, but converts args with ToObject and stores the
+// result in the value out points to with FromObject. out may be nil to
+// discard the result.
+func (in *Interpreter) CallValue(fn object.Object, out interface{}, args ...interface{}) error {
+	objects := make([]object.Object, len(args))
+	for i, arg := range args {
+		obj, err := ToObject(arg)
+		if err != nil {
+			return fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		objects[i] = obj
+	}
+
+	result, err := in.Call(fn, objects...)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return FromObject(result, out)
+}
@@ -0,0 +1,328 @@
+package monkey
+
+import (
+	"errors"
+	"github.com/mehrankamal/monkey/object"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	City string
+	Zip  int `monkey:"zip"`
+}
+
+type person struct {
+	Name    string
+	Age     int
+	Tags    []string
+	Home    *address
+	Secret  string `monkey:"-"`
+	private int
+}
+
+type Inner struct {
+	A int
+}
+
+type hidden struct {
+	A int
+}
+
+type node struct {
+	Value int
+	Next  *node
+}
+
+func TestToObject(t *testing.T) {
+	shared := &address{City: "Oslo"}
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-5), "-5"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{1.5, "1.5"},
+		{"monkey", `"monkey"`},
+		{big.NewInt(42), "42"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{[]interface{}{1, "a", nil}, `[1, "a", null]`},
+		{map[string]int{"b": 2, "a": 1}, `{"a": 1, "b": 2}`},
+		{(*address)(nil), "null"},
+		{person{Name: "Ann", Age: 30, Tags: []string{"x"}, Home: &address{City: "Oslo", Zip: 150}, Secret: "s"},
+			`{"Age": 30, "Home": {"City": "Oslo", "zip": 150}, "Name": "Ann", "Tags": ["x"]}`},
+		{&object.Integer{Value: 7}, "7"},
+		{[]*address{shared, shared}, `[{"City": "Oslo", "zip": 0}, {"City": "Oslo", "zip": 0}]`},
+		{&node{Value: 1, Next: &node{Value: 2}}, `{"Next": {"Next": null, "Value": 2}, "Value": 1}`},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Fatalf("ToObject(%#v) error: %s", tt.input, err)
+		}
+		if got := inspect(obj); got != tt.expected {
+			t.Errorf("wrong object for %#v. want=%s, got=%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestToObjectErrors(t *testing.T) {
+	loop := &node{Value: 1}
+	loop.Next = &node{Value: 2, Next: loop}
+
+	hash := map[string]interface{}{}
+	hash["self"] = hash
+
+	list := []interface{}{1, nil}
+	list[1] = list
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{make(chan int), "cannot convert chan int to a Monkey value"},
+		{complex(1, 2), "cannot convert complex128 to a Monkey value"},
+		{map[int]string{}, "cannot convert map[int]string to a Monkey value: hash keys must be strings"},
+		{[]interface{}{1, make(chan int)}, "element 1: cannot convert chan int to a Monkey value"},
+		{struct{ C chan int }{}, "field C: cannot convert chan int to a Monkey value"},
+		{func() (int, int) { return 0, 0 }, "cannot convert func() (int, int) to a Monkey value: it must return at most a value and an error"},
+		{loop, "field Next: field Next: cannot convert *monkey.node to a Monkey value: it contains itself"},
+		{hash, `key "self": cannot convert map[string]interface {} to a Monkey value: it contains itself`},
+		{list, "element 1: cannot convert []interface {} to a Monkey value: it contains itself"},
+	}
+
+	for _, tt := range tests {
+		_, err := ToObject(tt.input)
+		if err == nil {
+			t.Errorf("expected error for %T, got none", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %T. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	in := New()
+
+	var p person
+	evalInto(t, in, `{"Name": "Ann", "Age": 30, "Tags": ["x", "y"], "Home": {"City": "Oslo", "zip": 150}, "Secret": "s"}`, &p)
+	expected := person{Name: "Ann", Age: 30, Tags: []string{"x", "y"}, Home: &address{City: "Oslo", Zip: 150}}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("wrong struct. want=%+v, got=%+v", expected, p)
+	}
+
+	var m map[string][]float64
+	evalInto(t, in, `{"a": [1, 2.5], "b": []}`, &m)
+	if !reflect.DeepEqual(m, map[string][]float64{"a": {1, 2.5}, "b": {}}) {
+		t.Errorf("wrong map. got=%v", m)
+	}
+
+	var any interface{}
+	evalInto(t, in, `[1, "a", true, if (false) { 1 }, {"k": [2]}, 2 ** 70]`, &any)
+	two70, _ := new(big.Int).SetString("1180591620717411303424", 10)
+	expectedAny := []interface{}{int64(1), "a", true, nil, map[string]interface{}{"k": []interface{}{int64(2)}}, two70}
+	if !reflect.DeepEqual(any, expectedAny) {
+		t.Errorf("wrong value. want=%#v, got=%#v", expectedAny, any)
+	}
+
+	var u uint8
+	evalInto(t, in, "255", &u)
+	if u != 255 {
+		t.Errorf("wrong uint8. got=%d", u)
+	}
+
+	var fn object.Object
+	evalInto(t, in, "fn(x) { x }", &fn)
+	if _, ok := fn.(*object.Closure); !ok {
+		t.Errorf("fn is not Closure. got=%T", fn)
+	}
+
+	var outer struct {
+		*Inner
+		B int
+	}
+	evalInto(t, in, `{"A": 1, "B": 2}`, &outer)
+	if outer.Inner == nil || outer.A != 1 || outer.B != 2 {
+		t.Errorf("wrong embedded struct. got=%+v", outer)
+	}
+
+	ptr := &address{}
+	evalInto(t, in, "if (false) { 1 }", &ptr)
+	if ptr != nil {
+		t.Errorf("expected nil pointer, got %+v", ptr)
+	}
+}
+
+func TestFromObjectErrors(t *testing.T) {
+	in := New()
+
+	tests := []struct {
+		input    string
+		out      interface{}
+		expected string
+	}{
+		{`"a"`, new(int), "cannot convert STRING to int"},
+		{"256", new(uint8), "cannot convert INTEGER to uint8"},
+		{"-1", new(uint), "cannot convert INTEGER to uint"},
+		{"2 ** 64", new(int64), "cannot convert BIGINT to int64"},
+		{"if (false) { 1 }", new(string), "cannot convert NULL to string"},
+		{`[1, "b"]`, new([]int), "element 1: cannot convert STRING to int"},
+		{"[1, 2]", new([3]int), "cannot convert ARRAY of 2 elements to [3]int"},
+		{`{1: 2}`, new(map[string]int), "cannot convert HASH with INTEGER keys to map[string]int"},
+		{`{"Home": {"zip": "x"}}`, new(person), "field Home: field Zip: cannot convert STRING to int"},
+		{"1", new(error), "cannot convert INTEGER to error"},
+		{"1", new(*object.String), "cannot convert INTEGER to *object.String"},
+		{`{"A": 1}`, new(struct{ *hidden }), "field A: cannot allocate unexported embedded *monkey.hidden"},
+	}
+
+	for _, tt := range tests {
+		obj, err := in.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error for %q: %s", tt.input, err)
+		}
+
+		err = FromObject(obj, tt.out)
+		if err == nil {
+			t.Errorf("expected error for %q into %T, got none", tt.input, tt.out)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q into %T. want=%q, got=%q", tt.input, tt.out, tt.expected, err)
+		}
+	}
+
+	if err := FromObject(&object.Integer{}, 0); err == nil || !strings.Contains(err.Error(), "non-nil pointer") {
+		t.Errorf("expected an error for a non-pointer, got %v", err)
+	}
+}
+
+func TestBindFunc(t *testing.T) {
+	in := New()
+
+	bindings := map[string]interface{}{
+		"greet": func(p person) string { return "hi " + p.Name },
+		"sum": func(xs ...int) int {
+			total := 0
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		},
+		"half": func(n int) (int, error) {
+			if n%2 != 0 {
+				return 0, errors.New("odd number")
+			}
+			return n / 2, nil
+		},
+		"noop":   func() {},
+		"pick":   func(xs []int) int { return xs[5] },
+		"config": map[string]interface{}{"debug": true, "level": 3},
+	}
+	for name, v := range bindings {
+		if err := in.Bind(name, v); err != nil {
+			t.Fatalf("bind %s: %s", name, err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`greet({"Name": "Ann"})`, "hi Ann"},
+		{"sum()", "0"},
+		{"sum(1, 2, 3)", "6"},
+		{"half(8)", "4"},
+		{"noop()", "null"},
+		{`config["level"] + 1`, "4"},
+		{`let r = ""; try { half(3) } catch (e) { r = e["message"] }; r`, "odd number"},
+		{`let r = ""; try { half("x") } catch (e) { r = e["message"] }; r`, "argument 1: cannot convert STRING to int"},
+		{`let r = ""; try { half() } catch (e) { r = e["message"] }; r`, "wrong number of arguments. got=0, want=1"},
+		{`let r = ""; try { pick([1]) } catch (e) { r = e["message"] }; r`,
+			"pick panicked: runtime error: index out of range [5] with length 1"},
+	}
+
+	for _, tt := range tests {
+		result, err := in.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error for %q: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, result.Inspect())
+		}
+	}
+
+	_, err := in.Eval("half(3)")
+	if err == nil || !strings.Contains(err.Error(), "odd number") {
+		t.Errorf("expected a runtime error from half, got %v", err)
+	}
+
+	if err := in.Bind("bad", make(chan int)); err == nil || err.Error() != "bad: cannot convert chan int to a Monkey value" {
+		t.Errorf("wrong bind error. got=%v", err)
+	}
+}
+
+func TestCallValue(t *testing.T) {
+	in := New()
+	fn, err := in.Eval(`fn(p, n) { {"Name": p["Name"] + "!", "Age": p["Age"] + n} }`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	var p person
+	if err := in.CallValue(fn, &p, person{Name: "Bo", Age: 1}, 2); err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	if p.Name != "Bo!" || p.Age != 3 {
+		t.Errorf("wrong result. got=%+v", p)
+	}
+
+	err = in.CallValue(fn, nil, make(chan int), 1)
+	if err == nil || err.Error() != "argument 1: cannot convert chan int to a Monkey value" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func evalInto(t *testing.T, in *Interpreter, input string, out interface{}) {
+	t.Helper()
+
+	obj, err := in.Eval(input)
+	if err != nil {
+		t.Fatalf("eval error for %q: %s", input, err)
+	}
+	if err := FromObject(obj, out); err != nil {
+		t.Fatalf("FromObject error for %q: %s", input, err)
+	}
+}
+
+// inspect is like Inspect, but prints hash pairs in key order.
+func inspect(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.Array:
+		elements := make([]string, len(obj.Elements))
+		for i, element := range obj.Elements {
+			elements[i] = inspect(element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.Hash:
+		pairs := []string{}
+		for _, key := range obj.Keys() {
+			pairs = append(pairs, inspect(key)+": "+inspect(obj.Pairs[key.(object.Hashable).HashKey()].Value))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case *object.String:
+		return strconv.Quote(obj.Value)
+	default:
+		return obj.Inspect()
+	}
+}
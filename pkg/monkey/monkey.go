@@ -0,0 +1,210 @@
+// Package monkey embeds the Monkey interpreter in Go programs.
+//
+// An Interpreter keeps its globals between calls to Eval, and Go code can
+// add its own functions and values to them:
+//
+//	in := monkey.New()
+//	in.Register("twice", func(args ...object.Object) object.Object {
+//		n := args[0].(*object.Integer)
+//		return &object.Integer{Value: 2 * n.Value}
+//	})
+//	in.Eval(`let add = fn(a, b) { twice(a) + b };`)
+//
+//	add, _ := in.Get("add")
+//	sum, err := in.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+package monkey
+
+import (
+	"context"
+	"errors"
+	"github.com/mehrankamal/monkey/ast"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/lexer"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/parser"
+	"github.com/mehrankamal/monkey/vm"
+	"strings"
+)
+
+// Interpreter compiles and runs Monkey programs on the VM. Programs
+// evaluated by the same interpreter share their global variables.
+// An Interpreter must not be used from several goroutines at once.
+type Interpreter struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+	builtins    object.BuiltinSet
+	config      object.Config
+
+	// running is the machine of the program or call in progress, on which
+	// calls made from builtins run
+	running *vm.VirtualMachine
+}
+
+// New returns an interpreter whose globals are the builtins of
+// object.Builtins.
+func New() *Interpreter {
+	return NewWithBuiltins(object.Builtins)
+}
+
+// NewWithBuiltins returns an interpreter whose globals are the builtins of
+// set. Programs can use no other builtins, so a set such as
+// object.PureBuiltins() or one made by object.NewBuiltins with writers and
+// a file system of the host's choosing limits what they can do.
+func NewWithBuiltins(set object.BuiltinSet) *Interpreter {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(set)
+
+	return &Interpreter{
+		symbolTable: symbolTable,
+		constants:   []object.Object{},
+		globals:     make([]object.Object, vm.GlobalsSize),
+		builtins:    set,
+	}
+}
+
+// Config returns the runtime settings programs run with. Its Builtins are
+// ignored in favour of the set the interpreter was created with.
+func (in *Interpreter) Config() *object.Config {
+	return &in.config
+}
+
+// Register defines the global function name, which calls fn. Returning an
+// *object.Error from fn raises it as a runtime error, and returning nil
+// returns null.
+func (in *Interpreter) Register(name string, fn object.BuiltinFunction) {
+	in.Set(name, &object.Builtin{Name: name, Fn: fn})
+}
+
+// Set assigns value to the global variable name, defining it if needed.
+// Names that are not Monkey identifiers cannot be referred to by programs.
+func (in *Interpreter) Set(name string, value object.Object) {
+	symbol, ok := in.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = in.symbolTable.Define(name)
+	}
+	in.globals[symbol.Index] = value
+}
+
+// Get returns the value of the global variable or builtin name.
+func (in *Interpreter) Get(name string) (object.Object, bool) {
+	symbol, ok := in.symbolTable.Resolve(name)
+	if !ok {
+		return nil, false
+	}
+
+	switch symbol.Scope {
+	case compiler.GlobalScope:
+		value := in.globals[symbol.Index]
+		return value, value != nil
+	case compiler.BuiltinScope:
+		return in.builtins[symbol.Index].Builtin, true
+	default:
+		return nil, false
+	}
+}
+
+// Eval runs source and returns the value of its final statement if that is
+// an expression, or null. Parse errors are returned as *ParseError, compile
+// errors as *compiler.Error and runtime errors as *vm.RuntimeError.
+func (in *Interpreter) Eval(source string) (object.Object, error) {
+	return in.EvalContext(context.Background(), source)
+}
+
+// EvalContext is like Eval, but also stops once ctx is done. Stopped
+// programs, including those that exceed the instruction or allocation
+// limits of Config(), return a *vm.RuntimeError that wraps the error of
+// ctx, object.ErrInstructionLimit or object.ErrAllocationLimit.
+func (in *Interpreter) EvalContext(ctx context.Context, source string) (object.Object, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	comp := compiler.NewWithState(in.symbolTable, in.constants)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := comp.Bytecode()
+	in.constants = bc.Constants
+
+	machine := in.machine(bc)
+	defer in.enter(machine)()
+	err = machine.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !endsInExpression(program) {
+		return vm.Null, nil
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Call calls fn, a Monkey function or a builtin, with args and returns its
+// result. Runtime errors are returned as *vm.RuntimeError. Calls made from
+// a builtin while a program runs count against the limits of that program.
+func (in *Interpreter) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	return in.CallContext(context.Background(), fn, args...)
+}
+
+// CallContext is like Call, but stops like EvalContext.
+func (in *Interpreter) CallContext(ctx context.Context, fn object.Object, args ...object.Object) (object.Object, error) {
+	if in.running != nil {
+		return in.running.CallContext(ctx, fn, args...)
+	}
+
+	machine := in.machine(&compiler.Bytecode{Constants: in.constants})
+	defer in.enter(machine)()
+	return machine.CallContext(ctx, fn, args...)
+}
+
+// haltCause returns the cause of err if it is the error of a program that
+// was stopped, so that returning it from a builtin stops the calling
+// program as well.
+func haltCause(err error) error {
+	var runtimeErr *vm.RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return runtimeErr.Cause
+	}
+	return nil
+}
+
+// enter makes machine the running machine until the returned function is
+// called.
+func (in *Interpreter) enter(machine *vm.VirtualMachine) (leave func()) {
+	outer := in.running
+	in.running = machine
+	return func() { in.running = outer }
+}
+
+func endsInExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+func (in *Interpreter) machine(bc *compiler.Bytecode) *vm.VirtualMachine {
+	machine := vm.NewWithGlobalsStore(bc, in.globals)
+	*machine.Config() = in.config
+	machine.Config().Builtins = in.builtins
+	return machine
+}
+
+// ParseError holds the errors found parsing a program.
+type ParseError struct {
+	Errors []*parser.Error
+}
+
+func (e *ParseError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
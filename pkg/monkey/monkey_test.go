@@ -0,0 +1,367 @@
+package monkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/vm"
+	"testing"
+	"time"
+)
+
+func TestEvalKeepsGlobals(t *testing.T) {
+	in := New()
+
+	inputs := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = 1;", "null"},
+		{"let inc = fn(n) { n + a };", "null"},
+		{"a = 10; inc(5)", "15"},
+		{`len("four")`, "4"},
+	}
+
+	for _, tt := range inputs {
+		result, err := in.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("eval error for %q: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	in := New()
+
+	var seen []int64
+	in.Register("record", func(args ...object.Object) object.Object {
+		for _, arg := range args {
+			seen = append(seen, arg.(*object.Integer).Value)
+		}
+		return &object.Integer{Value: int64(len(seen))}
+	})
+	in.Register("fail", func(args ...object.Object) object.Object {
+		return &object.Error{Message: "failed on purpose"}
+	})
+	in.Set("limit", &object.Integer{Value: 3})
+
+	result, err := in.Eval("for (i in [1, 2, 3, 4]) { if (i > limit) { break } record(i) }; record(limit)")
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "4" {
+		t.Errorf("wrong result. want=4, got=%s", result.Inspect())
+	}
+	if len(seen) != 4 || seen[0] != 1 || seen[3] != 3 {
+		t.Errorf("wrong arguments recorded. got=%v", seen)
+	}
+
+	result, err = in.Eval(`let r = ""; try { fail() } catch (e) { r = e["message"] }; r`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "failed on purpose" {
+		t.Errorf("wrong result. want=%q, got=%q", "failed on purpose", result.Inspect())
+	}
+
+	_, err = in.Eval("fail()")
+	var runtimeErr *vm.RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected *vm.RuntimeError, got=%T (%v)", err, err)
+	}
+	if runtimeErr.Builtin != "fail" {
+		t.Errorf("wrong builtin. want=%q, got=%q", "fail", runtimeErr.Builtin)
+	}
+}
+
+func TestRegisterIsPerInterpreter(t *testing.T) {
+	first, second := New(), New()
+	first.Set("x", &object.Integer{Value: 1})
+
+	if _, ok := second.Get("x"); ok {
+		t.Errorf("x is defined in another interpreter")
+	}
+	if _, err := second.Eval("x"); err == nil {
+		t.Errorf("expected an error evaluating x, got none")
+	}
+}
+
+func TestSetReplacesGlobal(t *testing.T) {
+	in := New()
+
+	if _, err := in.Eval("let x = 1; let f = fn() { x };"); err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	in.Set("x", &object.Integer{Value: 2})
+
+	result, err := in.Eval("f()")
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "2" {
+		t.Errorf("wrong result. want=2, got=%s", result.Inspect())
+	}
+}
+
+func TestGet(t *testing.T) {
+	in := New()
+	if _, err := in.Eval(`let name = "monkey"; let f = fn() { let local = 1; local };`); err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"name", "monkey", true},
+		{"f", "Closure", true},
+		{"len", "builtin function", true},
+		{"local", "", false},
+		{"missing", "", false},
+	}
+
+	for _, tt := range tests {
+		value, ok := in.Get(tt.name)
+		if ok != tt.found {
+			t.Errorf("wrong found for %q. want=%t, got=%t", tt.name, tt.found, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if tt.name == "f" {
+			if _, isClosure := value.(*object.Closure); !isClosure {
+				t.Errorf("f is not Closure. got=%T", value)
+			}
+			continue
+		}
+		if value.Inspect() != tt.expected {
+			t.Errorf("wrong value for %q. want=%q, got=%q", tt.name, tt.expected, value.Inspect())
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	in := New()
+	in.Register("apply", func(args ...object.Object) object.Object {
+		// call back into Monkey while the program is running
+		result, err := in.Call(args[0], args[1:]...)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		return result
+	})
+
+	_, err := in.Eval(`
+let base = 100;
+let add = fn(a, b) { a + b + base };
+let counter = fn() { let n = 0; fn() { n += 1 } }();
+let boom = fn() { throw "boom" };
+`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	add, _ := in.Get("add")
+	result, err := in.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	if err != nil {
+		t.Fatalf("call error: %s", err)
+	}
+	if result.Inspect() != "103" {
+		t.Errorf("wrong result. want=103, got=%s", result.Inspect())
+	}
+
+	counter, _ := in.Get("counter")
+	for i := 1; i <= 3; i++ {
+		result, err := in.Call(counter)
+		if err != nil {
+			t.Fatalf("call error: %s", err)
+		}
+		if result.Inspect() != string(rune('0'+i)) {
+			t.Errorf("wrong count. want=%d, got=%s", i, result.Inspect())
+		}
+	}
+
+	result, err = in.Eval("apply(add, 5, 6)")
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "111" {
+		t.Errorf("wrong result. want=111, got=%s", result.Inspect())
+	}
+
+	boom, _ := in.Get("boom")
+	_, err = in.Call(boom)
+	if err == nil || err.Error() != "uncaught exception: boom" {
+		t.Errorf("wrong error. want=%q, got=%v", "uncaught exception: boom", err)
+	}
+
+	_, err = in.Call(add)
+	if err == nil || err.Error() != "wrong number of arguments: want=2, got=0" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	in := New()
+
+	_, err := in.Eval("let = 1;")
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("expected *ParseError, got=%T (%v)", err, err)
+	}
+
+	_, err = in.Eval("undefined")
+	if _, ok := err.(*compiler.Error); !ok {
+		t.Errorf("expected *compiler.Error, got=%T (%v)", err, err)
+	}
+
+	_, err = in.Eval("1 / 0")
+	if _, ok := err.(*vm.RuntimeError); !ok {
+		t.Errorf("expected *vm.RuntimeError, got=%T (%v)", err, err)
+	}
+
+	// the interpreter stays usable after errors
+	result, err := in.Eval("1 + 1")
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "2" {
+		t.Errorf("wrong result. want=2, got=%s", result.Inspect())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	in := New()
+	in.Config().CheckedArithmetic = true
+
+	_, err := in.Eval("9223372036854775807 + 1")
+	if err == nil {
+		t.Errorf("expected an overflow error, got none")
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	in := New()
+	in.Config().MaxInstructions = 10000
+
+	_, err := in.Eval("let spin = fn() { while (true) { } }; spin()")
+	if !errors.Is(err, object.ErrInstructionLimit) {
+		t.Errorf("expected the instruction limit to stop the program, got %v", err)
+	}
+
+	spin, _ := in.Get("spin")
+	_, err = in.Call(spin)
+	if !errors.Is(err, object.ErrInstructionLimit) {
+		t.Errorf("expected the instruction limit to stop the call, got %v", err)
+	}
+
+	in.Config().MaxInstructions = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = in.EvalContext(ctx, "spin()")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the program, got %v", err)
+	}
+
+	_, err = in.CallContext(ctx, spin)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the call, got %v", err)
+	}
+}
+
+func TestAllocationLimits(t *testing.T) {
+	in := New()
+	in.Config().MaxArrayLength = 1000
+	in.Register("numbers", func(args ...object.Object) object.Object {
+		n := args[0].(*object.Integer).Value
+		elements := make([]object.Object, n)
+		for i := range elements {
+			elements[i] = &object.Integer{Value: int64(i)}
+		}
+		return &object.Array{Elements: elements}
+	})
+
+	result, err := in.Eval("len(numbers(1000))")
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "1000" {
+		t.Errorf("wrong result. want=1000, got=%s", result.Inspect())
+	}
+
+	_, err = in.Eval("try { numbers(1001) } catch (e) { 0 }")
+	if !errors.Is(err, object.ErrAllocationLimit) {
+		t.Fatalf("expected an allocation limit to stop the program, got %v", err)
+	}
+	if err.Error() != "allocation limit exceeded: array of 1001 elements, limit 1000" {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
+
+func TestNewWithBuiltins(t *testing.T) {
+	var stdout bytes.Buffer
+	in := NewWithBuiltins(object.NewBuiltins(object.Host{Stdout: &stdout}))
+
+	result, err := in.Eval(`let name = "monkey"; puts("hello " + name); len(name)`)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if result.Inspect() != "6" {
+		t.Errorf("wrong result. want=6, got=%s", result.Inspect())
+	}
+	if stdout.String() != "hello monkey\n" {
+		t.Errorf("wrong output. got=%q", stdout.String())
+	}
+
+	if builtin, ok := in.Get("puts"); !ok || builtin.Type() != object.BUILTIN {
+		t.Errorf("puts is not a builtin global")
+	}
+
+	pure := NewWithBuiltins(object.PureBuiltins())
+	if _, err := pure.Eval(`puts("hello")`); err == nil {
+		t.Errorf("expected puts to be undefined with pure builtins")
+	}
+	if _, ok := pure.Get("puts"); ok {
+		t.Errorf("pure interpreter has puts")
+	}
+}
+
+func TestCallFromBuiltinSharesLimits(t *testing.T) {
+	in := New()
+	in.Config().MaxInstructions = 1000
+	if err := in.Bind("repeat", func(fn object.Object, n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := in.Call(fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("bind error: %s", err)
+	}
+
+	spin := "fn() { let n = 0; while (n < 10) { n += 1 } }"
+	if _, err := in.Eval("repeat(" + spin + ", 2)"); err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+
+	_, err := in.Eval("try { repeat(" + spin + ", 100) } catch (e) { 0 }")
+	if !errors.Is(err, object.ErrInstructionLimit) {
+		t.Errorf("expected the instruction limit to stop the calls, got %v", err)
+	}
+
+	fn, err := in.Eval(spin)
+	if err != nil {
+		t.Fatalf("eval error: %s", err)
+	}
+	if _, err := in.Call(fn); err != nil {
+		t.Errorf("call after the program stopped failed: %s", err)
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/disasm"
 	"github.com/mehrankamal/monkey/lexer"
 	"github.com/mehrankamal/monkey/object"
 	"github.com/mehrankamal/monkey/parser"
 	"github.com/mehrankamal/monkey/vm"
 	"io"
-	"strings"
 )
 
 const PROMPT = ">> "
@@ -20,9 +20,7 @@ func Start(in io.Reader, out io.Writer) {
 	constants := make([]object.Object, 0)
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
+	symbolTable.DefineBuiltins(object.Builtins)
 
 	for {
 		fmt.Printf(PROMPT)
@@ -49,23 +47,7 @@ func Start(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		constStrings := []string{}
-
-		for idx, constant := range c.Bytecode().Constants {
-			var constString string
-
-			switch constant := constant.(type) {
-			case *object.CompiledFunction:
-				splitInstructions := strings.Split(constant.Instructions.String(), "\n")
-				constString = strings.Join(splitInstructions, "\n\t\t")
-			default:
-				constString = constant.Inspect()
-			}
-
-			constStrings = append(constStrings, fmt.Sprintf("%d: %s", idx, constString))
-		}
-
-		fmt.Fprintf(out, "Generated Opcodes:\n\t%s\nConstants:\n\t%s\nResults: ", strings.Join(strings.Split(c.Bytecode().Instructions.String(), "\n"), "\n\t"), strings.Join(constStrings, "\n\t"))
+		fmt.Fprintf(out, "%s\nResults: ", disasm.Disassemble(c.Bytecode()))
 
 		code := c.Bytecode()
 		constants = code.Constants
@@ -73,7 +55,11 @@ func Start(in io.Reader, out io.Writer) {
 		machine := vm.NewWithGlobalsStore(code, globals)
 		err = machine.Run()
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+				fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", runtimeErr.Trace())
+			} else {
+				fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			}
 			continue
 		}
 
@@ -94,11 +80,11 @@ const MonkeyFace = `       .-"-.            .-"-.            .-"-.           .-"
  -={ see no evil }={ hear no evil }={ speak no evil }={ have no fun }=-
 `
 
-func printParserErrors(out io.Writer, errors []string) {
+func printParserErrors(out io.Writer, errors []*parser.Error) {
 	_, _ = io.WriteString(out, MonkeyFace)
 	_, _ = io.WriteString(out, "Whoops! We ran into some monkey business here!\n")
 	_, _ = io.WriteString(out, " parser errors:\n")
-	for _, msg := range errors {
-		_, _ = io.WriteString(out, "\t"+msg+"\n")
+	for _, err := range errors {
+		_, _ = io.WriteString(out, "\t"+err.Error()+"\n")
 	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mehrankamal/monkey/ast"
+	"github.com/mehrankamal/monkey/bytecode"
+	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/disasm"
+	"github.com/mehrankamal/monkey/evaluator"
+	"github.com/mehrankamal/monkey/lexer"
+	"github.com/mehrankamal/monkey/object"
+	"github.com/mehrankamal/monkey/parser"
+	"github.com/mehrankamal/monkey/vm"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// argsIndex is the global index of args, the first name the symbol table of
+// a script defines after the builtins.
+const argsIndex = 0
+
+// runCommand implements "monkey run [flags] file [args...]".
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.StringVar(engine, "engine", *engine, "use 'vm' or 'eval'")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(std.stderr, "usage: monkey run [flags] file [args...]")
+		return 2
+	}
+
+	return runFile(fs.Arg(0), fs.Args()[1:])
+}
+
+// buildCommand implements "monkey build file [-o output]".
+func buildCommand(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	output := fs.String("o", "", "write the bytecode to `file` (default: the script name with extension .mkc)")
+
+	// accept -o before or after the script
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(std.stderr, "usage: monkey build file [-o output]")
+		return 2
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() != 0 {
+		fmt.Fprintln(std.stderr, "usage: monkey build file [-o output]")
+		return 2
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(path, filepath.Ext(path)) + ".mkc"
+	}
+
+	err := buildFile(path, *output)
+	if err != nil {
+		fmt.Fprintln(std.stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func buildFile(path, output string) error {
+	input, err := readScript(path)
+	if err != nil {
+		return err
+	}
+
+	program, err := parseScript(path, string(input))
+	if err != nil {
+		return err
+	}
+
+	bc, err := compileScript(program)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := bytecode.Encode(&buf, bc); err != nil {
+		return err
+	}
+
+	return os.WriteFile(output, buf.Bytes(), 0644)
+}
+
+// disasmCommand implements "monkey disasm file".
+func disasmCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(std.stderr, "usage: monkey disasm file")
+		return 2
+	}
+
+	bc, err := loadBytecode(args[0])
+	if err != nil {
+		fmt.Fprintln(std.stderr, err)
+		return 1
+	}
+
+	if err := disasm.Fprint(std.stdout, bc); err != nil {
+		fmt.Fprintln(std.stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// loadBytecode reads the bytecode file at path, or compiles the script
+// there.
+func loadBytecode(path string) (*compiler.Bytecode, error) {
+	input, err := readScript(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytecode.IsBytecode(input) {
+		bc, err := bytecode.Decode(bytes.NewReader(input))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return bc, nil
+	}
+
+	program, err := parseScript(path, string(input))
+	if err != nil {
+		return nil, err
+	}
+	return compileScript(program)
+}
+
+// runFile runs the script or bytecode file at path, or the one on stdin if
+// path is "-". Scripts run with the engine chosen by the -engine flag.
+// Errors are printed to stderr. It returns the process exit code.
+func runFile(path string, args []string) int {
+	if *engine != "vm" && *engine != "eval" {
+		fmt.Fprintf(std.stderr, "unknown engine %q: use 'vm' or 'eval'\n", *engine)
+		return 2
+	}
+
+	err := runScript(path, scriptArgs(args))
+	if err != nil {
+		fmt.Fprintln(std.stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func runScript(path string, argv *object.Array) error {
+	input, err := readScript(path)
+	if err != nil {
+		return err
+	}
+
+	if bytecode.IsBytecode(input) {
+		if *engine == "eval" {
+			return fmt.Errorf("%s: cannot evaluate bytecode, use -engine=vm", path)
+		}
+
+		bc, err := bytecode.Decode(bytes.NewReader(input))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return execute(bc, argv)
+	}
+
+	program, err := parseScript(path, string(input))
+	if err != nil {
+		return err
+	}
+
+	if *engine == "eval" {
+		return evalScript(program, argv)
+	}
+
+	bc, err := compileScript(program)
+	if err != nil {
+		return err
+	}
+	return execute(bc, argv)
+}
+
+func readScript(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(std.stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// parseScript parses input read from path, returning all parser errors as
+// one error.
+func parseScript(path, input string) (*ast.Program, error) {
+	filename := path
+	if path == "-" {
+		filename = "<stdin>"
+	}
+
+	l := lexer.NewWithFilename(input, filename)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		messages := make([]string, len(p.Errors()))
+		for i, err := range p.Errors() {
+			messages[i] = err.Error()
+		}
+		return nil, errors.New(strings.Join(messages, "\n"))
+	}
+
+	return program, nil
+}
+
+// scriptArgs returns the array bound to args in the script.
+func scriptArgs(args []string) *object.Array {
+	elements := make([]object.Object, len(args))
+	for i, arg := range args {
+		elements[i] = &object.String{Value: arg}
+	}
+	return &object.Array{Elements: elements}
+}
+
+// builtins returns the builtins of scripts, with puts writing to the
+// standard output.
+func builtins() object.BuiltinSet {
+	return object.NewBuiltins(object.Host{Stdout: std.stdout})
+}
+
+func compileScript(program *ast.Program) (*compiler.Bytecode, error) {
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(builtins())
+	symbolTable.Define("args")
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+
+	return comp.Bytecode(), nil
+}
+
+func execute(bc *compiler.Bytecode, argv *object.Array) error {
+	globals := make([]object.Object, vm.GlobalsSize)
+	globals[argsIndex] = argv
+
+	machine := vm.NewWithGlobalsStore(bc, globals)
+	machine.Config().Builtins = builtins()
+	err := machine.Run()
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		return fmt.Errorf("%s: %s", runtimeErrorLocation(runtimeErr), runtimeErr.Trace())
+	}
+	return err
+}
+
+// runtimeErrorLocation returns the file and line of the innermost Monkey
+// function active when err was raised.
+func runtimeErrorLocation(err *vm.RuntimeError) string {
+	for _, frame := range err.StackTrace {
+		if frame.Builtin {
+			continue
+		}
+		if frame.Filename == "" {
+			return fmt.Sprintf("%d", frame.Line)
+		}
+		return fmt.Sprintf("%s:%d", frame.Filename, frame.Line)
+	}
+	return "-"
+}
+
+func evalScript(program *ast.Program, argv *object.Array) error {
+	env := object.NewEnvironment()
+	env.Config().Builtins = builtins()
+	env.Set("args", argv)
+
+	evaluated := evaluator.Eval(program, env)
+	if err, ok := evaluated.(*object.Error); ok {
+		var out strings.Builder
+		fmt.Fprintf(&out, "%s: %s", err.Pos, err.Message)
+		for _, name := range err.Stack {
+			fmt.Fprintf(&out, "\n\tat %s", name)
+		}
+		return errors.New(out.String())
+	}
+
+	return nil
+}
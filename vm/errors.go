@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"bytes"
+	"github.com/mehrankamal/monkey/object"
+)
+
+// StackFrame describes one active function call at the time of a runtime
+// error. The evaluator describes its calls the same way.
+type StackFrame = object.StackFrame
+
+// RuntimeError is returned by Run when execution fails. StackTrace lists the
+// active frames, innermost first.
+type RuntimeError struct {
+	Message    string
+	StackTrace []StackFrame
+
+	// Builtin names the builtin function that failed, if any.
+	Builtin string
+
+	// Cause is the error that stopped the program, such as the error of a
+	// cancelled context or one wrapping object.ErrInstructionLimit or
+	// object.ErrAllocationLimit, and nil for errors raised by the program
+	// itself.
+	Cause error
+}
+
+func (e *RuntimeError) Error() string { return e.Message }
+
+func (e *RuntimeError) Unwrap() error { return e.Cause }
+
+// Trace renders the error message followed by the stack trace.
+func (e *RuntimeError) Trace() string {
+	var out bytes.Buffer
+
+	out.WriteString(e.Message)
+	for _, frame := range e.StackTrace {
+		out.WriteString("\n\tat ")
+		out.WriteString(frame.String())
+	}
+
+	return out.String()
+}
+
+// builtinError is raised when a builtin function returns an error.
+type builtinError struct {
+	name    string
+	message string
+}
+
+func (e *builtinError) Error() string { return e.message }
+
+// haltError stops the program when its budget is spent.
+type haltError struct {
+	cause error
+}
+
+func (e *haltError) Error() string { return e.cause.Error() }
+
+// thrownError is raised by a throw statement.
+type thrownError struct {
+	err *object.Error
+}
+
+func (e *thrownError) Error() string { return e.err.Message }
+
+// unwind looks for a handler of err in the active frames, innermost first.
+// If there is one, the frames above it are dropped, the stack is cut back
+// to the handler's depth and the caught value pushed, and the handler's
+// frame resumes at the handler. It reports whether err was caught.
+func (vm *VirtualMachine) unwind(err error) bool {
+	for i := vm.frameIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		handler, ok := frame.cl.Fn.Handlers.Lookup(frame.ip)
+		if !ok {
+			continue
+		}
+
+		caught := vm.caughtValue(err)
+
+		for vm.frameIndex-1 > i {
+			vm.closeCells(vm.popFrame())
+		}
+
+		vm.sp = frame.basePointer + frame.cl.Fn.NumLocals + handler.Depth
+		vm.stack[vm.sp] = caught
+		vm.sp++
+
+		frame.ip = handler.Target - 1
+		return true
+	}
+
+	return false
+}
+
+// caughtValue returns the value a catch binds for err: the thrown value,
+// or an exception carrying the message and stack trace of a runtime error.
+func (vm *VirtualMachine) caughtValue(err error) object.Object {
+	if thrown, ok := err.(*thrownError); ok {
+		return thrown.err.Caught()
+	}
+
+	trace := vm.newRuntimeError(err).StackTrace
+	stack := make([]string, len(trace))
+	for i, frame := range trace {
+		stack[i] = frame.String()
+	}
+
+	return (&object.Error{Message: err.Error(), Stack: stack}).Caught()
+}
+
+func (vm *VirtualMachine) newRuntimeError(err error) *RuntimeError {
+	runtimeErr := &RuntimeError{Message: err.Error()}
+	trace := make([]StackFrame, 0, vm.frameIndex+1)
+
+	if builtin, ok := err.(*builtinError); ok {
+		runtimeErr.Builtin = builtin.name
+		trace = append(trace, StackFrame{Function: builtin.name, Builtin: true})
+	}
+
+	for i := vm.frameIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		fn := frame.cl.Fn
+
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+
+		trace = append(trace, StackFrame{
+			Function: name,
+			Filename: fn.Filename,
+			Line:     fn.Lines.Line(frame.ip),
+		})
+	}
+
+	runtimeErr.StackTrace = trace
+	return runtimeErr
+}
@@ -1,15 +1,18 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"github.com/mehrankamal/monkey/code"
 	"github.com/mehrankamal/monkey/compiler"
 	"github.com/mehrankamal/monkey/object"
+	"math"
+	"math/big"
 )
 
 const StackSize = 2048
 const GlobalsSize = 65536
-const MaxFrames = 1024
+const MaxFrames = object.MaxCallDepth
 
 var True = &object.Boolean{Value: true}
 var False = &object.Boolean{Value: false}
@@ -25,35 +28,68 @@ type VirtualMachine struct {
 
 	frames     []*Frame
 	frameIndex int
+
+	// cells of captured locals that still point into the stack, ordered by
+	// the frame that owns them
+	openCells []*object.Cell
+
+	// names of the builtins the program was compiled with
+	builtins []string
+
+	config object.Config
+	budget *object.Budget
+
+	// running is set while the machine runs a program or call, whose budget
+	// calls made from builtins share
+	running bool
+
+	// nested is the machine running the innermost call made while vm runs,
+	// whose frames the next call stacks on
+	nested *VirtualMachine
 }
 
 func New(bytecode *compiler.Bytecode) *VirtualMachine {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	return NewWithGlobalsStore(bytecode, make([]object.Object, GlobalsSize))
+}
+
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VirtualMachine {
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Name:         "<main>",
+		Filename:     bytecode.Filename,
+		Lines:        bytecode.Lines,
+		Handlers:     bytecode.Handlers,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
-	return &VirtualMachine{
+	vm := &VirtualMachine{
 		constants: bytecode.Constants,
 
 		stack: make([]object.Object, StackSize),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: s,
 
 		frames:     frames,
 		frameIndex: 1,
+
+		builtins: bytecode.Builtins,
 	}
-}
+	vm.budget = object.NewBudget(context.Background(), &vm.config)
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VirtualMachine {
-	vm := New(bytecode)
-	vm.globals = s
 	return vm
 }
 
+// Config returns the runtime settings of the machine. Change them before
+// calling Run.
+func (vm *VirtualMachine) Config() *object.Config {
+	return &vm.config
+}
+
 func (vm *VirtualMachine) StackTop() object.Object {
 	if vm.sp == 0 {
 		return nil
@@ -66,12 +102,148 @@ func (vm *VirtualMachine) currentFrame() *Frame {
 	return vm.frames[vm.frameIndex-1]
 }
 
+// Run executes the bytecode. Errors that no try statement catches are
+// returned as *RuntimeError. Programs that exceed the instruction or
+// allocation limits of Config() stop with a *RuntimeError whose Cause
+// wraps object.ErrInstructionLimit or object.ErrAllocationLimit; try
+// statements cannot catch these errors. Programs compiled with builtins
+// other than those of Config().Builtins, or whose instructions do not pass
+// compiler.Verify, fail before they start.
 func (vm *VirtualMachine) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is like Run, but also stops once ctx is done, with the error
+// of ctx as the Cause of the *RuntimeError.
+func (vm *VirtualMachine) RunContext(ctx context.Context) error {
+	if err := vm.checkBuiltins(); err != nil {
+		return err
+	}
+	main := vm.frames[0].cl.Fn
+	program := &compiler.Bytecode{Instructions: main.Instructions, Handlers: main.Handlers, Constants: vm.constants}
+	if err := compiler.Verify(program); err != nil {
+		return &RuntimeError{Message: err.Error()}
+	}
+
+	vm.budget.Start(ctx)
+	vm.running = true
+	defer func() { vm.running = false }()
+
+	return vm.execute()
+}
+
+// checkBuiltins fails if the builtin set of the config does not start with
+// the builtins the program was compiled with, whose indexes would refer to
+// other builtins.
+func (vm *VirtualMachine) checkBuiltins() error {
+	set := vm.config.BuiltinSet()
+	for i, name := range vm.builtins {
+		if i >= len(set) {
+			return &RuntimeError{Message: fmt.Sprintf(
+				"program compiled with builtin %d %s, but there are only %d builtins", i, name, len(set))}
+		}
+		if set[i].Name != name {
+			return &RuntimeError{Message: fmt.Sprintf(
+				"program compiled with builtin %d %s, but it is %s", i, name, set[i].Name)}
+		}
+	}
+	return nil
+}
+
+// execute runs the program, resuming it at the handler of each error it
+// catches.
+func (vm *VirtualMachine) execute() error {
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+
+		if halt, ok := err.(*haltError); ok {
+			runtimeErr := vm.newRuntimeError(err)
+			runtimeErr.Cause = halt.cause
+			return runtimeErr
+		}
+
+		if !vm.unwind(err) {
+			return vm.newRuntimeError(err)
+		}
+	}
+}
+
+// Call calls fn, a closure or builtin, with args and returns its result. The
+// call runs on a new machine sharing the constants, globals and settings of
+// vm, so it can be made after Run returns, or from a builtin while Run is
+// executing. A call made while vm runs counts against the instruction and
+// allocation limits of that run rather than starting afresh.
+func (vm *VirtualMachine) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	return vm.CallContext(context.Background(), fn, args...)
+}
+
+// CallContext is like Call, but stops like RunContext once ctx is done or
+// the call has run too many instructions. A call made while vm runs also
+// stops once the context of the run is done.
+func (vm *VirtualMachine) CallContext(ctx context.Context, fn object.Object, args ...object.Object) (object.Object, error) {
+	if len(args) > 255 {
+		return nil, fmt.Errorf("too many arguments: %d, at most 255", len(args))
+	}
+	if len(args)+1 > StackSize {
+		return nil, fmt.Errorf("stack overflow")
+	}
+
+	// the frames the call stacks on count against MaxFrames, so that a
+	// builtin calling back into the closure that called it cannot recurse
+	// without end
+	inner, used := vm, 0
+	if vm.running {
+		if vm.nested != nil {
+			inner = vm.nested
+		}
+		used = MaxFrames - len(inner.frames) + inner.frameIndex
+	}
+	if used >= MaxFrames {
+		return nil, fmt.Errorf("stack overflow")
+	}
+
+	caller := NewWithGlobalsStore(&compiler.Bytecode{
+		Instructions: code.Make(code.OpCall, len(args)),
+		Constants:    vm.constants,
+	}, vm.globals)
+	caller.frames = caller.frames[:MaxFrames-used]
+	caller.config = vm.config
+	caller.budget = vm.budget
+
+	caller.stack[0] = fn
+	copy(caller.stack[1:], args)
+	caller.sp = 1 + len(args)
+
+	if vm.running {
+		defer vm.budget.Nest(ctx)()
+		defer func(nested *VirtualMachine) { vm.nested = nested }(vm.nested)
+	} else {
+		vm.budget.Start(ctx)
+		vm.running = true
+		defer func() { vm.running = false; vm.nested = nil }()
+	}
+	vm.nested = caller
+
+	err := caller.execute()
+	if err != nil {
+		return nil, err
+	}
+	return caller.StackTop(), nil
+}
+
+func (vm *VirtualMachine) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if err := vm.budget.Step(); err != nil {
+			return &haltError{cause: err}
+		}
+
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -111,7 +283,8 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -127,8 +300,14 @@ func (vm *VirtualMachine) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpBitNot:
+			err := vm.executeBitNotOperator()
+			if err != nil {
+				return err
+			}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+			code.OpLessThan, code.OpLessThanOrEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -150,6 +329,42 @@ func (vm *VirtualMachine) Run() error {
 			pos := int(code.ReadUint16(vm.currentFrame().Instructions()[vm.currentFrame().ip+1:]))
 			vm.currentFrame().ip = pos - 1
 
+		case code.OpIter:
+			iterable, err := vm.pop()
+			if err != nil {
+				return err
+			}
+
+			iterator, ok := object.NewIterator(iterable)
+			if !ok {
+				return fmt.Errorf("cannot iterate over %s", iterable.Type())
+			}
+
+			err = vm.push(iterator)
+			if err != nil {
+				return err
+			}
+
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(vm.currentFrame().Instructions()[vm.currentFrame().ip+1:]))
+			vm.currentFrame().ip += 2
+
+			iterator, ok := vm.stack[vm.sp-1].(*object.Iterator)
+			if !ok {
+				return fmt.Errorf("not an iterator: %s", vm.stack[vm.sp-1].Type())
+			}
+			item, ok := iterator.Next()
+			if !ok {
+				vm.sp--
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+
+			err := vm.push(item)
+			if err != nil {
+				return err
+			}
+
 		case code.OpSetGlobal:
 			globalIdx := code.ReadUint16(vm.currentFrame().Instructions()[vm.currentFrame().ip+1:])
 			vm.currentFrame().ip += 2
@@ -164,7 +379,7 @@ func (vm *VirtualMachine) Run() error {
 			idx := code.ReadUint16(vm.currentFrame().Instructions()[vm.currentFrame().ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[idx])
+			err := vm.pushVariable(vm.globals[idx])
 			if err != nil {
 				return err
 			}
@@ -176,7 +391,12 @@ func (vm *VirtualMachine) Run() error {
 			array := vm.buildArray(vm.sp-arraySize, vm.sp)
 			vm.sp -= arraySize
 
-			err := vm.push(array)
+			err := vm.allocate(array)
+			if err != nil {
+				return err
+			}
+
+			err = vm.push(array)
 			if err != nil {
 				return err
 			}
@@ -190,6 +410,11 @@ func (vm *VirtualMachine) Run() error {
 			}
 			vm.sp = vm.sp - (numHashPairs * 2)
 
+			err = vm.allocate(hash)
+			if err != nil {
+				return err
+			}
+
 			err = vm.push(hash)
 			if err != nil {
 				return err
@@ -209,6 +434,39 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 
+		case code.OpSetIndex:
+			value, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			index, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			left, err := vm.pop()
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeSetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpDup2:
+			if vm.sp < 2 {
+				return fmt.Errorf("stack empty")
+			}
+
+			err := vm.push(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+			err = vm.push(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+
 		case code.OpClosure:
 			constIndex := code.ReadUint16(ins[ip+1:])
 			freeVars := code.ReadUint8(ins[ip+3:])
@@ -225,6 +483,36 @@ func (vm *VirtualMachine) Run() error {
 			vm.currentFrame().ip += 1
 			currentClosure := vm.currentFrame().cl
 
+			err := vm.pushVariable(currentClosure.Free[freeIndex].Get())
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			currentClosure := vm.currentFrame().cl
+
+			poppedValue, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			currentClosure.Free[freeIndex].Set(poppedValue)
+
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(vm.captureLocal(vm.currentFrame().basePointer + int(localIndex)))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			currentClosure := vm.currentFrame().cl
+
 			err := vm.push(currentClosure.Free[freeIndex])
 			if err != nil {
 				return err
@@ -239,13 +527,28 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 
+		case code.OpTailCall:
+			numArgs := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
+
 		case code.OpReturnValue:
 			returnValue, err := vm.pop()
 			if err != nil {
 				return err
 			}
 
+			if vm.frameIndex == 1 {
+				vm.returnFromMain(returnValue)
+				break
+			}
+
 			frame := vm.popFrame()
+			vm.closeCells(frame)
 			vm.sp = frame.basePointer - 1
 
 			err = vm.push(returnValue)
@@ -253,8 +556,22 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 
+		case code.OpThrow:
+			value, err := vm.pop()
+			if err != nil {
+				return err
+			}
+
+			return &thrownError{err: object.Thrown(value)}
+
 		case code.OpReturn:
+			if vm.frameIndex == 1 {
+				vm.returnFromMain(Null)
+				break
+			}
+
 			frame := vm.popFrame()
+			vm.closeCells(frame)
 			vm.sp = frame.basePointer - 1
 
 			err := vm.push(Null)
@@ -279,7 +596,7 @@ func (vm *VirtualMachine) Run() error {
 			vm.currentFrame().ip += 1
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			err := vm.pushVariable(vm.stack[frame.basePointer+int(localIndex)])
 			if err != nil {
 				return err
 			}
@@ -287,9 +604,12 @@ func (vm *VirtualMachine) Run() error {
 			functionIdx := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
-			definition := object.Builtins[functionIdx]
+			builtins := vm.config.BuiltinSet()
+			if int(functionIdx) >= len(builtins) {
+				return fmt.Errorf("undefined builtin %d", functionIdx)
+			}
 
-			err := vm.push(definition.Builtin)
+			err := vm.push(builtins[functionIdx].Builtin)
 			if err != nil {
 				return err
 			}
@@ -320,6 +640,47 @@ func (vm *VirtualMachine) executeCall(numArgs int) error {
 	}
 }
 
+// executeTailCall calls a closure in place of the current frame: the callee
+// and its arguments move down to the frame's slots and the frame is reused,
+// so tail-recursive functions run in constant frame and stack depth. Other
+// callees are called normally and the OpReturnValue that follows returns
+// their result.
+func (vm *VirtualMachine) executeTailCall(numArgs int) error {
+	callee, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+
+	if numArgs != callee.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", callee.Fn.NumParameters, numArgs)
+	}
+
+	frame := vm.currentFrame()
+	if frame.basePointer+callee.Fn.NumLocals > StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+	vm.closeCells(frame)
+
+	basePointer := frame.basePointer
+	copy(vm.stack[basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.frames[vm.frameIndex-1] = NewFrame(callee, basePointer)
+
+	vm.sp = basePointer + callee.Fn.NumLocals
+	vm.clearLocals(basePointer+numArgs, vm.sp)
+
+	return nil
+}
+
+// returnFromMain ends the program with value as its result, for a return
+// statement outside of any function.
+func (vm *VirtualMachine) returnFromMain(value object.Object) {
+	frame := vm.currentFrame()
+	frame.ip = len(frame.Instructions()) - 1
+
+	vm.sp = 0
+	vm.stack[0] = value
+}
+
 func (vm *VirtualMachine) pushFrame(f *Frame) {
 	vm.frames[vm.frameIndex] = f
 	vm.frameIndex++
@@ -357,6 +718,10 @@ func (vm *VirtualMachine) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER && rightType == object.INTEGER:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case object.IsInteger(left) && object.IsInteger(right):
+		return vm.executeBinaryBigIntOperation(op, left, right)
+	case isNumber(left) && isNumber(right):
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING && rightType == object.STRING:
 		return vm.executeBinaryStringOperation(op, left, right)
 	default:
@@ -392,11 +757,176 @@ func (vm *VirtualMachine) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
 
+// operatorSymbols gives the source operators of binary opcodes, for error
+// messages worded like those of the evaluator.
+var operatorSymbols = map[code.Opcode]string{
+	code.OpAdd: "+",
+	code.OpSub: "-",
+	code.OpMul: "*",
+	code.OpDiv: "/",
+	code.OpMod: "%",
+	code.OpPow: "**",
+
+	code.OpBitAnd:     "&",
+	code.OpBitOr:      "|",
+	code.OpBitXor:     "^",
+	code.OpShiftLeft:  "<<",
+	code.OpShiftRight: ">>",
+
+	code.OpEqual:              "==",
+	code.OpNotEqual:           "!=",
+	code.OpGreaterThan:        ">",
+	code.OpGreaterThanOrEqual: ">=",
+	code.OpLessThan:           "<",
+	code.OpLessThanOrEqual:    "<=",
+}
+
 func (vm *VirtualMachine) executeBinaryIntegerOperation(op code.Opcode, left, right object.Object) error {
 	rightVal := right.(*object.Integer).Value
 	leftVal := left.(*object.Integer).Value
 
 	var result int64
+	var overflow bool
+
+	switch op {
+	case code.OpAdd:
+		result, overflow = object.AddInt64(leftVal, rightVal)
+	case code.OpSub:
+		result, overflow = object.SubInt64(leftVal, rightVal)
+	case code.OpMul:
+		result, overflow = object.MulInt64(leftVal, rightVal)
+	case code.OpDiv:
+		if rightVal == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result, overflow = object.DivInt64(leftVal, rightVal)
+	case code.OpMod:
+		if rightVal == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftVal % rightVal
+	case code.OpPow:
+		if rightVal < 0 {
+			return vm.executeBinaryFloatOperation(op, left, right)
+		}
+		result, overflow = object.PowInt64(leftVal, rightVal)
+	case code.OpBitAnd:
+		result = leftVal & rightVal
+	case code.OpBitOr:
+		result = leftVal | rightVal
+	case code.OpBitXor:
+		result = leftVal ^ rightVal
+	case code.OpShiftLeft:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d", rightVal)
+		}
+		result, overflow = object.ShlInt64(leftVal, rightVal)
+	case code.OpShiftRight:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d", rightVal)
+		}
+		result = leftVal >> uint64(rightVal)
+	default:
+		return fmt.Errorf("unknown integer operation: %d", op)
+	}
+
+	if overflow {
+		if vm.config.CheckedArithmetic {
+			return fmt.Errorf("integer overflow: %d %s %d", leftVal, operatorSymbols[op], rightVal)
+		}
+		return vm.executeBinaryBigIntOperation(op, left, right)
+	}
+
+	return vm.push(&object.Integer{Value: result})
+
+}
+
+// executeBinaryBigIntOperation handles integers that overflowed int64 or
+// already are BigInts. Results that fit in int64 are demoted to Integer.
+func (vm *VirtualMachine) executeBinaryBigIntOperation(op code.Opcode, left, right object.Object) error {
+	leftVal, _ := object.BigValue(left)
+	rightVal, _ := object.BigValue(right)
+
+	result := new(big.Int)
+
+	switch op {
+	case code.OpAdd:
+		result.Add(leftVal, rightVal)
+	case code.OpSub:
+		result.Sub(leftVal, rightVal)
+	case code.OpMul:
+		result.Mul(leftVal, rightVal)
+	case code.OpDiv:
+		if rightVal.Sign() == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result.Quo(leftVal, rightVal)
+	case code.OpMod:
+		if rightVal.Sign() == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result.Rem(leftVal, rightVal)
+	case code.OpPow:
+		if rightVal.Sign() < 0 {
+			return vm.executeBinaryFloatOperation(op, left, right)
+		}
+		bits := int64(math.MaxInt64)
+		if rightVal.IsInt64() {
+			bits = object.PowBits(leftVal, rightVal.Int64())
+		}
+		if bits > object.MaxIntegerBits {
+			return fmt.Errorf("exponent too large: %s", rightVal)
+		}
+		if err := vm.budget.CheckIntegerBits(bits); err != nil {
+			return &haltError{cause: err}
+		}
+		result.Exp(leftVal, rightVal, nil)
+	case code.OpBitAnd:
+		result.And(leftVal, rightVal)
+	case code.OpBitOr:
+		result.Or(leftVal, rightVal)
+	case code.OpBitXor:
+		result.Xor(leftVal, rightVal)
+	case code.OpShiftLeft, code.OpShiftRight:
+		if rightVal.Sign() < 0 {
+			return fmt.Errorf("negative shift count: %s", rightVal)
+		}
+		if !rightVal.IsInt64() {
+			return fmt.Errorf("shift count too large: %s", rightVal)
+		}
+		if op == code.OpShiftRight {
+			result.Rsh(leftVal, uint(rightVal.Int64()))
+			break
+		}
+		bits := object.ShlBits(leftVal, rightVal.Int64())
+		if bits > object.MaxIntegerBits {
+			return fmt.Errorf("shift count too large: %s", rightVal)
+		}
+		if err := vm.budget.CheckIntegerBits(bits); err != nil {
+			return &haltError{cause: err}
+		}
+		result.Lsh(leftVal, uint(rightVal.Int64()))
+	default:
+		return fmt.Errorf("unknown integer operation: %d", op)
+	}
+
+	integer := object.NewInteger(result)
+	if _, ok := integer.(*object.BigInt); ok {
+		if err := vm.allocate(integer); err != nil {
+			return err
+		}
+	}
+
+	return vm.push(integer)
+}
+
+// executeBinaryFloatOperation handles two floats as well as a float mixed
+// with an integer, which is converted to float first.
+func (vm *VirtualMachine) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	var result float64
 
 	switch op {
 	case code.OpAdd:
@@ -407,12 +937,34 @@ func (vm *VirtualMachine) executeBinaryIntegerOperation(op code.Opcode, left, ri
 		result = leftVal * rightVal
 	case code.OpDiv:
 		result = leftVal / rightVal
+	case code.OpMod:
+		result = math.Mod(leftVal, rightVal)
+	case code.OpPow:
+		result = math.Pow(leftVal, rightVal)
 	default:
-		return fmt.Errorf("unknown integer operation: %d", op)
+		return fmt.Errorf("unknown operator: %s %s %s",
+			left.Type(), operatorSymbols[op], right.Type())
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(&object.Float{Value: result})
+}
 
+func isNumber(obj object.Object) bool {
+	return object.IsInteger(obj) || obj.Type() == object.FLOAT
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
 }
 
 func (vm *VirtualMachine) executeComparison(op code.Opcode) error {
@@ -430,15 +982,31 @@ func (vm *VirtualMachine) executeComparison(op code.Opcode) error {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if object.IsInteger(left) && object.IsInteger(right) {
+		return vm.executeBigIntComparison(op, left, right)
+	}
+
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+
+	if left.Type() == object.STRING && right.Type() == object.STRING {
+		return vm.executeStringComparison(op, left, right)
+	}
+
 	switch op {
 	case code.OpEqual:
 		return vm.push(nativeBoolToBooleanObject(right == left))
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(right != left))
-	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
 	}
+
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s",
+			left.Type(), operatorSymbols[op], right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s",
+		left.Type(), operatorSymbols[op], right.Type())
 }
 
 func nativeBoolToBooleanObject(b bool) object.Object {
@@ -460,6 +1028,56 @@ func (vm *VirtualMachine) executeIntegerComparison(op code.Opcode, left, right o
 		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VirtualMachine) executeBigIntComparison(op code.Opcode, left, right object.Object) error {
+	leftValue, _ := object.BigValue(left)
+	rightValue, _ := object.BigValue(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) == 0))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) != 0))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) > 0))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) >= 0))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) < 0))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue.Cmp(rightValue) <= 0))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VirtualMachine) executeFloatComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessThanOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
@@ -489,23 +1107,70 @@ func (vm *VirtualMachine) executeNegateOperator() error {
 		return err
 	}
 
-	if operand.Type() != object.INTEGER {
+	switch operand := operand.(type) {
+	case *object.Integer:
+		if operand.Value == math.MinInt64 {
+			if vm.config.CheckedArithmetic {
+				return fmt.Errorf("integer overflow: -(%d)", operand.Value)
+			}
+			return vm.push(object.NewInteger(new(big.Int).Neg(big.NewInt(operand.Value))))
+		}
+		return vm.push(&object.Integer{Value: -operand.Value})
+	case *object.BigInt:
+		return vm.push(object.NewInteger(new(big.Int).Neg(operand.Value)))
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
 		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
+}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+func (vm *VirtualMachine) executeBitNotOperator() error {
+	operand, err := vm.pop()
+	if err != nil {
+		return err
+	}
+
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(&object.Integer{Value: ^operand.Value})
+	case *object.BigInt:
+		return vm.push(object.NewInteger(new(big.Int).Not(operand.Value)))
+	default:
+		return fmt.Errorf("unknown operator: ~%s", operand.Type())
+	}
+}
+
+func (vm *VirtualMachine) executeStringComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %s %s %s",
+			left.Type(), operatorSymbols[op], right.Type())
+	}
 }
 
 func (vm *VirtualMachine) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return fmt.Errorf("unknown operator: %s %s %s",
+			left.Type(), operatorSymbols[op], right.Type())
 	}
 
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	result := &object.String{Value: leftValue + rightValue}
+	if err := vm.allocate(result); err != nil {
+		return err
+	}
+
+	return vm.push(result)
 }
 
 func (vm *VirtualMachine) buildArray(start int, end int) object.Object {
@@ -543,6 +1208,11 @@ func (vm *VirtualMachine) executeIndexExpression(left, index object.Object) erro
 		return vm.executeArrayIndex(left, index)
 	case left.Type() == object.HASH:
 		return vm.executeHashIndex(left, index)
+	case left.Type() == object.EXCEPTION && index.Type() == object.STRING:
+		if field, ok := left.(*object.Exception).Field(index.(*object.String).Value); ok {
+			return vm.push(field)
+		}
+		return vm.push(Null)
 	default:
 		return fmt.Errorf("index operator not supported: %s", left.Type())
 	}
@@ -578,24 +1248,85 @@ func (vm *VirtualMachine) executeHashIndex(hash, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+// executeSetIndex stores value into an array element or hash entry and
+// pushes value as the result of the assignment.
+func (vm *VirtualMachine) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d (length %d)", idx.Value, len(left.Elements))
+		}
+		left.Elements[idx.Value] = value
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+		if err := vm.budget.CheckSize(left); err != nil {
+			return &haltError{cause: err}
+		}
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
+}
+
 func (vm *VirtualMachine) callClosure(callee *object.Closure, numArgs int) error {
 
 	if numArgs != callee.Fn.NumParameters {
 		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", callee.Fn.NumParameters, numArgs)
 	}
 
+	if vm.frameIndex >= len(vm.frames) || vm.sp-numArgs+callee.Fn.NumLocals > StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+
 	frame := NewFrame(callee, vm.sp-numArgs)
 	vm.pushFrame(frame)
 
-	vm.sp += callee.Fn.NumLocals
+	vm.sp = frame.basePointer + callee.Fn.NumLocals
+	vm.clearLocals(frame.basePointer+numArgs, vm.sp)
 
 	return nil
 }
 
+// clearLocals empties the stack slots from start up to end, so that locals
+// a call has not set yet do not hold values left by earlier calls.
+func (vm *VirtualMachine) clearLocals(start, end int) {
+	for i := start; i < end; i++ {
+		vm.stack[i] = nil
+	}
+}
+
+// pushVariable pushes the value of a global, local or free variable, which
+// is nil if the program has not set it, like a variable defined by a let
+// statement in a branch that did not run.
+func (vm *VirtualMachine) pushVariable(value object.Object) error {
+	if value == nil {
+		return fmt.Errorf("variable used before it is defined")
+	}
+	return vm.push(value)
+}
+
 func (vm *VirtualMachine) callBuiltin(callee *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
-	result := callee.Fn(args...)
+	result := callee.Call(args...)
+	if err, ok := result.(*object.Error); ok {
+		if err.Cause != nil {
+			return &haltError{cause: err.Cause}
+		}
+		return &builtinError{name: callee.Name, message: err.Message}
+	}
+	if err := vm.budget.AllocateResult(result); err != nil {
+		return &haltError{cause: err}
+	}
 	vm.sp = vm.sp - numArgs - 1
 
 	var err error = nil
@@ -609,6 +1340,36 @@ func (vm *VirtualMachine) callBuiltin(callee *object.Builtin, numArgs int) error
 	return err
 }
 
+// captureLocal returns the open cell for the given stack slot, creating it
+// on first capture so that all closures capturing the slot share one cell.
+func (vm *VirtualMachine) captureLocal(slot int) *object.Cell {
+	for i := len(vm.openCells) - 1; i >= 0 && vm.openCells[i].Slot >= vm.currentFrame().basePointer; i-- {
+		if vm.openCells[i].Slot == slot {
+			return vm.openCells[i]
+		}
+	}
+
+	cell := &object.Cell{Ref: &vm.stack[slot], Slot: slot}
+	vm.openCells = append(vm.openCells, cell)
+	return cell
+}
+
+// closeCells closes the open cells of a returning frame, moving the values
+// of its captured locals off the stack before the slots get reused.
+func (vm *VirtualMachine) closeCells(frame *Frame) {
+	if !frame.cl.Fn.CapturesLocals {
+		return
+	}
+
+	n := len(vm.openCells)
+	for n > 0 && vm.openCells[n-1].Slot >= frame.basePointer {
+		vm.openCells[n-1].Close()
+		vm.openCells[n-1] = nil
+		n--
+	}
+	vm.openCells = vm.openCells[:n]
+}
+
 func (vm *VirtualMachine) pushClosure(idx int, freeVars int) error {
 	constant := vm.constants[idx]
 	function, ok := constant.(*object.CompiledFunction)
@@ -616,12 +1377,29 @@ func (vm *VirtualMachine) pushClosure(idx int, freeVars int) error {
 		return fmt.Errorf("not a function: %+v", constant)
 	}
 
-	free := make([]object.Object, freeVars)
+	free := make([]*object.Cell, freeVars)
 	for i := 0; i < freeVars; i++ {
-		free[i] = vm.stack[vm.sp-freeVars+i]
+		captured := vm.stack[vm.sp-freeVars+i]
+		if cell, ok := captured.(*object.Cell); ok {
+			free[i] = cell
+		} else {
+			free[i] = object.NewClosedCell(captured)
+		}
 	}
 	vm.sp = vm.sp - freeVars
 
 	closure := &object.Closure{Fn: function, Free: free}
+	if err := vm.allocate(closure); err != nil {
+		return err
+	}
+
 	return vm.push(closure)
 }
+
+// allocate counts obj against the allocation limits of the machine.
+func (vm *VirtualMachine) allocate(obj object.Object) error {
+	if err := vm.budget.Allocate(obj); err != nil {
+		return &haltError{cause: err}
+	}
+	return nil
+}
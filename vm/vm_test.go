@@ -1,13 +1,21 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/mehrankamal/monkey/ast"
+	"github.com/mehrankamal/monkey/code"
 	"github.com/mehrankamal/monkey/compiler"
+	"github.com/mehrankamal/monkey/evaluator"
 	"github.com/mehrankamal/monkey/lexer"
 	"github.com/mehrankamal/monkey/object"
 	"github.com/mehrankamal/monkey/parser"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -38,6 +46,28 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1.5", 1.5},
+		{"1.5 + 2.25", 3.75},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"3.0 - 4", -1.0},
+		{"2 * 1.25", 2.5},
+		{"1 / 4.0", 0.25},
+		{"-2.5", -2.5},
+		{"1e3 * 2", 2000.0},
+		{"(1.5 + 0.5) * 2", 4.0},
+		{"1.5 > 1", true},
+		{"1 < 1.5", true},
+		{"2 == 2.0", true},
+		{"2.5 != 2.5", false},
+		{"0.1 + 0.2 == 0.3", false},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestBooleanExpression(t *testing.T) {
 	tests := []vmTestCase{
 		{"true", true},
@@ -59,6 +89,24 @@ func TestBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"1.5 >= 1", true},
+		{"1 <= 0.5", false},
+		{"9223372036854775807 + 1 >= 9223372036854775807", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && \"a\"", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"false && (1 / 0 == 1)", false},
+		{"true || (1 / 0 == 1)", true},
 		{"!true", false},
 		{"!false", true},
 		{"!5", false},
@@ -71,6 +119,224 @@ func TestBooleanExpression(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestModulo(t *testing.T) {
+	tests := []vmTestCase{
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7 % -3", 1},
+		{"10 + 7 % 3 * 2", 12},
+		{"7.5 % 2", 1.5},
+		{"(9223372036854775807 + 1) % 10", 8},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPowerAndBitwiseOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"(-2) ** 3", -8},
+		{"2 ** -1", 0.5},
+		{"2.5 ** 2", 6.25},
+		{"4 ** 0.5", 2.0},
+		{"2 ** 64", bigInt("18446744073709551616")},
+		{"(2 ** 64) ** 2", bigInt("340282366920938463463374607431768211456")},
+		{"6 & 3", 2},
+		{"6 | 3", 7},
+		{"6 ^ 3", 5},
+		{"~5", -6},
+		{"~-1", 0},
+		{"1 << 10", 1024},
+		{"-1024 >> 3", -128},
+		{"1 >> 64", 0},
+		{"-1 >> 100", -1},
+		{"1 << 63", bigInt("9223372036854775808")},
+		{"(1 << 64) >> 60", 16},
+		{"(1 << 64) | 1", bigInt("18446744073709551617")},
+		{"(1 << 64) & 3", 0},
+		{"~(1 << 64)", bigInt("-18446744073709551617")},
+		{"1 | 2 ^ 6 & 3", 1},
+		{"1 + 1 << 2", 8},
+		{"5 & 4 == 4", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; let sum = 0; while (i < 5) { sum += i; i += 1; } sum", 10},
+		{"let i = 0; while (false) { i = 1; } i", 0},
+		{"let i = 0; while (true) { i += 1; if (i == 7) { break; } } i", 7},
+		{"let i = 0; let odd = 0; while (i < 10) { i += 1; if (i % 2 == 0) { continue; } odd += 1; } odd", 5},
+		{"let sum = 0; for (x in [1, 2, 3, 4]) { sum += x; } sum", 10},
+		{`let s = ""; for (c in "abc") { s = c + s; } s`, "cba"},
+		{`let keys = ""; for (k in {"b": 2, "a": 1, "c": 3}) { keys += k; } keys`, "abc"},
+		{`let total = 0; let h = {"x": 1, "y": 2}; for (k in h) { total += h[k]; } total`, 3},
+		{"let sum = 0; for (x in [1, 2, 3, 4, 5]) { if (x == 2) { continue; } if (x == 4) { break; } sum += x; } sum", 4},
+		{"let sum = 0; for (x in []) { sum += 1; } sum", 0},
+		{"let n = 0; for (a in [1, 2, 3]) { for (b in [1, 2, 3]) { if (b > a) { break; } n += 1; } } n", 6},
+		{"let f = fn(arr) { let sum = 0; for (x in arr) { sum += x; } sum }; f([10, 20]) + f([1])", 31},
+		{"let find = fn(arr, v) { let i = 0; for (x in arr) { if (x == v) { return i; } i += 1; } -1 }; find([5, 6, 7], 7)", 2},
+		{"let f = fn() { let i = 0; while (true) { i += 1; if (i > 3) { return i; } } }; f()", 4},
+		{"let f = fn() { while (false) { } }; f()", Null},
+		{"let i = 0; while (i < 100000) { i += 1; } i", 100000},
+		{"let fs = []; for (x in [1, 2, 3]) { fs = push(fs, fn() { x }); } fs[0]() + fs[2]()", 6},
+		{"let x = if (true) { let y = 1; }; x", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"for (x in 5) { }", "cannot iterate over INTEGER"},
+		{"let f = fn(a) { for (x in a) { x } }; f(true)", "cannot iterate over BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestTryStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{`let r = 0; try { throw 5 } catch (e) { r = e }; r`, 5},
+		{`let r = 0; try { r = 1 } catch (e) { r = 2 }; r`, 1},
+		{`let x = 0; try { x = 1; throw 2; x = 3 } catch (e) { x += e * 10 } finally { x += 100 }; x`, 121},
+		{`let r = ""; try { [1][true] } catch (e) { r = e["message"] }; r`, "index operator not supported: ARRAY"},
+		{`let r = ""; let f = fn(a) { a }; try { f(1, 2) } catch (e) { r = e["message"] }; r`, "wrong number of arguments: want=1, got=2"},
+		{`let r = ""; try { 1 + "a" } catch (e) { r = e["nothing"] }; r`, Null},
+		{`1 + if (true) { try { throw 1 } catch (e) { }; 2 } + 3`, 6},
+		{`let f = fn(a) { let b = 2; a + b + if (true) { try { throw 1 } catch (e) { b = e }; 10 } + b }; f(5)`, 18},
+		{`let f = fn(n) { if (n == 0) { throw "bottom" } 1 + f(n - 1) }; let r = ""; try { f(50) } catch (e) { r = e }; r`, "bottom"},
+		{`let f = fn() { try { throw "a" } catch (e) { throw e + "b" } }; let r = ""; try { f() } catch (e) { r = e }; r`, "ab"},
+		{`let r = ""; try { try { 1 + "a" } catch (e) { throw e } } catch (e) { r = e["message"] }; r`, "unsupported types for binary operation: INTEGER STRING"},
+		{`let r = 0; try { try { throw 1 } finally { r = 10 } } catch (e) { r += e }; r`, 11},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, 2},
+		{`let r = 0; let f = fn() { try { r = 1; return 5 } finally { r = 2 } }; f() + r`, 7},
+		{`let f = fn() { try { 1 } catch (e) { 2 } }; f()`, Null},
+		{`let f = fn() { try { 1 } catch (e) { return 2 } }; f(); 3`, 3},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue } n += x } finally { n += 10 } }; n`, 34},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { break } n += x } finally { n += 10 } }; n`, 21},
+		{`let f = fn() { for (x in [1, 2]) { try { return x } finally { x } } }; f()`, 1},
+		{`let n = 0; for (x in [1, 2, 3]) { try { throw x } finally { n += x; continue } }; n`, 6},
+		{`let n = 0; while (true) { n += 1; try { throw n } finally { if (n == 3) { break } continue } }; n`, 3},
+		{`let k = 0; while (k < 3) { try { k += 1; if (k == 2) { throw k } } catch (e) { k += 10 } }; k`, 12},
+		{`let mk = fn() { let x = 1; throw fn() { x } }; let r = 0; try { mk() } catch (e) { r = e() }; r`, 1},
+		{`let f = fn() {
+			let x = 5;
+			let h = fn() { x += 1; x };
+			let inner = fn() { h(); 1 + "a" };
+			try { inner() } catch (e) { }
+			h()
+		}; f()`, 7},
+		{`let deep = fn(n) { 1 + deep(n - 1) }; let r = ""; try { deep(0) } catch (e) { r = e["message"] }; r`, "stack overflow"},
+		{`let r = ""; try { len(1) } catch (e) { r = e["stack"][0] }; r`, "len (builtin)"},
+		{`let r = ""; try { push([], 1, 2) } catch (e) { r = e["message"] }; r`, "wrong number of arguments. got=3, want=2"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUncaughtErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw "boom"`, "uncaught exception: boom"},
+		{`throw [1, 2]`, "uncaught exception: [1, 2]"},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1"},
+		{`try { 1 + "a" } catch (e) { throw e }`, "unsupported types for binary operation: INTEGER STRING"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestCaughtErrorStack(t *testing.T) {
+	input := `let inner = fn() {
+	1 + "a"
+};
+let outer = fn() { let result = inner(); result };
+let stack = [];
+try {
+	outer();
+} catch (e) {
+	stack = e["stack"];
+}
+stack;`
+
+	expected := []string{"inner (line 2)", "outer (line 4)", "<main> (line 7)"}
+
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	stack, ok := vm.LastPoppedStackElem().(*object.Array)
+	if !ok {
+		t.Fatalf("stack is not Array. got=%T (%+v)", vm.LastPoppedStackElem(), vm.LastPoppedStackElem())
+	}
+	if len(stack.Elements) != len(expected) {
+		t.Fatalf("wrong stack length. want=%d, got=%d (%s)", len(expected), len(stack.Elements), stack.Inspect())
+	}
+	for i, frame := range expected {
+		err := assertStringObject(frame, stack.Elements[i])
+		if err != nil {
+			t.Errorf("frame %d: %s", i, err)
+		}
+	}
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", 10},
@@ -102,6 +368,10 @@ func TestStringExpressions(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"mon" + "key" == "monkey"`, true},
+		{`"monkey" == "banana"`, false},
+		{`"monkey" != "banana"`, true},
+		{`"monkey" != "monkey"`, false},
 	}
 
 	runVmTests(t, tests)
@@ -141,6 +411,68 @@ func TestHashLiterals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x %= 4", 2},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"let s = \"a\"; s += \"b\"; s", "ab"},
+		{"let f = fn(a) { a += 1; a * 2 }; f(1)", 4},
+		{"let f = fn() { let sum = 0; sum = sum + 10; sum }; f()", 10},
+		{"let f = fn() { let x = 1; let g = fn() { x += 1; x }; g() + g() }; f()", 5},
+		{"let a = [1, 2, 3]; a[1] = 20; a", []int{1, 20, 3}},
+		{"let a = [1, 2, 3]; a[2] += 10", 13},
+		{"let a = [1, 2, 3]; let b = a; b[0] = 7; a[0]", 7},
+		{"let a = [[1], [2]]; a[1][0] *= 5; a[1][0]", 10},
+		{"let h = {\"k\": 1}; h[\"k\"] += 1; h[\"k\"]", 2},
+		{"let h = {}; h[\"new\"] = 5; h[\"new\"]", 5},
+		{"let h = {}; h[1] = 1; h[true] = 2; h", map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 1,
+			True.HashKey():                        2,
+		}},
+		{"let i = 0; let a = [0, 0]; a[i = 1] = 9; a", []int{0, 9}},
+		{"let f = fn() { f = 1; f }; f() + f", 2},
+		{"let f = fn() { let g = fn() { fn() { g = 5 } }; g()(); g }; f()", 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [1]; a[1] = 2", "index out of range: 1 (length 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of range: -1 (length 1)"},
+		{"let a = [1]; a[\"x\"] = 2", "array index must be INTEGER, got STRING"},
+		{"let h = {}; h[fn() {}] = 2", "unusable as hash key: CLOSURE"},
+		{"let s = \"abc\"; s[0] = 2", "index assignment not supported: STRING"},
+		{"let h = {}; h[\"k\"] += 1", "unsupported types for binary operation: NULL INTEGER"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"[1, 2, 3][1]", 2},
@@ -204,6 +536,10 @@ func TestFunctionsWithReturnStatement(t *testing.T) {
 			`,
 			expected: 99,
 		},
+		{input: `return 5; 6`, expected: 5},
+		{input: `let f = fn() { 2 }; if (true) { return f() }; 3`, expected: 2},
+		{input: `for (x in [1, 2]) { return x }; 3`, expected: 1},
+		{input: `try { return 4 } finally { puts("done") }; 5`, expected: 4},
 	}
 
 	runVmTests(t, tests)
@@ -360,6 +696,92 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 
 }
 
+func TestArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		checked  bool
+		expected string
+	}{
+		{"1 / 0", false, "division by zero"},
+		{"1 % 0", false, "division by zero"},
+		{"let f = fn(x) { 10 / x }; f(0)", false, "division by zero"},
+		{"9223372036854775807 + 1", true, "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", true, "integer overflow: -9223372036854775807 - 2"},
+		{"let f = fn(x) { x * x }; f(4294967296)", true, "integer overflow: 4294967296 * 4294967296"},
+		{"2 ** 63", true, "integer overflow: 2 ** 63"},
+		{"1 << 63", true, "integer overflow: 1 << 63"},
+		{"1 << -1", false, "negative shift count: -1"},
+		{"1 >> -1", false, "negative shift count: -1"},
+		{"(1 << 64) << -1", false, "negative shift count: -1"},
+		{"1 << (1 << 64)", false, "shift count too large: 18446744073709551616"},
+		{"2 ** (1 << 64)", false, "exponent too large: 18446744073709551616"},
+		{"1 << 9000000000000000000", false, "shift count too large: 9000000000000000000"},
+		{"(1 << 64) << 1048576", false, "shift count too large: 1048576"},
+		{"2 ** 9000000000000000000", false, "exponent too large: 9000000000000000000"},
+		{"3 ** 2000000", false, "exponent too large: 2000000"},
+		{"1.5 & 1", false, "unknown operator: FLOAT & INTEGER"},
+		{"~1.5", false, "unknown operator: ~FLOAT"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.Config().CheckedArithmetic = tt.checked
+
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestBigIntPromotion(t *testing.T) {
+	tests := []vmTestCase{
+		{"9223372036854775807 + 1", bigInt("9223372036854775808")},
+		{"-9223372036854775807 - 2", bigInt("-9223372036854775809")},
+		{"4294967296 * 4294967296", bigInt("18446744073709551616")},
+		{"let big = 9223372036854775807 * 4; big / 4", 9223372036854775807},
+		{"let big = 9223372036854775807 + 1; big - 1", 9223372036854775807},
+		{"let big = 9223372036854775807 * 3; big * big", bigInt("765635325572111542626572170058092511241")},
+		{"-(-9223372036854775807 - 1)", bigInt("9223372036854775808")},
+		{"let big = 9223372036854775807 + 1; -big", -9223372036854775808},
+		{"(-9223372036854775807 - 1) / -1", bigInt("9223372036854775808")},
+		{"9223372036854775807 + 1 > 9223372036854775807", true},
+		{"9223372036854775807 < 9223372036854775807 + 1", true},
+		{"9223372036854775807 + 1 == 9223372036854775807 * 2 / 2 + 1", true},
+		{"(9223372036854775807 + 1) * 2 / 2 == 9223372036854775807 + 1", true},
+		{"9223372036854775807 + 1 != 5", true},
+		{"(9223372036854775807 + 1) * 1.0", 9223372036854775808.0},
+		{"let h = {9223372036854775807 + 1: \"big\"}; h[9223372036854775807 * 2 / 2 + 1]", "big"},
+		{"99999999999999999999", bigInt("99999999999999999999")},
+		{"0x1_0000_0000_0000_0000 - 1", bigInt("18446744073709551615")},
+		{"-9223372036854775808", -9223372036854775808},
+		{"9223372036854775808 - 1", 9223372036854775807},
+		{"9223372036854775808 == 9223372036854775807 + 1", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func bigInt(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big.Int literal " + s)
+	}
+	return v
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
@@ -406,6 +828,94 @@ func TestBuiltinFunctions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestBuiltinRuntimeErrors(t *testing.T) {
+	input := `let f = fn(x) {
+	len(x)
+};
+f(1);`
+
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	if runtimeErr.Builtin != "len" {
+		t.Errorf("wrong builtin. want=%q, got=%q", "len", runtimeErr.Builtin)
+	}
+
+	expected := "argument to `len` not supported, got INTEGER\n" +
+		"\tat len (builtin)\n" +
+		"\tat f (line 2)\n" +
+		"\tat <main> (line 4)"
+	if runtimeErr.Trace() != expected {
+		t.Errorf("wrong trace.\nwant=%q\ngot =%q", expected, runtimeErr.Trace())
+	}
+}
+
+// TestBuiltinErrorsMatchEvaluator checks that every misuse of a builtin
+// stops the VM with the error the evaluator stops with.
+func TestBuiltinErrorsMatchEvaluator(t *testing.T) {
+	inputs := []string{
+		`len(1)`,
+		`len()`,
+		`len("one", "two")`,
+		`first(1)`,
+		`first()`,
+		`last(1)`,
+		`last([1], [2])`,
+		`rest(1)`,
+		`rest()`,
+		`push(1, 1)`,
+		`push([1])`,
+		`let f = fn(a) { first(a) }; f("x")`,
+		`let xs = [1, 2]; len(xs) + len(true)`,
+		`if (len(1) > 0) { 1 } else { 2 }`,
+		`for (x in [1, "a", 2]) { push(x, 1) }`,
+	}
+
+	for _, input := range inputs {
+		program := parse(input)
+
+		evaluated := evaluator.Eval(program, object.NewEnvironment())
+		evalErr, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Fatalf("evaluator returned no error for %q. got=%T (%+v)", input, evaluated, evaluated)
+		}
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("VM returned no runtime error for %q. got=%T (%+v)", input, err, err)
+		}
+
+		if runtimeErr.Message != evalErr.Message {
+			t.Errorf("messages differ for %q. evaluator=%q, vm=%q", input, evalErr.Message, runtimeErr.Message)
+		}
+		stack := make([]string, len(runtimeErr.StackTrace))
+		for i, frame := range runtimeErr.StackTrace {
+			stack[i] = frame.String()
+		}
+		if strings.Join(stack, ",") != strings.Join(evalErr.Stack, ",") {
+			t.Errorf("stacks differ for %q. evaluator=%v, vm=%v", input, evalErr.Stack, stack)
+		}
+	}
+}
+
 func TestClosures(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -474,6 +984,81 @@ func TestClosures(t *testing.T) {
 				closure();`,
 			expected: 99,
 		},
+		{
+			input: `
+				let newCounter = fn() {
+					let count = 0;
+					fn() { count += 1 };
+				};
+				let counter = newCounter();
+				counter();
+				counter();
+				counter();`,
+			expected: 3,
+		},
+		{
+			input: `
+				let pair = fn() {
+					let count = 0;
+					let inc = fn() { count += 1 };
+					let get = fn() { count };
+					[inc, get];
+				};
+				let p = pair();
+				p[0]();
+				p[0]();
+				p[1]();`,
+			expected: 2,
+		},
+		{
+			input: `
+				let f = fn() {
+					let x = 1;
+					let set = fn(v) { x = v };
+					set(5);
+					x;
+				};
+				f();`,
+			expected: 5,
+		},
+		{
+			input: `
+				let f = fn() {
+					let x = 1;
+					let get = fn() { x };
+					x = 10;
+					get();
+				};
+				f();`,
+			expected: 10,
+		},
+		{
+			input: `
+				let f = fn(a) {
+					fn() {
+						fn() { a *= 2 };
+					};
+				};
+				let middle = f(3);
+				let double = middle();
+				double();
+				let again = middle();
+				again();`,
+			expected: 12,
+		},
+		{
+			input: `
+				let make = fn(start) {
+					let count = start;
+					fn() { count += 1 };
+				};
+				let a = make(0);
+				let b = make(100);
+				a();
+				b();
+				a() + b();`,
+			expected: 104,
+		},
 	}
 
 	runVmTests(t, tests)
@@ -532,6 +1117,224 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } };
+				countDown(100000);`,
+			expected: 0,
+		},
+		{
+			input: `
+				let countDown = fn(x) {
+					if (x == 0) { return 0; }
+					return countDown(x - 1);
+				};
+				countDown(100000);`,
+			expected: 0,
+		},
+		{
+			input: `
+				let isEven = fn(n, isOdd) { if (n == 0) { true } else { isOdd(n - 1, isEven) } };
+				let isOdd = fn(n, isEven) { if (n == 0) { false } else { isEven(n - 1, isOdd) } };
+				isEven(100001, isOdd);`,
+			expected: false,
+		},
+		{
+			input: `
+				let wrapper = fn() {
+					let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + n) } };
+					loop(100000, 0);
+				};
+				wrapper();`,
+			expected: 5000050000,
+		},
+		{
+			input:    `let size = fn(a) { len(a) }; size([1, 2, 3]);`,
+			expected: 3,
+		},
+		{
+			input: `
+				let collect = fn(n, fns) {
+					if (n == 0) { return fns; }
+					let x = n;
+					collect(n - 1, push(fns, fn() { x }))
+				};
+				let fns = collect(3, []);
+				[fns[0](), fns[1](), fns[2]()];`,
+			expected: []int{3, 2, 1},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCallsOverLargeArray(t *testing.T) {
+	elements := make([]object.Object, 100000)
+	for i := range elements {
+		elements[i] = &object.Integer{Value: int64(i)}
+	}
+
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	globals := make([]object.Object, GlobalsSize)
+	globals[symbolTable.Define("arr").Index] = &object.Array{Elements: elements}
+
+	input := `
+		let sum = fn(i, acc) {
+			if (i == len(arr)) { return acc; }
+			sum(i + 1, acc + arr[i])
+		};
+		sum(0, 0);`
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithGlobalsStore(comp.Bytecode(), globals)
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	assertExpectedObject(t, 4999950000, vm.LastPoppedStackElem())
+}
+
+func TestDeepRecursion(t *testing.T) {
+	input := `let countDown = fn(x) { if (x == 0) { 0 } else { 1 + countDown(x - 1) } }; countDown(100000);`
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	if err.Error() != "stack overflow" {
+		t.Fatalf("wrong VM error: want=%q, got=%q", "stack overflow", err)
+	}
+}
+
+func TestCallChecksLocalsFit(t *testing.T) {
+	// g reads its last local before pushing anything, near the top of the
+	// stack, whether it is called normally or in place of h's frame
+	g := &object.CompiledFunction{
+		Instructions: append(code.Make(code.OpGetLocal, 254), code.Make(code.OpReturnValue)...),
+		NumLocals:    255,
+	}
+	h := &object.CompiledFunction{
+		Instructions: append(append(code.Make(code.OpClosure, 1, 0), code.Make(code.OpTailCall, 0)...), code.Make(code.OpReturnValue)...),
+	}
+
+	for _, callee := range []int{1, 2} {
+		var main code.Instructions
+		for i := 0; i < StackSize-200; i++ {
+			main = append(main, code.Make(code.OpConstant, 0)...)
+		}
+		main = append(main, code.Make(code.OpClosure, callee, 0)...)
+		main = append(main, code.Make(code.OpCall, 0)...)
+
+		err := New(&compiler.Bytecode{
+			Instructions: main,
+			Constants:    []object.Object{&object.Integer{Value: 1}, g, h},
+		}).Run()
+		if err == nil || err.Error() != "stack overflow" {
+			t.Errorf("wrong VM error calling constant %d: want=%q, got=%v", callee, "stack overflow", err)
+		}
+	}
+}
+
+func TestInvalidBytecode(t *testing.T) {
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{
+				Instructions: append(code.Make(code.OpConstant, 0), code.Make(code.OpIterNext, 6)...),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+			"not an iterator: INTEGER",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 5)},
+			"invalid function <main>: OpConstant at 0: constant 5 of 0",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpArray, 3)},
+			"invalid function <main>: OpArray at 0 takes 3 values, 0 on the stack",
+		},
+	}
+
+	for _, tt := range tests {
+		err := New(tt.bytecode).Run()
+		if err == nil {
+			t.Errorf("expected VM error for %q but resulted in none.", tt.bytecode.Instructions)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error for %q: want=%q, got=%q", tt.bytecode.Instructions, tt.expected, err)
+		}
+	}
+}
+
+func TestUndefinedVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{`if (false) { let y = 2; }; y`, &object.Error{Message: "variable used before it is defined"}},
+		{`let f = fn(c) { if (c) { let x = 1; }; x }; f(false)`,
+			&object.Error{Message: "variable used before it is defined"}},
+		{`let f = fn(c) { if (c) { let x = 1; }; fn() { x } }; f(false)()`,
+			&object.Error{Message: "variable used before it is defined"}},
+		// the slot of x must not keep the value of the first call
+		{`let f = fn(c) { if (c) { let x = 1; }; x }; f(true); f(false)`,
+			&object.Error{Message: "variable used before it is defined"}},
+		{`let f = fn(c) { if (c) { let x = 1; }; x }; f(true)`, 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinPanics(t *testing.T) {
+	boom := &object.Builtin{Name: "boom", Fn: func(args ...object.Object) object.Object {
+		return args[5]
+	}}
+	set := append(object.PureBuiltins(), object.BuiltinDefinition{Name: "boom", Builtin: boom})
+
+	comp := compiler.NewWithBuiltins(set)
+	if err := comp.Compile(parse("let f = fn() { boom(1) }; f()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.Config().Builtins = set
+	err := vm.Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	if runtimeErr.Builtin != "boom" {
+		t.Errorf("wrong builtin. want=%q, got=%q", "boom", runtimeErr.Builtin)
+	}
+
+	expected := "boom panicked: runtime error: index out of range [5] with length 1\n" +
+		"\tat boom (builtin)\n" +
+		"\tat f (line 1)\n" +
+		"\tat <main> (line 1)"
+	if runtimeErr.Trace() != expected {
+		t.Errorf("wrong trace.\nwant=%q\ngot =%q", expected, runtimeErr.Trace())
+	}
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -551,6 +1354,20 @@ func assertExpectedObject(
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := assertFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
+	case *big.Int:
+		result, ok := actual.(*object.BigInt)
+		if !ok {
+			t.Errorf("object is not BigInt. got=%T (%+v)", actual, actual)
+			return
+		}
+		if result.Value.Cmp(expected) != 0 {
+			t.Errorf("object has wrong value. got=%s, want=%s", result.Value, expected)
+		}
 	case bool:
 		err := assertBooleanObject(expected, actual)
 		if err != nil {
@@ -609,16 +1426,6 @@ func assertExpectedObject(
 			}
 		}
 
-	case *object.Error:
-		errObj, ok := actual.(*object.Error)
-		if !ok {
-			t.Errorf("object is not Error: %T (%+v)", actual, actual)
-			return
-		}
-		if errObj.Message != expected.Message {
-			t.Errorf("wrong error message. expected=%q, got=%q",
-				expected.Message, errObj.Message)
-		}
 	}
 }
 
@@ -665,6 +1472,18 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 
 		vm := New(comp.Bytecode())
 		err = vm.Run()
+
+		// an expected error is a runtime error, not a value
+		if expected, ok := tt.expected.(*object.Error); ok {
+			if err == nil {
+				t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+			}
+			if err.Error() != expected.Message {
+				t.Errorf("wrong VM error: want=%q, got=%q", expected.Message, err)
+			}
+			continue
+		}
+
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
 		}
@@ -689,3 +1508,469 @@ func assertIntegerObject(expected int64, actual object.Object) error {
 
 	return nil
 }
+
+func TestRuntimeErrorStackTrace(t *testing.T) {
+	input := `let add = fn(a, b) {
+	a + b
+};
+let apply = fn(f) {
+	let x = 1;
+	f(x)
+};
+apply(add);
+`
+
+	l := lexer.NewWithFilename(input, "trace.mk")
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	expectedTrace := []StackFrame{
+		{Function: "apply", Filename: "trace.mk", Line: 6},
+		{Function: "<main>", Filename: "trace.mk", Line: 8},
+	}
+
+	if len(runtimeErr.StackTrace) != len(expectedTrace) {
+		t.Fatalf("wrong stack trace length. want=%d, got=%d (%+v)",
+			len(expectedTrace), len(runtimeErr.StackTrace), runtimeErr.StackTrace)
+	}
+
+	for i, frame := range expectedTrace {
+		if runtimeErr.StackTrace[i] != frame {
+			t.Errorf("wrong frame %d. want=%+v, got=%+v",
+				i, frame, runtimeErr.StackTrace[i])
+		}
+	}
+
+	expected := `wrong number of arguments: want=2, got=1
+	at apply (trace.mk:6)
+	at <main> (trace.mk:8)`
+	if runtimeErr.Trace() != expected {
+		t.Errorf("wrong trace.\nwant=%q\ngot =%q", expected, runtimeErr.Trace())
+	}
+}
+
+func TestRuntimeErrorStackTraceInnermostFrame(t *testing.T) {
+	input := `let inner = fn() {
+	1 + "a"
+};
+let outer = fn() { let result = inner(); result };
+outer();`
+
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	expected := `unsupported types for binary operation: INTEGER STRING
+	at inner (line 2)
+	at outer (line 4)
+	at <main> (line 5)`
+	if runtimeErr.Trace() != expected {
+		t.Errorf("wrong trace.\nwant=%q\ngot =%q", expected, runtimeErr.Trace())
+	}
+}
+
+func assertFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+	}
+
+	return nil
+}
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		input    string
+		args     []object.Object
+		expected interface{}
+	}{
+		{"fn(a, b) { a + b }", []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}}, 3},
+		{"let g = 10; fn(a) { a * g }", []object.Object{&object.Integer{Value: 4}}, 40},
+		{"let make = fn(n) { fn() { n += 1 } }; let c = make(1); c(); c", nil, 3},
+		{"let f = fn(n) { if (n == 0) { return 0 } f(n - 1) }; f", []object.Object{&object.Integer{Value: 5000}}, 0},
+		{"fn() { try { len(1) } catch (e) { return 7 } }", nil, 7},
+		{"len", []object.Object{&object.String{Value: "abc"}}, 3},
+		{"fn(a) { a }", nil, &object.Error{Message: "wrong number of arguments: want=1, got=0"}},
+		{`fn() { throw "boom" }`, nil, &object.Error{Message: "uncaught exception: boom"}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		result, err := vm.Call(vm.LastPoppedStackElem(), tt.args...)
+
+		if expected, ok := tt.expected.(*object.Error); ok {
+			if err == nil {
+				t.Fatalf("expected error for %q but resulted in none.", tt.input)
+			}
+			if err.Error() != expected.Message {
+				t.Errorf("wrong error: want=%q, got=%q", expected.Message, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("call error for %q: %s", tt.input, err)
+		}
+		assertExpectedObject(t, tt.expected, result)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	tests := []struct {
+		input           string
+		maxInstructions int64
+		stopped         bool
+	}{
+		{"1 + 2", 4, false},
+		{"1 + 2", 3, true},
+		{"while (true) { }", 1000, true},
+		{"let f = fn() { f() }; f()", 1000, true},
+		{"let f = fn(n) { 1 + f(n) }; try { f(1) } catch (e) { 0 }", 100000, false},
+		{"let n = 0; try { while (true) { n += 1 } } catch (e) { n = -1 } finally { n = -2 }", 1000, true},
+		{"let n = 0; while (n < 100) { n += 1 }", 0, false},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.Config().MaxInstructions = tt.maxInstructions
+		err := vm.Run()
+
+		if !tt.stopped {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, object.ErrInstructionLimit) {
+			t.Errorf("expected the instruction limit to stop %q, got %v", tt.input, err)
+			continue
+		}
+		if err.Error() != "instruction limit exceeded" {
+			t.Errorf("wrong error message. got=%q", err)
+		}
+		if runtimeErr := err.(*RuntimeError); len(runtimeErr.StackTrace) == 0 {
+			t.Errorf("expected a stack trace for %q", tt.input)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("try { while (true) { } } catch (e) { }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+
+	tests := []struct {
+		ctx   context.Context
+		cause error
+	}{
+		{cancelled, context.Canceled},
+		{timeout, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		err := New(comp.Bytecode()).RunContext(tt.ctx)
+		if !errors.Is(err, tt.cause) {
+			t.Errorf("wrong error. want cause %v, got=%v", tt.cause, err)
+		}
+		if errors.Is(err, object.ErrInstructionLimit) {
+			t.Errorf("cancellation reported as instruction limit: %v", err)
+		}
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("fn() { while (true) { } }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	vm.Config().MaxInstructions = 500
+	_, err := vm.Call(vm.LastPoppedStackElem())
+	if !errors.Is(err, object.ErrInstructionLimit) {
+		t.Errorf("expected the instruction limit to stop the call, got %v", err)
+	}
+
+	vm.Config().MaxInstructions = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = vm.CallContext(ctx, vm.LastPoppedStackElem())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation to stop the call, got %v", err)
+	}
+}
+
+func TestAllocationLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   object.Config
+		expected string
+	}{
+		{"push([1, 2], 3)", object.Config{MaxArrayLength: 3}, ""},
+		{"[1, 2, 3, 4]", object.Config{MaxArrayLength: 3}, "allocation limit exceeded: array of 4 elements, limit 3"},
+		{"let a = []; while (true) { a = push(a, 1) }", object.Config{MaxArrayLength: 3},
+			"allocation limit exceeded: array of 4 elements, limit 3"},
+		{`let s = "ab"; while (true) { s = s + s }`, object.Config{MaxStringLength: 8},
+			"allocation limit exceeded: string of 16 bytes, limit 8"},
+		{"{1: 1, 2: 2, 3: 3}", object.Config{MaxHashSize: 2}, "allocation limit exceeded: hash of 3 pairs, limit 2"},
+		{"let h = {}; h[1] = 1; h[1] = 2; h[2] = 2; h[3] = 3", object.Config{MaxHashSize: 2},
+			"allocation limit exceeded: hash of 3 pairs, limit 2"},
+		{"let n = 0; while (true) { let a = [n]; n += 1 }", object.Config{MaxAllocations: 10},
+			"allocation limit exceeded: more than 10 allocations"},
+		{"let f = fn() { fn() { 1 } }; while (true) { f() }", object.Config{MaxAllocations: 5},
+			"allocation limit exceeded: more than 5 allocations"},
+		{"let a = []; try { while (true) { a = push(a, 1) } } catch (e) { 0 }", object.Config{MaxArrayLength: 100},
+			"allocation limit exceeded: array of 101 elements, limit 100"},
+		{"let x = 1 << 100; while (true) { x = x * x }", object.Config{MaxStringLength: 100},
+			"allocation limit exceeded: integer of 104 bytes, limit 100"},
+		{"7 ** 1000", object.Config{MaxStringLength: 100}, "allocation limit exceeded: integer of 256 bytes, limit 100"},
+		{"try { 1 << 1000 } catch (e) { 0 }", object.Config{MaxStringLength: 100},
+			"allocation limit exceeded: integer of 128 bytes, limit 100"},
+		{"let n = 1 << 64; while (true) { n += 1 }", object.Config{MaxAllocations: 10},
+			"allocation limit exceeded: more than 10 allocations"},
+		{"(1 << 64) * 3", object.Config{MaxStringLength: 100, MaxAllocations: 10}, ""},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		*vm.Config() = tt.config
+		err := vm.Run()
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, object.ErrAllocationLimit) {
+			t.Errorf("expected an allocation limit to stop %q, got %v", tt.input, err)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestBuiltinSets(t *testing.T) {
+	compile := func(input string, set object.BuiltinSet) (*compiler.Bytecode, error) {
+		comp := compiler.NewWithBuiltins(set)
+		err := comp.Compile(parse(input))
+		return comp.Bytecode(), err
+	}
+
+	var stdout bytes.Buffer
+	set := object.NewBuiltins(object.Host{Stdout: &stdout})
+	bc, err := compile(`puts("out", len("four"))`, set)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(bc)
+	vm.Config().Builtins = set
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if stdout.String() != "out\n4\n" {
+		t.Errorf("wrong stdout. got=%q", stdout.String())
+	}
+
+	_, err = compile(`puts("out")`, object.PureBuiltins())
+	if err == nil || err.Error() != "1:1: undefined variable puts" {
+		t.Errorf("expected puts to be undefined with pure builtins, got %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		compiled object.BuiltinSet
+		run      object.BuiltinSet
+		expected string
+	}{
+		{`len("abc")`, object.PureBuiltins(), set, "program compiled with builtin 1 first, but it is puts"},
+		{`first([1])`, set, object.PureBuiltins(), "program compiled with builtin 1 puts, but it is first"},
+		{`push([], 1)`, set, set[:5], "program compiled with builtin 5 push, but there are only 5 builtins"},
+		{`len("abc")`, object.PureBuiltins(), append(object.PureBuiltins(), set[1]), ""},
+	}
+
+	for _, tt := range tests {
+		bc, err := compile(tt.input, tt.compiled)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm = New(bc)
+		vm.Config().Builtins = tt.run
+		err = vm.Run()
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+
+	// Bytecode without builtin names is not checked before it runs.
+	bc, err = compile(`push([], 1)`, set)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bc.Builtins = nil
+	vm = New(bc)
+	vm.Config().Builtins = set[:5]
+	err = vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "undefined builtin 5") {
+		t.Errorf("expected the missing builtin to fail, got %v", err)
+	}
+}
+
+func TestCallFromBuiltinSharesBudget(t *testing.T) {
+	var machine *VirtualMachine
+	set := append(object.PureBuiltins(), object.BuiltinDefinition{
+		Name: "repeat",
+		Builtin: &object.Builtin{Name: "repeat", Fn: func(args ...object.Object) object.Object {
+			for i := 0; i < 100; i++ {
+				if _, err := machine.Call(args[0]); err != nil {
+					return &object.Error{Message: err.Error(), Cause: err.(*RuntimeError).Cause}
+				}
+			}
+			return nil
+		}},
+	})
+
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltins(set)
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	input := "try { repeat(fn() { let n = 0; while (n < 10) { n += 1 } }) } catch (e) { 0 }"
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine = New(comp.Bytecode())
+	machine.Config().Builtins = set
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if machine.budget.Instructions() < 100*10 {
+		t.Errorf("calls were not counted. got=%d instructions", machine.budget.Instructions())
+	}
+
+	// Each call runs well within the limit, but all of them together do not.
+	machine = New(comp.Bytecode())
+	machine.Config().Builtins = set
+	machine.Config().MaxInstructions = 1000
+	err := machine.Run()
+	if !errors.Is(err, object.ErrInstructionLimit) {
+		t.Errorf("expected the instruction limit to stop the calls, got %v", err)
+	}
+}
+
+func TestCallFromBuiltinOverflows(t *testing.T) {
+	var machine *VirtualMachine
+	set := append(object.PureBuiltins(), object.BuiltinDefinition{
+		Name: "call",
+		Builtin: &object.Builtin{Name: "call", Fn: func(args ...object.Object) object.Object {
+			result, err := machine.Call(args[0])
+			if err != nil {
+				return &object.Error{Message: err.Error()}
+			}
+			return result
+		}},
+	})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let f = fn() { call(f) }; f()", "stack overflow"},
+		{"let f = fn() { 1 + call(f) }; call(f)", "stack overflow"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { call(fn() { f(n - 1) }) } }; f(100)", ""},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.NewWithBuiltins(set)
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine = New(comp.Bytecode())
+		machine.Config().Builtins = set
+		err := machine.Run()
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong VM error for %q: want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}